@@ -0,0 +1,126 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import "reflect"
+
+// An Allocator provides the memory for pointers, slices and byte data
+// created while decoding. The memory it returns must be zeroed.
+type Allocator interface {
+	// New returns a pointer to a new zero value of type t.
+	New(t reflect.Type) reflect.Value
+	// MakeSlice returns a new zeroed slice of type t and length l.
+	MakeSlice(t reflect.Type, l int) reflect.Value
+	// Bytes returns a new zeroed byte slice of length l.
+	Bytes(l int) []byte
+}
+
+// SetAllocator makes the Decoder allocate through a. A nil a restores
+// the default of allocating every value on its own.
+func (dec *Decoder) SetAllocator(a Allocator) {
+	dec.o.Allocator = a
+}
+
+const (
+	slabLen   = 64
+	slabBytes = 4096
+)
+
+// Region is an Allocator carving values out of shared slabs, so that
+// many small values are allocated together and freed together once
+// none of them is referenced any more. Its zero value is ready to use.
+// A Region must not be used concurrently.
+type Region struct {
+	slabs map[reflect.Type]reflect.Value
+	bytes []byte
+}
+
+// slab returns n consecutive zero values of type t.
+func (r *Region) slab(t reflect.Type, n int) reflect.Value {
+	if n > slabLen/4 {
+		return reflect.MakeSlice(reflect.SliceOf(t), n, n)
+	}
+	s, ok := r.slabs[t]
+	if !ok || s.Cap()-s.Len() < n {
+		if r.slabs == nil {
+			r.slabs = make(map[reflect.Type]reflect.Value)
+		}
+		s = reflect.MakeSlice(reflect.SliceOf(t), 0, slabLen)
+	}
+	l := s.Len()
+	r.slabs[t] = s.Slice(0, l+n)
+	return s.Slice3(l, l+n, l+n)
+}
+
+// New implements Allocator.
+func (r *Region) New(t reflect.Type) reflect.Value {
+	return r.slab(t, 1).Index(0).Addr()
+}
+
+// MakeSlice implements Allocator.
+func (r *Region) MakeSlice(t reflect.Type, l int) reflect.Value {
+	return r.slab(t.Elem(), l).Convert(t)
+}
+
+// Bytes implements Allocator.
+func (r *Region) Bytes(l int) []byte {
+	if l > slabBytes/4 {
+		return make([]byte, l)
+	}
+	if r.bytes == nil || cap(r.bytes)-len(r.bytes) < l {
+		r.bytes = make([]byte, 0, slabBytes)
+	}
+	n := len(r.bytes)
+	r.bytes = r.bytes[:n+l]
+	return r.bytes[n : n+l : n+l]
+}
+
+// Reset makes r start over on new slabs.
+// Values allocated before stay valid.
+func (r *Region) Reset() {
+	*r = Region{}
+}
+
+func (d *decoder) new(t reflect.Type) reflect.Value {
+	if d.alloc == nil {
+		return reflect.New(t)
+	}
+	return d.alloc.New(t)
+}
+
+// maxPrealloc bounds the bytes allocated for a length ahead of its input,
+// unless the length is checked against the size of the input.
+const maxPrealloc = 64 << 10
+
+// prealloc returns how many of l elements of the given size
+// to allocate before their input arrives.
+func (d *decoder) prealloc(l int, size uintptr) int {
+	if d.lim != nil || d.left != nil || size == 0 {
+		return l
+	}
+	return min(l, max(maxPrealloc/int(size), 1))
+}
+
+// makeSlice makes a slice of length l, or shorter if the size of the input
+// is unknown. Callers grow it as elements arrive, see grow.
+func (d *decoder) makeSlice(t reflect.Type, l int) reflect.Value {
+	d.checkAlloc(uint64(l), t.Elem().Size())
+	return d.allocSlice(t, d.prealloc(l, t.Elem().Size()))
+}
+
+// grow lengthens the slice v towards l elements, at least to n.
+func (d *decoder) grow(v reflect.Value, n, l int) {
+	s := d.allocSlice(v.Type(), max(n, min(2*v.Len(), l)))
+	reflect.Copy(s, v)
+	v.Set(s)
+}
+
+// allocSlice makes a slice without checking its length.
+func (d *decoder) allocSlice(t reflect.Type, l int) reflect.Value {
+	if d.alloc == nil {
+		return reflect.MakeSlice(t, l, l)
+	}
+	return d.alloc.MakeSlice(t, l)
+}
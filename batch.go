@@ -0,0 +1,69 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"io"
+	"reflect"
+)
+
+// EncodeSlice marshals the elements of the slice vs and writes them to w
+// after their count, looking up how to encode their type only once.
+// Outside of PreserveNil mode, it is laid out like the slice itself.
+// It panics if vs is not a slice or its elements are of an invalid type.
+func EncodeSlice(w io.Writer, vs interface{}) error {
+	return NewEncoder(w).EncodeSlice(vs)
+}
+
+// DecodeSlice reads elements written by EncodeSlice from r
+// into the slice vs points to.
+// It panics if vs does not point to a slice or its elements are of an invalid type.
+func DecodeSlice(r io.Reader, vs interface{}) error {
+	return lenient(r).DecodeSlice(vs)
+}
+
+// EncodeSlice marshals the elements of the slice vs and writes them to the stream,
+// see the EncodeSlice function.
+func (enc *Encoder) EncodeSlice(vs interface{}) error {
+	return enc.encode(nil, reflect.ValueOf(vs), true)
+}
+
+// DecodeSlice reads elements written by EncodeSlice from the stream
+// into the slice vs points to, see the DecodeSlice function.
+func (dec *Decoder) DecodeSlice(vs interface{}) error {
+	return dec.decode(nil, reflect.ValueOf(vs), true)
+}
+
+// batch returns the machine for a batch of elements of the slice type t.
+func (g *_types) batch(t reflect.Type) machine {
+	if t.Kind() != reflect.Slice {
+		panic("enc: batch of non-slice type " + t.String())
+	}
+	return &batchMachine{t, g.get(t.Elem())}
+}
+
+type batchMachine struct {
+	t reflect.Type
+	m machine
+}
+
+func (m *batchMachine) encode(e *encoder, v reflect.Value) {
+	l := v.Len()
+	e.encodeUint(uint64(l))
+	for i := 0; i < l; i++ {
+		e.encodeAt(m.m, v.Index(i), step{i: i})
+	}
+}
+
+func (m *batchMachine) decode(d *decoder, v reflect.Value) {
+	l := d.decodeCount()
+	v.Set(d.makeSlice(m.t, l))
+	for i := 0; i < l; i++ {
+		if i == v.Len() {
+			d.grow(v, i+1, l)
+		}
+		d.decodeAt(m.m, v.Index(i), step{i: i})
+	}
+}
@@ -118,3 +118,39 @@ func BenchmarkDecodeGob(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkEncodeFastFields(b *testing.B) {
+	v := FastPlain{I: 1 << 20, S: "hello", F: 1.5, Flat: Flat{1, 2, 3}}
+	e := NewEncoder(nilWriter{})
+	for i := 0; i < b.N; i++ {
+		e.Encode(&v)
+	}
+}
+
+func BenchmarkEncodePlain(b *testing.B) {
+	v := Plain{I: 1 << 20, S: "hello", F: 1.5, Flat: Flat{1, 2, 3}}
+	e := NewEncoder(nilWriter{})
+	for i := 0; i < b.N; i++ {
+		e.Encode(&v)
+	}
+}
+
+func BenchmarkEncodeConcurrent(b *testing.B) {
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := Encode(nilWriter{}, benchValue); err != nil {
+				b.Log(err)
+			}
+		}
+	})
+}
+
+func BenchmarkPointerChain(b *testing.B) {
+	f := &Flat{1, 2, 3}
+	pf := &f
+	v := &pf
+	e := NewEncoder(nilWriter{})
+	for i := 0; i < b.N; i++ {
+		e.Encode(&v)
+	}
+}
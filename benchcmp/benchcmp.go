@@ -0,0 +1,158 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package benchcmp compares the size and speed of enc with those of other
+// encodings on values of your own types. A command comparing them on a
+// sample value takes a single line:
+//
+//	func main() {
+//		benchcmp.Main(&sample)
+//	}
+//
+// Other encodings, like protocol buffers for registered messages,
+// are compared by appending them to Formats.
+package benchcmp
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"runtime"
+	"text/tabwriter"
+	"time"
+
+	"github.com/koneu/enc"
+)
+
+// A Format is an encoding to compare.
+type Format struct {
+	Name      string
+	Marshal   func(v interface{}) ([]byte, error)
+	Unmarshal func(b []byte, v interface{}) error
+}
+
+// Formats are the encodings compared by Main.
+var Formats = []Format{
+	{"enc", func(v interface{}) ([]byte, error) {
+		var buf bytes.Buffer
+		err := enc.Encode(&buf, v)
+		return buf.Bytes(), err
+	}, func(b []byte, v interface{}) error {
+		return enc.Decode(bytes.NewReader(b), v)
+	}},
+	{"gob", func(v interface{}) ([]byte, error) {
+		var buf bytes.Buffer
+		err := gob.NewEncoder(&buf).Encode(v)
+		return buf.Bytes(), err
+	}, func(b []byte, v interface{}) error {
+		return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+	}},
+	{"json", json.Marshal, json.Unmarshal},
+}
+
+// A Result holds the measurements of a Format.
+type Result struct {
+	Format string
+	// Bytes is the size of the encoding.
+	Bytes int
+	// Encode and Decode are the times an operation took on average,
+	// and EncodeAllocs and DecodeAllocs the allocations it made.
+	Encode, Decode             time.Duration
+	EncodeAllocs, DecodeAllocs uint64
+	// Equal reports whether the decoded value is deeply equal to the
+	// encoded one, see reflect.DeepEqual.
+	Equal bool
+	// Err is the first error encoding or decoding, if any.
+	Err error
+}
+
+// Compare encodes and decodes v in every format, each for about d,
+// and returns the results in the same order.
+func Compare(v interface{}, d time.Duration, formats ...Format) []Result {
+	ret := make([]Result, len(formats))
+	for i, f := range formats {
+		ret[i] = compare(v, d, f)
+	}
+	return ret
+}
+
+func compare(v interface{}, d time.Duration, f Format) Result {
+	r := Result{Format: f.Name}
+	b, err := f.Marshal(v)
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	r.Bytes = len(b)
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	w := reflect.New(t)
+	if r.Err = f.Unmarshal(b, w.Interface()); r.Err != nil {
+		return r
+	}
+	r.Equal = reflect.DeepEqual(reflect.Indirect(reflect.ValueOf(v)).Interface(), w.Elem().Interface())
+
+	r.Encode, r.EncodeAllocs, r.Err = measure(d, func() error {
+		_, err := f.Marshal(v)
+		return err
+	})
+	if r.Err == nil {
+		r.Decode, r.DecodeAllocs, r.Err = measure(d, func() error {
+			return f.Unmarshal(b, reflect.New(t).Interface())
+		})
+	}
+	return r
+}
+
+// measure runs op for about d, and returns the time and allocations it took on average.
+func measure(d time.Duration, op func() error) (time.Duration, uint64, error) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	n := 0
+	for ; n == 0 || time.Since(start) < d; n++ {
+		if err := op(); err != nil {
+			return 0, 0, err
+		}
+	}
+	took := time.Since(start)
+	runtime.ReadMemStats(&after)
+	return took / time.Duration(n), (after.Mallocs - before.Mallocs) / uint64(n), nil
+}
+
+// Print writes rs to w as a table.
+func Print(w io.Writer, rs []Result) error {
+	t := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(t, "format\tbytes\tencode\tallocs\tdecode\tallocs\tequal\t")
+	for _, r := range rs {
+		if r.Err != nil {
+			fmt.Fprintf(t, "%s\t%v\t\t\t\t\t\t\n", r.Format, r.Err)
+			continue
+		}
+		fmt.Fprintf(t, "%s\t%d\t%v\t%d\t%v\t%d\t%v\t\n",
+			r.Format, r.Bytes, r.Encode, r.EncodeAllocs, r.Decode, r.DecodeAllocs, r.Equal)
+	}
+	return t.Flush()
+}
+
+// Main compares Formats on v and prints the results to standard output.
+// The time spent on each operation is set with the -d flag.
+func Main(v interface{}) {
+	log.SetFlags(0)
+	log.SetPrefix("benchcmp: ")
+	d := flag.Duration("d", time.Second, "time spent on each operation")
+	flag.Parse()
+	if err := Print(os.Stdout, Compare(v, *d, Formats...)); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,48 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package benchcmp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type Sample struct {
+	ID   int
+	Name string
+	Tags []string
+}
+
+func TestCompare(t *testing.T) {
+	v := Sample{1, "sample", []string{"a", "b"}}
+	failing := Format{"failing", func(interface{}) ([]byte, error) {
+		return nil, errors.New("unsupported")
+	}, nil}
+	rs := Compare(&v, time.Millisecond, append(Formats, failing)...)
+	if len(rs) != 4 {
+		t.Fatalf("%d results", len(rs))
+	}
+	for _, r := range rs[:3] {
+		if r.Err != nil || r.Bytes == 0 || r.Encode <= 0 || r.Decode <= 0 || !r.Equal {
+			t.Errorf("unexpected result %+v", r)
+		}
+	}
+	if rs[0].Bytes >= rs[2].Bytes {
+		t.Errorf("enc took %d bytes, json %d", rs[0].Bytes, rs[2].Bytes)
+	}
+	if rs[3].Err == nil {
+		t.Error("error not reported")
+	}
+
+	var b strings.Builder
+	if err := Print(&b, rs); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(b.String(), "\n"); len(lines) != 6 || !strings.Contains(lines[4], "unsupported") {
+		t.Errorf("unexpected table\n%s", b.String())
+	}
+}
@@ -0,0 +1,92 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// A RangeError indicates that the decoded Value of the field Name of
+// the struct type T is out of the bounds set by its min and max tags.
+type RangeError struct {
+	T     reflect.Type
+	Name  string
+	Value interface{}
+}
+
+func (r RangeError) Error() string {
+	return fmt.Sprintf("enc: field %s of %s out of range: %v", r.Name, r.T, r.Value)
+}
+
+// bounds holds the limits set by the `enc:"min=x,max=y"` tags of a field
+// of numbers, which are int64, uint64 or float64 as the field, or nil.
+type bounds struct {
+	min, max interface{}
+}
+
+// parseBounds returns the bounds in the tag of the field f, or nil.
+func parseBounds(f reflect.StructField, t tag) *bounds {
+	min, hasMin := t.value("min")
+	max, hasMax := t.value("max")
+	if !hasMin && !hasMax {
+		return nil
+	}
+	parse := func(s string) interface{} {
+		var x interface{}
+		var err error
+		switch f.Type.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			x, err = strconv.ParseInt(s, 0, 64)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			x, err = strconv.ParseUint(s, 0, 64)
+		case reflect.Float32, reflect.Float64:
+			x, err = strconv.ParseFloat(s, 64)
+		default:
+			panic("enc: min or max tag on field " + f.Name + " of " + f.Type.String())
+		}
+		if err != nil {
+			panic("enc: invalid bound " + s + " on field " + f.Name)
+		}
+		return x
+	}
+	b := new(bounds)
+	if hasMin {
+		b.min = parse(min)
+	}
+	if hasMax {
+		b.max = parse(max)
+	}
+	return b
+}
+
+// in reports whether the number v is within b.
+func (b *bounds) in(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x := v.Int()
+		return (b.min == nil || x >= b.min.(int64)) && (b.max == nil || x <= b.max.(int64))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		x := v.Uint()
+		return (b.min == nil || x >= b.min.(uint64)) && (b.max == nil || x <= b.max.(uint64))
+	}
+	x := v.Float()
+	return (b.min == nil || x >= b.min.(float64)) && (b.max == nil || x <= b.max.(float64))
+}
+
+// checkBounds fails decoding if a field of v that want is set for,
+// or any if want is nil, is out of its bounds.
+func (m *structMachine) checkBounds(v reflect.Value, want []bool) {
+	for i := range m.fields {
+		f := &m.fields[i]
+		if f.bounds == nil || want != nil && !want[i] {
+			continue
+		}
+		if fv := f.value(v); !f.bounds.in(fv) {
+			panic(noPanic{RangeError{m.t, f.name, fv.Interface()}})
+		}
+	}
+}
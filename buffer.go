@@ -0,0 +1,53 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+var buffers = sync.Pool{New: func() interface{} { return bufio.NewWriter(nil) }}
+
+// pooledWriter buffers writes to w in a bufio.Writer taken from a pool
+// until it is flushed, so that Encoders over writers without WriteByte,
+// like a net.Conn, do not allocate or keep a buffer each.
+type pooledWriter struct {
+	w io.Writer
+	b *bufio.Writer
+}
+
+func (p *pooledWriter) buf() *bufio.Writer {
+	if p.b == nil {
+		p.b = buffers.Get().(*bufio.Writer)
+		p.b.Reset(p.w)
+	}
+	return p.b
+}
+
+func (p *pooledWriter) Write(b []byte) (int, error) {
+	return p.buf().Write(b)
+}
+
+func (p *pooledWriter) WriteByte(c byte) error {
+	return p.buf().WriteByte(c)
+}
+
+func (p *pooledWriter) WriteString(s string) (int, error) {
+	return p.buf().WriteString(s)
+}
+
+// Flush writes the buffered data to w and returns the buffer to the pool.
+func (p *pooledWriter) Flush() error {
+	if p.b == nil {
+		return nil
+	}
+	err := p.b.Flush()
+	p.b.Reset(nil)
+	buffers.Put(p.b)
+	p.b = nil
+	return err
+}
@@ -0,0 +1,85 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package cachefile persists map-based caches whose entries expire.
+// Entries are written and read one at a time, so neither side builds
+// intermediate copies of the cache, and expired values are skipped
+// without being decoded.
+package cachefile
+
+import (
+	"bufio"
+	"io"
+	"reflect"
+	"time"
+
+	"github.com/koneu/enc"
+)
+
+// Save writes the entries of m to w along with the times they expire at,
+// as returned by expires. The zero Time means an entry never expires.
+// It panics if K or V are invalid types.
+func Save[K comparable, V any](w io.Writer, m map[K]V, expires func(K, V) time.Time) error {
+	bw := bufio.NewWriter(w)
+	e := enc.NewEncoder(bw)
+	if err := e.Encode(len(m)); err != nil {
+		return err
+	}
+	for k, v := range m {
+		var at int64
+		if t := expires(k, v); !t.IsZero() {
+			at = t.UnixNano()
+		}
+		if err := e.Encode(&k); err != nil {
+			return err
+		}
+		if err := e.Encode(at); err != nil {
+			return err
+		}
+		if err := e.Encode(&v); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// Load reads the entries written by Save from r and calls add for every
+// entry not expired at now, with the time it expires at.
+// It panics if K or V are invalid types.
+func Load[K comparable, V any](r io.Reader, now time.Time, add func(K, V, time.Time)) error {
+	d := enc.NewDecoder(bufio.NewReader(r))
+	var n int
+	if err := d.Decode(&n); err != nil {
+		return err
+	}
+	vt := reflect.TypeOf((*V)(nil)).Elem()
+	for i := 0; i < n; i++ {
+		var (
+			k  K
+			at int64
+		)
+		if err := d.Decode(&k); err != nil {
+			return err
+		}
+		if err := d.Decode(&at); err != nil {
+			return err
+		}
+		var t time.Time
+		if at != 0 {
+			t = time.Unix(0, at)
+			if !t.After(now) {
+				if err := d.Skip(vt); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		var v V
+		if err := d.Decode(&v); err != nil {
+			return err
+		}
+		add(k, v, t)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cachefile
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type item struct {
+	Body    []byte
+	Expires time.Time
+}
+
+func TestCacheFile(t *testing.T) {
+	now := time.Now()
+	m := map[string]item{
+		"fresh":   {[]byte("a"), now.Add(time.Hour)},
+		"stale":   {[]byte("b"), now.Add(-time.Hour)},
+		"forever": {[]byte("c"), time.Time{}},
+	}
+	var buf bytes.Buffer
+	if err := Save(&buf, m, func(_ string, v item) time.Time { return v.Expires }); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]item)
+	err := Load(&buf, now, func(k string, v item, at time.Time) {
+		if !at.Equal(v.Expires) {
+			t.Error("unexpected expiry", k, at)
+		}
+		got[k] = v
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(m, "stale")
+	if len(got) != len(m) || !reflect.DeepEqual(got["fresh"].Body, m["fresh"].Body) || !got["forever"].Expires.IsZero() {
+		t.Errorf("unexpected entries %v", got)
+	}
+}
@@ -0,0 +1,48 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// Clone returns a new Encoder writing to w with the options of enc,
+// for configuring an Encoder once and stamping out one per goroutine.
+// The stream state of enc, like its header and tees, is not copied.
+// Stats, Tracer and Sealer are shared with enc.
+func (enc *Encoder) Clone(w io.Writer) *Encoder {
+	return NewEncoderOptions(w, enc.o)
+}
+
+// Clone returns a new Decoder reading from r with the options and
+// token type of dec, for configuring a Decoder once and stamping out one
+// per goroutine. The stream state of dec is not copied, but once dec has
+// read the header of a stream, the clone uses its version and modes.
+// Stats, Tracer, Allocator, Progress and Sealer are shared with dec.
+func (dec *Decoder) Clone(r io.Reader) *Decoder {
+	c := NewDecoderOptions(r, dec.o)
+	if dec.tok != nil {
+		c.SetTokenType(dec.tok.t)
+	}
+	return c
+}
+
+// A guard detects the use of an Encoder or Decoder
+// by several goroutines at once.
+type guard struct {
+	busy atomic.Bool
+}
+
+// enter marks the start of a call. It panics if another one is running.
+func (g *guard) enter(name string) {
+	if !g.busy.CompareAndSwap(false, true) {
+		panic("enc: " + name + " used concurrently, see Clone")
+	}
+}
+
+func (g *guard) exit() {
+	g.busy.Store(false)
+}
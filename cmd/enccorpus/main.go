@@ -0,0 +1,125 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Command enccorpus writes a seed corpus of valid encodings of a Go type,
+// for fuzzing code that decodes enc input.
+//
+// Usage:
+//
+//	enccorpus [-n count] [-seed seed] [-raw] [-o dir] package Type
+//
+// It builds and runs a program encoding values of package.Type created by
+// enctest.Generate, one per seed, so it must be run where the package
+// can be imported from, like within its module. Every value is written to
+// a file in dir named after its hash, in the format of the corpora of
+// native Go fuzzing, to be placed in testdata/fuzz/FuzzName, or as is
+// with -raw, like go-fuzz expects.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"text/template"
+)
+
+var program = template.Must(template.New("main").Parse(`// Code generated by enccorpus. DO NOT EDIT.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	{{- if not .Raw}}
+	"strconv"
+	{{- end}}
+
+	"github.com/koneu/enc"
+	"github.com/koneu/enc/enctest"
+
+	pkg {{printf "%q" .Package}}
+)
+
+func main() {
+	t := reflect.TypeOf((*pkg.{{.Type}})(nil)).Elem()
+	for seed := int64({{.Seed}}); seed < {{.Seed}}+{{.N}}; seed++ {
+		var buf bytes.Buffer
+		if err := enc.EncodeValue(&buf, enctest.Generate(t, seed)); err != nil {
+			log.Fatal(err)
+		}
+		b := buf.Bytes()
+		{{- if not .Raw}}
+		b = []byte("go test fuzz v1\n[]byte(" + strconv.Quote(string(b)) + ")\n")
+		{{- end}}
+		name := fmt.Sprintf("%x", sha256.Sum256(b))[:16]
+		if err := os.WriteFile(filepath.Join({{printf "%q" .Dir}}, name), b, 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+`))
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("enccorpus: ")
+
+	var args struct {
+		Package, Type, Dir string
+		N, Seed            int64
+		Raw                bool
+	}
+	flag.Int64Var(&args.N, "n", 32, "number of values")
+	flag.Int64Var(&args.Seed, "seed", 1, "seed of the first value")
+	flag.BoolVar(&args.Raw, "raw", false, "write encodings as is rather than as native fuzzing corpus files")
+	flag.StringVar(&args.Dir, "o", ".", "directory to write the corpus to")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: enccorpus [flags] package Type")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	args.Package, args.Type = flag.Arg(0), flag.Arg(1)
+
+	var err error
+	if args.Dir, err = filepath.Abs(args.Dir); err == nil {
+		err = os.MkdirAll(args.Dir, 0755)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the program is built in the working directory to import packages as it does
+	tmp, err := os.MkdirTemp(".", "enccorpus")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	f, err := os.Create(filepath.Join(tmp, "main.go"))
+	if err == nil {
+		err = program.Execute(f, &args)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err == nil {
+		cmd := exec.Command("go", "run", ".")
+		cmd.Dir, cmd.Stdout, cmd.Stderr = tmp, os.Stdout, os.Stderr
+		err = cmd.Run()
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,106 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Command encdump prints an encoded stream as a sequence of varints,
+// or guided by the type of its values.
+//
+// Usage:
+//
+//	encdump [-type name] [file]
+//
+// Without type information, the stream is read as back to back varints,
+// each printed with its offset, raw bytes and both its unsigned and signed
+// interpretation. Lengths of strings and byte slices show up as such varints;
+// their contents are printed as further varints.
+//
+// With -type, the stream is read as values of the type registered under
+// name, see enc.RegisterName, and printed like enc.Dump does. The types
+// registered by default, like int, string or []interface {}, are known.
+// To dump values of your own types, build a copy of encdump that imports
+// the packages registering them.
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/koneu/enc"
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("encdump: ")
+	typ := flag.String("type", "", "the registered `name` of the type of the values")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: encdump [-type name] [file]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var in io.Reader = os.Stdin
+	switch flag.NArg() {
+	case 0:
+	case 1:
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	r := bufio.NewReader(in)
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+
+	if *typ != "" {
+		t, ok := enc.RegisteredType(*typ)
+		if !ok {
+			log.Fatalf("no type registered under %q", *typ)
+		}
+		if err := enc.Dump(r, t, w); err != nil {
+			w.Flush()
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var off int64
+	var raw []byte
+	for {
+		raw = raw[:0]
+		var u uint64
+		var s uint
+		for {
+			b, err := r.ReadByte()
+			if err == io.EOF && len(raw) == 0 {
+				return
+			}
+			if err != nil {
+				w.Flush()
+				log.Fatal(err)
+			}
+			raw = append(raw, b)
+			u |= uint64(b&0x7f) << s
+			if b < 0x80 || len(raw) == binary.MaxVarintLen64 {
+				break
+			}
+			s += 7
+		}
+		i := int64(u >> 1)
+		if u&1 != 0 {
+			i = ^i
+		}
+		fmt.Fprintf(w, "%8d %-20x %20d %20d\n", off, raw, u, i)
+		off += int64(len(raw))
+	}
+}
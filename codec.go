@@ -0,0 +1,108 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+)
+
+// A Codec encodes values of a type in its own way. Unless Size is 0,
+// every encoding is Size bytes long and written as is,
+// otherwise it is prefixed by its length. Streams starting with bytes
+// written as is that could be taken for a stream header get a header
+// ahead of them, which Decoders read by themselves.
+type Codec interface {
+	// Size returns the length of every encoding, or 0 if it varies.
+	Size() int
+	// Append appends the encoding of v to b.
+	Append(b []byte, v reflect.Value) ([]byte, error)
+	// Decode sets the settable value v from its encoding b.
+	Decode(b []byte, v reflect.Value) error
+}
+
+var codecs = struct {
+	sync.RWMutex
+	m map[reflect.Type]Codec
+}{m: make(map[reflect.Type]Codec)}
+
+var namedCodecs = struct {
+	sync.RWMutex
+	m map[string]Codec
+}{m: make(map[string]Codec)}
+
+var errCodecSize = errors.New("encoding does not match the codec size")
+
+// RegisterCodec makes values of type t be encoded by c instead of by enc.
+// It panics if values of type t have already been encoded or decoded,
+// so it is best called from an init function.
+func RegisterCodec(t reflect.Type, c Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	if used(t) {
+		panic("enc: RegisterCodec called after first use of " + t.String())
+	}
+	codecs.m[t] = c
+}
+
+// RegisterNamedCodec records c under name, so that struct fields
+// tagged `enc:"codec=name"` are encoded by c instead of by enc, whatever
+// their type. Codecs must be registered before the structs using them are
+// first encoded or decoded, so it is best called from an init function.
+// It panics if the name is already registered.
+func RegisterNamedCodec(name string, c Codec) {
+	namedCodecs.Lock()
+	defer namedCodecs.Unlock()
+	if _, ok := namedCodecs.m[name]; ok || name == "" {
+		panic("enc: RegisterNamedCodec of " + name + " registered twice or empty")
+	}
+	namedCodecs.m[name] = c
+}
+
+func namedCodec(name string) Codec {
+	namedCodecs.RLock()
+	defer namedCodecs.RUnlock()
+	return namedCodecs.m[name]
+}
+
+func codecOf(t reflect.Type) Codec {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	return codecs.m[t]
+}
+
+type codecMachine struct {
+	t reflect.Type
+	c Codec
+}
+
+func (m *codecMachine) encode(e *encoder, v reflect.Value) {
+	b, err := m.c.Append(nil, v)
+	if err == nil && m.c.Size() != 0 && len(b) != m.c.Size() {
+		err = errCodecSize
+	}
+	if err != nil {
+		panic(noPanic{MarshalerError{m.t, err}})
+	}
+	if m.c.Size() == 0 {
+		e.encodeUint(uint64(len(b)))
+	}
+	e.write(b)
+}
+
+func (m *codecMachine) decode(d *decoder, v reflect.Value) {
+	if err := m.c.Decode(d.read(m.len(d)), v); err != nil {
+		panic(noPanic{MarshalerError{m.t, err}})
+	}
+}
+
+// len reads the length of the next encoding, unless it is fixed.
+func (m *codecMachine) len(d *decoder) uint64 {
+	if n := m.c.Size(); n != 0 {
+		return uint64(n)
+	}
+	return d.decodeUint()
+}
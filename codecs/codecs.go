@@ -0,0 +1,42 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package codecs provides implementations of enc.Codec for common types.
+package codecs
+
+import (
+	"reflect"
+
+	"github.com/koneu/enc"
+)
+
+// UUID encodes arrays of 16 bytes, like most UUID types, as exactly 16 bytes,
+// rather than as a length followed by a varint per byte.
+var UUID enc.Codec = uuid{}
+
+// RegisterUUID registers UUID as the codec of t.
+// It panics if t is not an array of 16 bytes.
+func RegisterUUID(t reflect.Type) {
+	if t.Kind() != reflect.Array || t.Len() != 16 || t.Elem().Kind() != reflect.Uint8 {
+		panic("codecs: RegisterUUID of " + t.String())
+	}
+	enc.RegisterCodec(t, UUID)
+}
+
+type uuid struct{}
+
+func (uuid) Size() int {
+	return 16
+}
+
+func (uuid) Append(b []byte, v reflect.Value) ([]byte, error) {
+	var a [16]byte
+	reflect.Copy(reflect.ValueOf(a[:]), v)
+	return append(b, a[:]...), nil
+}
+
+func (uuid) Decode(b []byte, v reflect.Value) error {
+	reflect.Copy(v, reflect.ValueOf(b))
+	return nil
+}
@@ -0,0 +1,67 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package codecs
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/koneu/enc"
+)
+
+type ID [16]byte
+
+type Record struct {
+	ID   ID
+	Refs []ID
+}
+
+func init() {
+	RegisterUUID(reflect.TypeOf(ID{}))
+}
+
+func TestUUID(t *testing.T) {
+	id := ID{0xff, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 0x80}
+	v := Record{id, []ID{{}, id}}
+
+	var buf bytes.Buffer
+	if err := enc.Encode(&buf, &v); err != nil {
+		t.Fatal(err)
+	}
+	if l := buf.Len(); l != 1+16+1+2*16 {
+		t.Errorf("encoded %d bytes", l)
+	}
+	if err := enc.Describe(reflect.TypeOf(v)).Validate(buf.Bytes()); err != nil {
+		t.Error(err)
+	}
+
+	var w Record
+	if err := enc.Decode(&buf, &w); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v, w) {
+		t.Errorf("%v != %v", v, w)
+	}
+}
+
+func TestUUIDLeadingMagic(t *testing.T) {
+	// a stream header starts with the same bytes
+	ids := []ID{{0x80, 0x00, 1}, {0x80}}
+	var buf bytes.Buffer
+	e := enc.NewEncoder(&buf)
+	for i := range ids {
+		if err := e.Encode(&ids[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := enc.NewDecoder(&buf)
+	for _, id := range ids {
+		var w ID
+		if err := d.Decode(&w); err != nil || w != id {
+			t.Errorf("decoded %x, %v", w, err)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"bufio"
+	"io"
+	"reflect"
+)
+
+// A Machine encodes and decodes values of a single type, see CompileType.
+// It is safe for concurrent use.
+type Machine interface {
+	// Type returns the type of the values.
+	Type() reflect.Type
+	// Encode writes v like an Encoder without options would,
+	// but without a stream header.
+	Encode(w io.Writer, v reflect.Value) error
+	// Decode reads a value written by Encode from r into v, which must be settable.
+	// Unless r is a Reader, input is buffered
+	// and Decode may read past the value.
+	Decode(r io.Reader, v reflect.Value) error
+}
+
+// CompileType returns the Machine for values of type t,
+// or a TypeError or KeyError if they cannot be encoded.
+// Encoding and decoding through a Machine does without looking up its type
+// for every value, which suits callers handling many values of known types.
+// Machine methods panic if the values passed to them are of another type.
+func CompileType(t reflect.Type) (m Machine, err error) {
+	defer func() {
+		switch p := recover(); p := p.(type) {
+		case nil:
+		case TypeError:
+			err = p
+		case KeyError:
+			err = p
+		default:
+			panic(p)
+		}
+	}()
+	return &compiled{t, types.get(t)}, nil
+}
+
+type compiled struct {
+	t reflect.Type
+	m machine
+}
+
+func (m *compiled) Type() reflect.Type {
+	return m.t
+}
+
+func (m *compiled) check(v reflect.Value) {
+	if v.Type() != m.t {
+		panic("enc: Machine of " + m.t.String() + " used with " + v.Type().String())
+	}
+}
+
+func (m *compiled) Encode(w io.Writer, v reflect.Value) (err error) {
+	m.check(v)
+	defer func() {
+		switch p := recover(); p := p.(type) {
+		case nil:
+		case noPanic:
+			err = p.error
+		default:
+			panic(p)
+		}
+	}()
+
+	e := encoder{types: types}
+	if bw, ok := w.(Writer); ok {
+		e.w = bw
+	} else {
+		b := &pooledWriter{w: w}
+		defer func() {
+			if ferr := b.Flush(); err == nil {
+				err = ferr
+			}
+		}()
+		e.w = b
+	}
+	m.m.encode(&e, v)
+	return
+}
+
+func (m *compiled) Decode(r io.Reader, v reflect.Value) (err error) {
+	m.check(v)
+	in := new(offsetReader)
+	defer func() {
+		switch p := recover(); p := p.(type) {
+		case nil:
+		case noPanic:
+			err = p.error
+		default:
+			panic(p)
+		}
+		switch e := err.(type) {
+		case CorruptError:
+			e.Offset = in.n
+			err = e
+		}
+		if err == io.ErrUnexpectedEOF || err == io.EOF && in.n > 0 {
+			err = EOFError{in.n}
+		}
+	}()
+
+	d := decoder{r: in, types: types, in: in}
+	if br, ok := r.(Reader); ok {
+		in.Reader = br
+		if s, ok := r.(sized); ok {
+			d.left = s.Len
+		}
+	} else {
+		in.Reader = bufio.NewReader(r)
+	}
+	m.m.decode(&d, v)
+	return
+}
@@ -0,0 +1,131 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// CompressedString is a string compressed with DEFLATE when it is long,
+// like large human readable text, saving space where whole payloads
+// cannot be compressed.
+type CompressedString string
+
+// CompressedBytes is a byte slice compressed like CompressedString.
+type CompressedBytes []byte
+
+var (
+	compressedStringType = reflect.TypeOf(CompressedString(""))
+	compressedBytesType  = reflect.TypeOf(CompressedBytes(nil))
+)
+
+// compressMin is the length from which compressedMachine compresses values.
+const compressMin = 256
+
+// maxRatio bounds how much longer than their compressed bytes values
+// decompress to, which DEFLATE keeps below 1032.
+const maxRatio = 1032
+
+// Flags of compressed values.
+const (
+	flagPlain    = 0 // followed by the length and the bytes
+	flagDeflated = 1 // followed by the length, the compressed length and the compressed bytes
+)
+
+var errCompressed = CorruptError{Reason: "invalid compressed value"}
+
+var flateWriters = sync.Pool{New: func() interface{} {
+	w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+	return w
+}}
+
+// compressedMachine encodes CompressedString and CompressedBytes values
+// as a flag followed by their bytes, compressed only if that saves space.
+type compressedMachine struct{ t reflect.Type }
+
+// bytes returns the bytes of the value v.
+func (m compressedMachine) bytes(v reflect.Value) []byte {
+	if m.t == compressedStringType {
+		return []byte(v.String())
+	}
+	return v.Bytes()
+}
+
+func (m compressedMachine) encode(e *encoder, v reflect.Value) {
+	l := v.Len()
+	if l >= compressMin {
+		var buf bytes.Buffer
+		w := flateWriters.Get().(*flate.Writer)
+		w.Reset(&buf)
+		w.Write(m.bytes(v))
+		w.Close()
+		flateWriters.Put(w)
+		if buf.Len() < l {
+			e.writeByte(flagDeflated)
+			e.encodeUint(uint64(l))
+			e.encodeUint(uint64(buf.Len()))
+			e.write(buf.Bytes())
+			return
+		}
+	}
+	e.writeByte(flagPlain)
+	e.encodeUint(uint64(l))
+	if m.t == compressedStringType {
+		e.writeString(v.String())
+	} else {
+		e.write(v.Bytes())
+	}
+}
+
+func (m compressedMachine) decode(d *decoder, v reflect.Value) {
+	var b []byte
+	switch d.readByte() {
+	case flagPlain:
+		b = d.read(d.decodeUint())
+	case flagDeflated:
+		l := d.decodeUint()
+		d.checkSize(l, 1)
+		if d.lim != nil && l > uint64(d.lim.n) {
+			panic(noPanic{ErrTooLarge})
+		}
+		c := d.decodeUint()
+		if c > maxAlloc/maxRatio || l > c*maxRatio {
+			panic(noPanic{errCompressed})
+		}
+		// the buffer grows as data is decompressed rather than trusting l
+		r := flate.NewReader(bytes.NewReader(d.read(c)))
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(io.LimitReader(r, int64(l))); err != nil || uint64(buf.Len()) != l {
+			panic(noPanic{errCompressed})
+		}
+		if n, _ := r.Read(make([]byte, 1)); n != 0 {
+			panic(noPanic{errCompressed})
+		}
+		b = buf.Bytes()
+	default:
+		panic(noPanic{errCompressed})
+	}
+	if m.t == compressedStringType {
+		v.SetString(string(b))
+	} else {
+		v.SetBytes(b)
+	}
+}
+
+// skip skips a value without decompressing it.
+func (m compressedMachine) skip(d *decoder) {
+	switch d.readByte() {
+	case flagPlain:
+	case flagDeflated:
+		d.decodeUint()
+	default:
+		panic(noPanic{errCompressed})
+	}
+	d.discard(d.decodeUint())
+}
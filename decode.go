@@ -6,20 +6,210 @@ package enc
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/binary"
 	"io"
+	"math"
+	"math/bits"
 	"reflect"
 )
 
-// Decode reads data from r and unmarshals it.
+// Decode reads data from r and unmarshals it into the value v points to.
+// To decode a value encoded as an interface, v points to an interface.
 // It panics if the value is of an invalid type.
 func Decode(r io.Reader, v interface{}) error {
-	return DecodeValue(r, reflect.ValueOf(v))
+	return lenient(r).DecodeValue(reflect.ValueOf(v))
 }
 
-// DecodeValue reads data from r and unmarshals it.
+// DecodeValue reads data from r and unmarshals it into v, which must be settable
+// or point to a settable value, possibly through an interface.
+// Otherwise, it returns an AssignError.
 // It panics if the value is of an invalid type.
-func DecodeValue(r io.Reader, v reflect.Value) (err error) {
+func DecodeValue(r io.Reader, v reflect.Value) error {
+	return lenient(r).DecodeValue(v)
+}
+
+// DecodeContext is like Decode, but gives up sending to channels
+// and decoding further struct fields, elements and map values
+// once ctx is done and returns ctx.Err().
+func DecodeContext(ctx context.Context, r io.Reader, v interface{}) error {
+	return lenient(r).DecodeContext(ctx, v)
+}
+
+// DecodeAll reads several values written back to back from r and unmarshals them.
+// It panics if a value is of an invalid type.
+func DecodeAll(r io.Reader, vs ...interface{}) error {
+	dec := lenient(r)
+	for _, v := range vs {
+		if err := dec.Decode(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A Decoder reads values from an input stream.
+// It must not be used by several goroutines at once, which panics
+// when detected; use a Clone per goroutine instead.
+type Decoder struct {
+	r        Reader
+	in       offsetReader
+	o        Options
+	started  bool
+	synced   bool
+	base     int64 // the offset of the first frame, see Sealer
+	frame    bytes.Reader
+	buf      []byte
+	opened   []byte
+	tok      *tokenizer
+	deadline deadliner
+	left     func() int
+	guard    guard
+}
+
+// A sized reader knows how much input is left, like a bytes.Reader.
+type sized interface {
+	Len() int
+}
+
+// NewDecoder returns a new Decoder reading from r, in Strict mode.
+// Unless r is a Reader, input is buffered
+// and the Decoder may read past the values it decodes.
+func NewDecoder(r io.Reader) *Decoder {
+	dec := new(Decoder)
+	if br, ok := r.(Reader); ok {
+		dec.in.Reader = br
+		if s, ok := r.(sized); ok {
+			dec.left = s.Len
+		}
+	} else {
+		br := bufio.NewReader(r)
+		dec.in.Reader = br
+		if l, ok := r.(*io.LimitedReader); ok {
+			dec.left = func() int { return int(min(l.N+int64(br.Buffered()), math.MaxInt)) }
+		}
+	}
+	dec.r = &dec.in
+	dec.deadline, _ = r.(deadliner)
+	return dec
+}
+
+// SetInputSize tells the Decoder that n bytes of input are left, so that
+// lengths exceeding them fail before memory is allocated for them.
+// The size of bytes.Readers, strings.Readers, bytes.Buffers and
+// io.LimitedReaders is known without it. If n is negative, it is unknown.
+func (dec *Decoder) SetInputSize(n int64) {
+	if n < 0 {
+		dec.left = nil
+		return
+	}
+	end := dec.in.n + n
+	dec.left = func() int { return int(min(end-dec.in.n, math.MaxInt)) }
+}
+
+// lenient returns a Decoder for the package-level functions, which are not strict.
+func lenient(r io.Reader) *Decoder {
+	dec := NewDecoder(r)
+	dec.o.Mode = Lenient
+	return dec
+}
+
+// SetMode sets the modes used for subsequent values.
+// The Decoder is strict unless m has Lenient set, see Strict.
+func (dec *Decoder) SetMode(m Mode) {
+	dec.o.Mode = m
+}
+
+// SetVersion sets the wire format version of streams without a header.
+// If the stream starts with a header, its version and modes take precedence.
+func (dec *Decoder) SetVersion(v Version) {
+	dec.o.Version = v
+}
+
+// SetMaxMessageBytes limits the input read for a single value to n bytes,
+// failing with ErrTooLarge beyond. Lengths exceeding what is left of the
+// limit fail before anything is allocated for them. 0 means no limit.
+func (dec *Decoder) SetMaxMessageBytes(n int64) {
+	dec.o.MaxMessageBytes = n
+}
+
+// SetChanLimits limits the number of elements decoded into a channel to
+// elements, and the buffer of channels it creates to buffer elements,
+// failing with ErrTooLarge beyond either. A channel it creates buffers all
+// of its elements. Elements decoded into an existing channel are sent once
+// they are received elsewhere, which decoding waits for, see DecodeContext.
+// 0 means no limit. Channels encode like slices of their elements, so that
+// types with slices in place of channels decode them without any channel.
+func (dec *Decoder) SetChanLimits(elements, buffer int) {
+	dec.o.MaxChanElements, dec.o.MaxChanBuffer = elements, buffer
+}
+
+// Decode reads the next value from the stream and unmarshals it.
+// It panics if the value is of an invalid type.
+func (dec *Decoder) Decode(v interface{}) error {
+	return dec.decode(nil, reflect.ValueOf(v), false)
+}
+
+// DecodeValue reads the next value from the stream and unmarshals it
+// into v, which must be settable or point to a settable value,
+// possibly through an interface. Otherwise, it returns an AssignError.
+// It panics if the value is of an invalid type.
+func (dec *Decoder) DecodeValue(v reflect.Value) error {
+	return dec.decode(nil, v, false)
+}
+
+// DecodeContext is like Decode, but gives up sending to channels
+// and decoding further struct fields, elements and map values
+// once ctx is done and returns ctx.Err().
+func (dec *Decoder) DecodeContext(ctx context.Context, v interface{}) error {
+	return dec.decode(ctx, reflect.ValueOf(v), false)
+}
+
+// decode reads into v, or into the slice v as a batch.
+func (dec *Decoder) decode(ctx context.Context, v reflect.Value, batch bool) error {
+	v, err := target(v)
+	if err != nil {
+		return err
+	}
+	start := dec.in.n
+	err = dec.run(ctx, func(d *decoder) {
+		get := d.types.get
+		if batch {
+			get = d.types.batch
+		}
+		if d.trace != nil {
+			d.trace.run("", v.Type(), func() { get(v.Type()).decode(d, v) })
+		} else {
+			get(v.Type()).decode(d, v)
+		}
+	})
+	if err == nil && dec.o.Stats != nil {
+		dec.o.Stats.add(v.Type(), false, dec.in.n-start)
+	}
+	return err
+}
+
+// target returns the value to decode into for v, which is v itself if it
+// can be set, or else the value v points to, following interfaces.
+func target(v reflect.Value) (reflect.Value, error) {
+	for v.IsValid() && !v.CanSet() {
+		if k := v.Kind(); k != reflect.Ptr && k != reflect.Interface || v.IsNil() {
+			return v, AssignError{v.Type()}
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return v, AssignError{}
+	}
+	return v, nil
+}
+
+// run calls f to decode the next value and returns the error it fails with.
+func (dec *Decoder) run(ctx context.Context, f func(*decoder)) (err error) {
+	dec.guard.enter("Decoder")
+	defer dec.guard.exit()
+	start := dec.in.n
 	defer func() {
 		switch p := recover(); p := p.(type) {
 		case nil:
@@ -28,44 +218,357 @@ func DecodeValue(r io.Reader, v reflect.Value) (err error) {
 		default:
 			panic(p)
 		}
+		err = dec.wrap(err, start)
 	}()
 
-	var d decoder
-	if r, ok := r.(reader); ok {
-		d.r = r
+	if ctx != nil && ctx.Done() != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 	} else {
-		d.r = bufio.NewReader(r)
+		ctx = nil
 	}
 
-	if !v.CanSet() {
-		v = reflect.Indirect(v)
+	d := dec.start(true)
+	d.ctx = ctx
+	f(&d)
+	if d.mode&Framed != 0 && dec.frame.Len() != 0 {
+		dec.frame.Reset(nil)
+		return errFrameData
 	}
-	types.get(v.Type()).decode(&d, v)
 	return
 }
 
+// wrap adds the stream offset to decoding errors.
+// EOF is unexpected unless the value started at or after offset start.
+func (dec *Decoder) wrap(err error, start int64) error {
+	switch e := err.(type) {
+	case CorruptError:
+		e.Offset = dec.in.n
+		return e
+	}
+	if err == io.ErrUnexpectedEOF || err == io.EOF && dec.in.n > start {
+		return EOFError{dec.in.n}
+	}
+	return err
+}
+
+// start returns a decoder for the next value, reading the header of the stream first.
+// In Framed mode, it reads a new frame if next is set.
+func (dec *Decoder) start(next bool) decoder {
+	if !dec.started {
+		dec.started = true
+		dec.readHeader()
+		dec.base = dec.in.n
+		if p, ok := dec.r.(*prefixReader); ok {
+			dec.base -= int64(p.n)
+		}
+	}
+	d := decoder{
+		r:       dec.r,
+		mode:    dec.o.Mode.implied(),
+		version: dec.o.Version,
+		types:   cache(dec.o.Flags),
+		alloc:   dec.o.Allocator,
+		spill:   dec.o.SpillSize,
+		maxChan: dec.o.MaxChanElements,
+		chanBuf: dec.o.MaxChanBuffer,
+		in:      &dec.in,
+	}
+	if dec.o.Sealer != nil && d.mode&Framed == 0 {
+		panic(noPanic{errSealer})
+	}
+	if d.mode&Framed != 0 {
+		if next {
+			dec.readFrame()
+		}
+		d.r, d.left = &dec.frame, dec.frame.Len
+	} else {
+		d.left = dec.left
+	}
+	if n := dec.o.MaxMessageBytes; n > 0 {
+		d.lim = &limitReader{d.r, n}
+		d.r = d.lim
+	}
+	if dec.o.Progress != nil && dec.o.ProgressInterval > 0 {
+		d.progress = &progress{f: dec.o.Progress, every: int64(dec.o.ProgressInterval), in: &dec.in}
+	}
+	if dec.o.Tracer != nil {
+		r := &offsetReader{Reader: d.r}
+		d.r, d.trace = r, &tracer{t: dec.o.Tracer, pos: func() int64 { return r.n }}
+	}
+	return d
+}
+
 type decoder struct {
-	r reader
+	r        Reader
+	mode     Mode
+	version  Version
+	ctx      context.Context
+	types    *_types
+	trace    *tracer
+	refs     []reflect.Value
+	alloc    Allocator
+	spill    int64
+	lim      *limitReader
+	left     func() int
+	in       *offsetReader // the input read so far, if counted
+	progress *progress
+	maxChan  int
+	chanBuf  int
+}
+
+// ref reads the reference tag of a non-nil pointer into v
+// and reports whether its target has yet to be decoded.
+func (d *decoder) ref(v reflect.Value) bool {
+	id := d.decodeUint()
+	if id == 1 {
+		if v.IsNil() {
+			v.Set(d.new(v.Type().Elem()))
+		}
+		d.refs = append(d.refs, v.Elem().Addr())
+		return true
+	}
+	if id -= 2; id >= uint64(len(d.refs)) || d.refs[id].Type() != v.Type() {
+		panic(noPanic{errRef})
+	}
+	v.Set(d.refs[id])
+	return false
+}
+
+// send sends x on c, giving up once d.ctx is done.
+func (d *decoder) send(c, x reflect.Value) {
+	if d.ctx == nil {
+		c.Send(x)
+		return
+	}
+	i, _, _ := reflect.Select([]reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(d.ctx.Done())},
+		{Dir: reflect.SelectSend, Chan: c, Send: x},
+	})
+	if i == 0 {
+		panic(noPanic{d.ctx.Err()})
+	}
+}
+
+// cancel fails once d.ctx is done.
+func (d *decoder) cancel() {
+	select {
+	case <-d.ctx.Done():
+		panic(noPanic{d.ctx.Err()})
+	default:
+	}
 }
 
 func (d *decoder) decodeInt() int64 {
-	ret, err := binary.ReadVarint(d.r)
-	if err != nil {
-		panic(noPanic{err})
+	u := d.decodeUint()
+	if u&1 != 0 {
+		return ^int64(u >> 1)
 	}
-	return ret
+	return int64(u >> 1)
 }
 
 func (d *decoder) decodeUint() uint64 {
-	ret, err := binary.ReadUvarint(d.r)
+	ret, err := readUvarint(d.r)
 	if err != nil {
 		panic(noPanic{err})
 	}
 	return ret
 }
 
+// offsetReader counts the bytes read from a stream.
+type offsetReader struct {
+	Reader
+	n int64
+}
+
+func (r *offsetReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *offsetReader) ReadByte() (byte, error) {
+	b, err := r.Reader.ReadByte()
+	if err == nil {
+		r.n++
+	}
+	return b, err
+}
+
+func (r *offsetReader) UnreadByte() error {
+	err := r.Reader.UnreadByte()
+	if err == nil {
+		r.n--
+	}
+	return err
+}
+
+// limitReader fails with ErrTooLarge once more than n bytes are read.
+type limitReader struct {
+	Reader
+	n int64
+}
+
+func (r *limitReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, ErrTooLarge
+	}
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.Reader.Read(p)
+	r.n -= int64(n)
+	return n, err
+}
+
+func (r *limitReader) ReadByte() (byte, error) {
+	if r.n <= 0 {
+		return 0, ErrTooLarge
+	}
+	b, err := r.Reader.ReadByte()
+	if err == nil {
+		r.n--
+	}
+	return b, err
+}
+
+func (r *limitReader) UnreadByte() error {
+	err := r.Reader.UnreadByte()
+	if err == nil {
+		r.n++
+	}
+	return err
+}
+
+// readUvarint is like binary.ReadUvarint, but only accepts the
+// shortest encoding of a value.
+func readUvarint(r io.ByteReader) (uint64, error) {
+	var u uint64
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			if i > 0 && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return u, err
+		}
+		if i == binary.MaxVarintLen64-1 && b > 1 {
+			return u, CorruptError{Reason: "varint overflows 64 bits"}
+		}
+		u |= uint64(b&0x7f) << (7 * i)
+		if b < 0x80 {
+			if b == 0 && i > 0 {
+				return u, CorruptError{Reason: "overlong varint"}
+			}
+			return u, nil
+		}
+	}
+}
+
+// decodeCount reads an element count, which has to fit an int.
+func (d *decoder) decodeCount() int {
+	return d.count(d.decodeUint())
+}
+
+func (d *decoder) count(u uint64) int {
+	if u > math.MaxInt {
+		panic(noPanic{CorruptError{Reason: "length overflows int"}})
+	}
+	return int(u)
+}
+
+// maxAlloc stays below the limits of the runtime on allocations.
+const maxAlloc = math.MaxInt>>16 | math.MaxInt32>>1
+
+// checkAlloc fails unless l elements of the given size may be allocated.
+// Every element takes up at least a byte of input, so there cannot be more
+// of them than the input left, if it is known.
+func (d *decoder) checkAlloc(l uint64, size uintptr) {
+	d.checkSize(l, size)
+	if d.lim != nil && l > uint64(d.lim.n) {
+		panic(noPanic{ErrTooLarge})
+	}
+	if d.left != nil && l > uint64(d.left()) {
+		// the input ends first, without waiting for it
+		panic(noPanic{io.ErrUnexpectedEOF})
+	}
+}
+
+// checkSize fails unless l elements of the given size may be allocated,
+// regardless of the input left.
+func (d *decoder) checkSize(l uint64, size uintptr) {
+	if size != 0 && l > maxAlloc/uint64(size) {
+		panic(noPanic{ErrTooLarge})
+	}
+}
+
+func (d *decoder) decodeFloat(f32 bool) (f float64) {
+	u := d.decodeUint()
+	switch {
+	case d.version < Version2:
+		f = math.Float64frombits(u)
+	case f32:
+		f = float64(math.Float32frombits(bits.ReverseBytes32(uint32(u))))
+	default:
+		f = math.Float64frombits(bits.ReverseBytes64(u))
+	}
+	if d.mode&FiniteFloats != 0 && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		panic(noPanic{errNonFinite})
+	}
+	return
+}
+
+// zeroValue consumes a single 0 byte standing for the zero value of a comparable
+// type and reports whether it found one. It finds none in ExplicitZeros mode.
+func (d *decoder) zeroValue() bool {
+	return d.mode&ExplicitZeros == 0 && d.zero()
+}
+
+// zero consumes a single 0 byte standing for a zero value and reports whether it found one.
+func (d *decoder) zero() bool {
+	if d.readByte() == 0 {
+		return true
+	}
+	d.unreadByte()
+	return false
+}
+
+// decodeLen reads a length written by encoder.encodeLen
+// and reports false if it stands for nil.
+func (d *decoder) decodeLen() (int, bool) {
+	l := d.count(d.decodeUint())
+	if d.mode&PreserveNil == 0 {
+		return l, true
+	}
+	if l == 0 {
+		return 0, false
+	}
+	return l - 1, true
+}
+
+// present consumes the tag marking a non-nil value in PreserveNil mode.
+func (d *decoder) present() {
+	if d.readByte() != 1 {
+		panic(noPanic{errNil})
+	}
+}
+
 func (d *decoder) read(size uint64) []byte {
-	ret := make([]byte, size)
+	d.checkAlloc(size, 1)
+	if size > maxPrealloc && d.lim == nil && d.left == nil {
+		b := d.readGrowing(size)
+		if d.alloc == nil {
+			return b
+		}
+		return append(d.alloc.Bytes(len(b))[:0], b...)
+	}
+	var ret []byte
+	if d.alloc == nil {
+		ret = make([]byte, size)
+	} else {
+		ret = d.alloc.Bytes(int(size))
+	}
 	if _, err := io.ReadFull(d.r, ret); err != nil {
 		if err == io.EOF {
 			panic(noPanic{io.ErrUnexpectedEOF})
@@ -75,6 +578,25 @@ func (d *decoder) read(size uint64) []byte {
 	return ret
 }
 
+// readGrowing reads size bytes into a buffer that grows as they arrive.
+func (d *decoder) readGrowing(size uint64) []byte {
+	var buf bytes.Buffer
+	n, err := buf.ReadFrom(io.LimitReader(d.r, int64(size)))
+	if err != nil {
+		panic(noPanic{err})
+	}
+	if uint64(n) != size {
+		panic(noPanic{io.ErrUnexpectedEOF})
+	}
+	return buf.Bytes()
+}
+
+func (d *decoder) discard(size uint64) {
+	if err := d.copy(io.Discard, int64(d.count(size))); err != nil {
+		panic(noPanic{err})
+	}
+}
+
 func (d *decoder) readByte() byte {
 	ret, err := d.r.ReadByte()
 	if err == nil {
@@ -0,0 +1,99 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package dgram encodes values into single datagrams, like UDP packets.
+// Values are encoded into buffers of fixed size and decoded from whole
+// packets, without the buffering and copies of streams.
+package dgram
+
+import (
+	"bytes"
+	"net"
+
+	"github.com/koneu/enc"
+)
+
+// Marshal encodes v into the buffer b and returns the packet, b[:n].
+// It fails with enc.ErrTooLarge if v does not fit into len(b) bytes.
+// It panics if v is of an invalid type.
+func Marshal(b []byte, v interface{}) ([]byte, error) {
+	return MarshalOptions(b, v, enc.Options{})
+}
+
+// MarshalOptions is like Marshal, but encodes using o.
+func MarshalOptions(b []byte, v interface{}, o enc.Options) ([]byte, error) {
+	w := &fixed{b: b[:0:len(b)]}
+	if err := enc.NewEncoderOptions(w, o).Encode(v); err != nil {
+		return nil, err
+	}
+	return w.b, nil
+}
+
+// Unmarshal decodes v from the packet p, which must hold nothing else.
+// It panics if v is of an invalid type.
+func Unmarshal(p []byte, v interface{}) error {
+	return UnmarshalOptions(p, v, enc.Options{})
+}
+
+// UnmarshalOptions is like Unmarshal, but decodes using o.
+func UnmarshalOptions(p []byte, v interface{}, o enc.Options) error {
+	r := bytes.NewReader(p)
+	if err := enc.NewDecoderOptions(r, o).Decode(v); err != nil {
+		return err
+	}
+	if r.Len() != 0 {
+		return enc.CorruptError{Offset: r.Size() - int64(r.Len()), Reason: "trailing data"}
+	}
+	return nil
+}
+
+// WriteTo encodes v into b and sends it to addr over c as a single packet.
+func WriteTo(c net.PacketConn, addr net.Addr, b []byte, v interface{}) error {
+	p, err := Marshal(b, v)
+	if err != nil {
+		return err
+	}
+	_, err = c.WriteTo(p, addr)
+	return err
+}
+
+// ReadFrom receives a single packet from c into b and decodes v from it.
+// It returns the address the packet came from. Packets longer than b
+// are cut off by most connections and fail to decode.
+func ReadFrom(c net.PacketConn, b []byte, v interface{}) (net.Addr, error) {
+	n, addr, err := c.ReadFrom(b)
+	if err != nil {
+		return addr, err
+	}
+	return addr, Unmarshal(b[:n], v)
+}
+
+// fixed appends to b up to its capacity.
+type fixed struct {
+	b []byte
+}
+
+func (w *fixed) Write(p []byte) (int, error) {
+	if len(p) > cap(w.b)-len(w.b) {
+		return 0, enc.ErrTooLarge
+	}
+	w.b = append(w.b, p...)
+	return len(p), nil
+}
+
+func (w *fixed) WriteByte(c byte) error {
+	if len(w.b) == cap(w.b) {
+		return enc.ErrTooLarge
+	}
+	w.b = append(w.b, c)
+	return nil
+}
+
+func (w *fixed) WriteString(s string) (int, error) {
+	if len(s) > cap(w.b)-len(w.b) {
+		return 0, enc.ErrTooLarge
+	}
+	w.b = append(w.b, s...)
+	return len(s), nil
+}
@@ -0,0 +1,62 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dgram
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/koneu/enc"
+)
+
+type ping struct {
+	Seq  uint32
+	Body string
+}
+
+func TestMarshal(t *testing.T) {
+	b := make([]byte, 16)
+	in := ping{7, "hello"}
+	p, err := Marshal(b, &in)
+	if err != nil || &p[0] != &b[0] {
+		t.Fatal(p, err)
+	}
+	var out ping
+	if err := Unmarshal(p, &out); err != nil || out != in {
+		t.Error(out, err)
+	}
+
+	if _, err := Marshal(b[:len(p)-1], &in); err != enc.ErrTooLarge {
+		t.Error("expected", enc.ErrTooLarge, "got", err)
+	}
+	if err := Unmarshal(append(p, 0), &out); !errors.Is(err, enc.ErrCorrupt) {
+		t.Error("expected", enc.ErrCorrupt, "got", err)
+	}
+}
+
+func TestPacketConn(t *testing.T) {
+	a, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer a.Close()
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer c.Close()
+
+	in := ping{1, "over udp"}
+	if err := WriteTo(a, c.LocalAddr(), make([]byte, 512), &in); err != nil {
+		t.Fatal(err)
+	}
+	var out ping
+	addr, err := ReadFrom(c, make([]byte, 512), &out)
+	if err != nil || !reflect.DeepEqual(out, in) || addr.String() != a.LocalAddr().String() {
+		t.Error(out, addr, err)
+	}
+}
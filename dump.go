@@ -0,0 +1,92 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// Dump reads values of type t from r until the end of the stream
+// and writes a description of their encoding to w, one token per line,
+// each prefixed with its offset.
+// It panics if t is an invalid type.
+func Dump(r io.Reader, t reflect.Type, w io.Writer) error {
+	dec := NewDecoder(bufio.NewReader(r))
+	dec.SetTokenType(t)
+	depth := 0
+	for {
+		label := dec.tok.label()
+		off := dec.in.n
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, ok := tok.(End); ok {
+			depth--
+		}
+		if _, err := fmt.Fprintf(w, "%8d %s%s%s\n", off, strings.Repeat("  ", depth), label, describe(tok)); err != nil {
+			return err
+		}
+		if _, ok := tok.(Begin); ok {
+			depth++
+		}
+	}
+}
+
+// label names the element the next token belongs to.
+func (k *tokenizer) label() string {
+	if len(k.stack) == 0 {
+		return ""
+	}
+	f := &k.stack[len(k.stack)-1]
+	if f.i == f.n {
+		return ""
+	}
+	switch m := f.m.(type) {
+	case *structMachine:
+		if f.named {
+			if f.i%2 == 0 {
+				return fmt.Sprintf("name %d: ", f.i/2)
+			}
+			return fmt.Sprintf("value %d: ", f.i/2)
+		}
+		return fmt.Sprintf("%d %s: ", f.i, m.fields[f.i].name)
+	case *mapMachine:
+		if f.i%2 == 0 {
+			return fmt.Sprintf("key %d: ", f.i/2)
+		}
+		return fmt.Sprintf("value %d: ", f.i/2)
+	}
+	return fmt.Sprintf("%d: ", f.i)
+}
+
+func describe(t Token) string {
+	switch t := t.(type) {
+	case Begin:
+		return fmt.Sprintf("%s %d {", t.Kind, t.Len)
+	case End:
+		return "}"
+	case Zero:
+		return "zero"
+	case Ref:
+		return fmt.Sprintf("ref %d", t)
+	case string:
+		return fmt.Sprintf("string %d %q", len(t), t)
+	case []byte:
+		return fmt.Sprintf("bytes %d %x", len(t), t)
+	case int64:
+		return fmt.Sprintf("int %d", t)
+	case uint64:
+		return fmt.Sprintf("uint %d", t)
+	}
+	return fmt.Sprintf("%T %v", t, t)
+}
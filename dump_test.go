@@ -0,0 +1,47 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestDump(t *testing.T) {
+	var buf bytes.Buffer
+	v := Record{ID: 1, Tags: map[string]int{"a": -1}, Body: []byte{2, 3}}
+	if err := Encode(&buf, &v); err != nil {
+		t.Error(err)
+	}
+
+	var out bytes.Buffer
+	if err := Dump(&buf, reflect.TypeOf(Record{}), &out); err != nil {
+		t.Error(err)
+	}
+	want := `       0 struct 4 {
+       1   0 ID: uint 1
+       2   1 Tags: map 1 {
+       3     key 0: string 1 "a"
+       5     value 0: int -1
+       6   }
+       6   2 Body: bytes 2 0203
+       9   3 Next: zero
+      10 }
+`
+	if out.String() != want {
+		t.Errorf("unexpected dump:\n%s", out.String())
+	}
+
+	// as encdump does with -type
+	typ, ok := RegisteredType("string")
+	out.Reset()
+	if err := Dump(bytes.NewReader([]byte{5, 'h', 'e', 'l', 'l', 'o'}), typ, &out); !ok || err != nil || out.String() != "       0 string 5 \"hello\"\n" {
+		t.Errorf("unexpected dump %q %v", out.String(), err)
+	}
+	if _, ok := RegisteredType("nope"); ok {
+		t.Error("found an unregistered type")
+	}
+}
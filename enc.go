@@ -4,20 +4,286 @@
 
 // Package enc implements a very compact binary encoding for Go types.
 // No type information is stored.
+//
+// Struct fields holding slices of booleans, numbers or strings are
+// run-length encoded with the `enc:"rle"` tag, which pays off for
+// sparse data like bitmaps. Runs are made up of their length and
+// a single element.
+//
+// The package level functions, Stats and the machines generated for types
+// are safe for concurrent use. Types, flags and codecs are registered
+// before they are used, typically in init functions. Encoders and Decoders
+// hold the state of their stream and are not safe for concurrent use;
+// configure one and Clone it for every goroutine.
 package enc
 
 import (
 	"encoding"
+	"errors"
 	"io"
 	"reflect"
+	"strconv"
 )
 
 var (
 	bytesType       = reflect.TypeOf([]byte{})
 	marshalerType   = reflect.TypeOf(new(encoding.BinaryMarshaler)).Elem()
+	appenderType    = reflect.TypeOf(new(encoding.BinaryAppender)).Elem()
 	unmarshalerType = reflect.TypeOf(new(encoding.BinaryUnmarshaler)).Elem()
 )
 
+// A Mode selects optional behavior of an Encoder or Decoder.
+// Modes that change the wire format must be set on both sides.
+type Mode uint
+
+const (
+	// SnapshotChans encodes only the elements currently buffered in a channel
+	// and puts them back afterwards, instead of receiving until it is closed.
+	// Closed channels are drained as usual. Should others send to the channel
+	// meanwhile, encoding fails, and the elements that no longer fit are lost.
+	SnapshotChans Mode = 1 << iota
+
+	// Refs encodes every pointer target only once per value and refers back
+	// to it afterwards, preserving aliasing and allowing cyclic values.
+	// It changes the wire format.
+	Refs
+
+	// SkipUnsupported leaves out struct fields of kind Func and UnsafePointer
+	// when encoding and zeroes them when decoding.
+	// Without it, values containing such fields fail with a TypeError.
+	SkipUnsupported
+
+	// OmitEmpty leaves out trailing zero struct fields.
+	// Single fields are left out with the `enc:"omitempty"` tag.
+	// Decoding leaves fields missing from the input untouched.
+	OmitEmpty
+
+	// PreserveNil tells nil slices, maps, pointers, channels and interfaces
+	// apart from empty or zero ones. It changes the wire format.
+	PreserveNil
+
+	// Canonical sorts map entries by their encoding and normalizes floats,
+	// so that values deemed equal by reflect.DeepEqual encode to identical bytes.
+	// It implies PreserveNil and NormalizeFloats.
+	Canonical
+
+	// Framed wraps every value in a frame made up of a sync marker, the length
+	// of the value and a CRC-32 checksum. A Decoder reads whole frames before
+	// decoding them and can find its way back to the next frame with Resync.
+	// Frames can be encrypted or authenticated, see Encoder.SetSealer.
+	// It changes the wire format.
+	Framed
+
+	// Strict fails decoding with a SchemaMismatchError when the encoded
+	// length of an array differs from that of the Go type, or when fields
+	// of a struct are missing from the input and OmitEmpty is not set.
+	// Otherwise, missing elements and fields are left untouched and
+	// extra array elements are skipped. Extra struct fields always fail.
+	// Decoders are strict unless Lenient is set, except those of the
+	// package-level functions like Decode.
+	Strict
+
+	// Typed precedes non-nil interface values with the name their concrete
+	// type is registered under, see Register. Decoding creates a new value
+	// of the registered type. Without it, interface values can only be
+	// decoded into interfaces already holding a value of the right type.
+	// Booleans, numbers, strings, []byte, []interface{} and
+	// map[string]interface{} are registered by default, so that
+	// heterogeneous maps and slices of them, like configurations,
+	// round-trip without registering anything. It changes the wire format.
+	Typed
+
+	// MergeMaps decodes map entries into maps that are already non-nil,
+	// keeping their other entries, instead of replacing them with new maps.
+	// Entries of equal keys are overwritten.
+	MergeMaps
+
+	// NormalizeFloats encodes every NaN with the same bits and negative
+	// zero as zero, so that floats comparing equal encode to identical bytes.
+	NormalizeFloats
+
+	// FiniteFloats fails encoding NaN and infinite floats, and decoding
+	// them with a CorruptError, for payloads that are compared or signed.
+	FiniteFloats
+
+	// ExplicitZeros encodes zero values of comparable types in full,
+	// rather than as a single 0 byte, which the encoding of a value that
+	// is not zero may start with too, like that of a marshaler returning
+	// no data. It changes the wire format. An Encoder in this mode starts
+	// the stream with a header, in Version1 unless a version is set,
+	// so that Decoders pick it up by themselves.
+	ExplicitZeros
+
+	// NamedFields encodes every struct field along with its name and the
+	// length of its value, so that fields are matched by name when decoding,
+	// regardless of their order. Fields unknown to the decoding struct are
+	// skipped, or fail in Strict mode with a FieldError. It costs bytes, but
+	// lets struct layouts differ between encoder and decoder, for instance
+	// while a change rolls out. It changes the wire format.
+	NamedFields
+
+	// Redact encodes struct fields tagged `enc:"redact"` as their zero value,
+	// for encoding values holding secrets like passwords into logs or snapshots.
+	// Without it, these fields are encoded as usual.
+	Redact
+
+	// Lenient keeps Decoders from being strict by default, see Strict.
+	// Strict still applies if it is set along with it.
+	Lenient
+)
+
+// implied returns m along with the modes it implies.
+func (m Mode) implied() Mode {
+	if m&Canonical != 0 {
+		m |= PreserveNil | NormalizeFloats
+	}
+	if m&Lenient == 0 {
+		m |= Strict
+	}
+	return m
+}
+
+// Flags change how values of a single type are encoded.
+// They are set with RegisterFlags, or for all types with Options.
+//
+// By default, types are encoded according to their kind, and through
+// encoding.BinaryMarshaler and encoding.BinaryUnmarshaler only if they
+// cannot be, like struct types with unexported fields other than embedded
+// ones. See Marshalers and NoMarshalers to change this.
+type Flags uint
+
+const (
+	// Unexported includes unexported struct fields, accessed through package unsafe.
+	Unexported Flags = 1 << iota
+
+	// SkipUnexported leaves out unexported struct fields.
+	SkipUnexported
+
+	// Flatten encodes the fields of embedded structs as if they were
+	// fields of the embedding struct, like encoding/json does.
+	// A single embedded struct is flattened with the `enc:"flatten"` tag.
+	Flatten
+
+	// UnixNano encodes time.Time values as nanoseconds since the Unix epoch,
+	// dropping the location and the monotonic clock reading, and decodes
+	// them in UTC. The zero Time encodes as 0, so the epoch itself decodes
+	// as the zero Time. Times out of the range of an int64 fail to encode.
+	// A single field is encoded this way with the `enc:"unixnano"` tag.
+	// Otherwise times go through their binary marshaler, which keeps
+	// the zone offset. time.Duration values always encode as their
+	// nanoseconds, like any int64.
+	UnixNano
+
+	// FastFields reads and writes struct fields of booleans, numbers and
+	// strings at their offsets in memory through package unsafe, rather than
+	// through package reflect, which speeds up plain structs considerably.
+	// It takes effect for structs that are addressable, like those passed
+	// by pointer, and not traced, see Tracer.
+	FastFields
+
+	// NoMarshalers refuses to fall back to encoding.BinaryMarshaler and
+	// encoding.BinaryUnmarshaler, whose output depends on the packages
+	// implementing them, so that every byte on the wire comes from the
+	// encodings documented here. Types left without an encoding fail with
+	// a TypeError when first used, among them time.Time without UnixNano.
+	// It takes precedence over Marshalers.
+	NoMarshalers
+
+	// Marshalers encodes types implementing both encoding.BinaryMarshaler
+	// and encoding.BinaryUnmarshaler through them, even if they could be
+	// encoded otherwise, like structs with exported fields. By default,
+	// marshalers are only used for types that cannot. Set for all types
+	// with Options, a single type is encoded natively with NoMarshalers.
+	Marshalers
+)
+
+var (
+	// ErrCorrupt is matched by every CorruptError.
+	ErrCorrupt = errors.New("enc: corrupt input")
+
+	// ErrTooLarge indicates a length in the input too large to allocate.
+	ErrTooLarge = errors.New("enc: length too large")
+)
+
+var (
+	errSnapshot  = errors.New("enc: channel filled up during snapshot")
+	errEncodeNil = errors.New("enc: cannot encode nil")
+	errFinite    = errors.New("enc: NaN or infinite float in FiniteFloats mode")
+	errRef       = CorruptError{Reason: "invalid reference"}
+	errNil       = CorruptError{Reason: "invalid nil tag"}
+
+	errFields    = CorruptError{Reason: "more struct fields than known"}
+	errFieldLen  = CorruptError{Reason: "struct field shorter than its length"}
+	errToken     = errors.New("enc: interface values cannot be tokenized")
+	errTokenType = errors.New("enc: no token type set")
+	errIP        = errors.New("enc: IP address of invalid length")
+	errInterface = errors.New("enc: cannot decode into a nil interface outside Typed mode")
+	errSkip      = errors.New("enc: interface values cannot be skipped outside Typed mode")
+	errJSONRef   = errors.New("enc: references cannot be converted to JSON")
+
+	errTrailing  = CorruptError{Reason: "trailing data"}
+	errFrame     = CorruptError{Reason: "corrupt frame"}
+	errFrameData = CorruptError{Reason: "frame holds more than one value"}
+	errNonFinite = CorruptError{Reason: "NaN or infinite float"}
+)
+
+// A CorruptError indicates input that is not a valid encoding.
+// Offset is the number of bytes read from the stream when it was detected.
+// It matches ErrCorrupt with errors.Is.
+type CorruptError struct {
+	Offset int64
+	Reason string
+}
+
+func (e CorruptError) Error() string {
+	return "enc: corrupt input at offset " + strconv.FormatInt(e.Offset, 10) + ": " + e.Reason
+}
+
+func (e CorruptError) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+// An EOFError indicates that the stream ended in the middle of a value.
+// It matches io.ErrUnexpectedEOF with errors.Is.
+type EOFError struct {
+	Offset int64
+}
+
+func (e EOFError) Error() string {
+	return "enc: unexpected EOF at offset " + strconv.FormatInt(e.Offset, 10)
+}
+
+func (e EOFError) Is(target error) bool {
+	return target == io.ErrUnexpectedEOF
+}
+
+// A SchemaMismatchError indicates that the input was encoded from a different
+// type than T, holding Encoded elements or fields instead of Expected ones.
+type SchemaMismatchError struct {
+	T                 reflect.Type
+	Expected, Encoded int
+}
+
+func (e SchemaMismatchError) Error() string {
+	return "enc: " + strconv.Itoa(e.Encoded) + " elements encoded for " +
+		e.T.String() + " of " + strconv.Itoa(e.Expected)
+}
+
+// A MarshalerError wraps an error returned by the
+// encoding.BinaryMarshaler, encoding.BinaryUnmarshaler or Codec of a type.
+type MarshalerError struct {
+	T   reflect.Type
+	Err error
+}
+
+func (e MarshalerError) Error() string {
+	return "enc: marshaler of " + e.T.String() + ": " + e.Err.Error()
+}
+
+func (e MarshalerError) Unwrap() error {
+	return e.Err
+}
+
 // A TypeError indicates that an invalid type was passed to De- or Encode.
 type TypeError struct {
 	T reflect.Type
@@ -27,13 +293,55 @@ func (t TypeError) Error() string {
 	return "enc: invalid type: " + t.T.String()
 }
 
-type writer interface {
+// A KeyError indicates that the keys of the map type T cannot be encoded,
+// or that a decoded key of type Key cannot be used in a map.
+type KeyError struct {
+	T, Key reflect.Type
+}
+
+func (k KeyError) Error() string {
+	return "enc: invalid key type " + k.Key.String() + " in " + k.T.String()
+}
+
+// An AssignError indicates that a value passed to Decode cannot be set,
+// like a map element or a value other than a pointer stored in an interface.
+// T is nil if the value is nil.
+type AssignError struct {
+	T reflect.Type
+}
+
+func (a AssignError) Error() string {
+	if a.T == nil {
+		return "enc: cannot decode into nil"
+	}
+	return "enc: cannot decode into unsettable " + a.T.String() + ", use a pointer"
+}
+
+// A FieldError indicates that a struct type lacks a requested field.
+type FieldError struct {
+	T    reflect.Type
+	Name string
+}
+
+func (f FieldError) Error() string {
+	return "enc: no field " + f.Name + " in " + f.T.String()
+}
+
+// A Writer is written to by Encoders directly, without the buffering
+// they add to other writers, like bufio.Writer, bytes.Buffer or a ring
+// buffer of a transport. Output reaches it in small pieces, one byte
+// at a time for many numbers, so its methods should be cheap.
+type Writer interface {
 	io.Writer
 	io.ByteWriter
 	WriteString(string) (int, error)
 }
 
-type reader interface {
+// A Reader is read from by Decoders directly, without the buffering they
+// add to other readers, like bufio.Reader or bytes.Reader, so that they
+// read no further than the values they decode. Input is read from it in
+// small pieces, one byte at a time for many numbers.
+type Reader interface {
 	io.Reader
 	io.ByteScanner
 }
@@ -6,8 +6,25 @@ package enc
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
 	"math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"testing/quick"
 	"time"
@@ -46,11 +63,11 @@ type Test struct {
 type Time struct{ time.Time }
 
 func (Time) Generate(*rand.Rand, int) reflect.Value {
-	return reflect.ValueOf(Time{time.Now()})
+	return reflect.ValueOf(Time{time.Now().Round(0)})
 }
 
 func TestTime(t *testing.T) {
-	n := time.Now()
+	n := time.Now().Round(0)
 	testEquals(t, &n, new(time.Time))
 }
 
@@ -113,6 +130,389 @@ func TestNilChan(t *testing.T) {
 	testEquals(t, new(chan int), &v)
 }
 
+func TestChanContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	var buf bytes.Buffer
+	if err := EncodeContext(ctx, &buf, make(chan int)); err != context.DeadlineExceeded {
+		t.Error("expected", context.DeadlineExceeded, "got", err)
+	}
+
+	c := make(chan int, 4)
+	for i := 1; i <= cap(c); i++ {
+		c <- i
+	}
+	close(c)
+	buf.Reset()
+	if err := Encode(&buf, c); err != nil {
+		t.Error(err)
+	}
+	c = make(chan int)
+	if err := DecodeContext(ctx, &buf, &c); err != context.DeadlineExceeded {
+		t.Error("expected", context.DeadlineExceeded, "got", err)
+	}
+}
+
+func TestChanLimits(t *testing.T) {
+	c := make(chan int, 5)
+	for i := 1; i <= cap(c); i++ {
+		c <- i
+	}
+	close(c)
+	var buf bytes.Buffer
+	if err := Encode(&buf, &struct{ C chan int }{c}); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+
+	var s struct{ C []int }
+	if err := Decode(bytes.NewReader(b), &s); err != nil || !reflect.DeepEqual(s.C, []int{1, 2, 3, 4, 5}) {
+		t.Errorf("unexpected result %v %v", s.C, err)
+	}
+
+	var v struct{ C chan int }
+	d := NewDecoder(bytes.NewReader(b))
+	d.SetChanLimits(4, 0)
+	if err := d.Decode(&v); err != ErrTooLarge {
+		t.Error("expected", ErrTooLarge, "got", err)
+	}
+
+	d = NewDecoder(bytes.NewReader(b))
+	d.SetChanLimits(5, 2)
+	if err := d.Decode(&v); err != ErrTooLarge || v.C != nil {
+		t.Error("expected", ErrTooLarge, "got", err, v.C)
+	}
+	d = NewDecoder(bytes.NewReader(b))
+	d.SetChanLimits(5, 5)
+	if err := d.Decode(&v); err != nil || cap(v.C) != 5 || len(v.C) != 5 {
+		t.Error("unexpected result", err, cap(v.C), len(v.C))
+	}
+
+	// an existing channel takes elements beyond its buffer once they are received
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	v.C = make(chan int, 2)
+	d = NewDecoder(bytes.NewReader(b))
+	if err := d.DecodeContext(ctx, &v); err != context.DeadlineExceeded || len(v.C) != 2 {
+		t.Error("expected", context.DeadlineExceeded, "got", err, len(v.C))
+	}
+}
+
+func TestChanSnapshot(t *testing.T) {
+	c := make(chan int, 4)
+	c <- 1
+	c <- 2
+
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetMode(SnapshotChans)
+	if err := e.Encode(c); err != nil {
+		t.Error(err)
+	}
+	if len(c) != 2 || <-c != 1 || <-c != 2 {
+		t.Error("snapshot changed the channel")
+	}
+
+	var d chan int
+	if err := Decode(&buf, &d); err != nil {
+		t.Error(err)
+	}
+	if len(d) != 2 || <-d != 1 || <-d != 2 {
+		t.Error("decoded data does not match encoded data")
+	}
+
+	// a sender waiting on the full channel takes up the room of the last element
+	c <- 1
+	c <- 2
+	c <- 3
+	c <- 4
+	go func() { c <- 5 }()
+	time.Sleep(10 * time.Millisecond)
+	if err := e.Encode(c); err != errSnapshot {
+		t.Error("expected", errSnapshot, "got", err)
+	}
+	if len(c) != 4 || <-c != 1 || <-c != 2 || <-c != 3 || <-c != 4 {
+		t.Error("elements were not put back")
+	}
+}
+
+type Node struct {
+	V    int
+	Next *Node
+}
+
+func TestRefs(t *testing.T) {
+	a := &Node{V: 1}
+	a.Next = &Node{V: 2, Next: a}
+	v := [2]*Node{a, a.Next}
+
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetMode(Refs)
+	if err := e.Encode(&v); err != nil {
+		t.Error(err)
+	}
+
+	var w [2]*Node
+	d := NewDecoder(&buf)
+	d.SetMode(Refs)
+	if err := d.Decode(&w); err != nil {
+		t.Error(err)
+	}
+	if w[0].V != 1 || w[1].V != 2 || w[0].Next != w[1] || w[1].Next != w[0] {
+		t.Error("decoded data does not match encoded data")
+	}
+}
+
+type Handler struct {
+	Name string
+	F    func()
+	N    int
+}
+
+func TestSkipUnsupported(t *testing.T) {
+	var buf bytes.Buffer
+	h := Handler{"a", func() {}, 1}
+	if _, ok := Encode(&buf, &h).(TypeError); !ok {
+		t.Error("expected TypeError")
+	}
+
+	buf.Reset()
+	e := NewEncoder(&buf)
+	e.SetMode(SkipUnsupported)
+	if err := e.Encode(&h); err != nil {
+		t.Error(err)
+	}
+	g := Handler{F: func() {}}
+	d := NewDecoder(&buf)
+	d.SetMode(SkipUnsupported)
+	if err := d.Decode(&g); err != nil {
+		t.Error(err)
+	}
+	if g.Name != h.Name || g.F != nil || g.N != h.N {
+		t.Error("decoded data does not match encoded data")
+	}
+}
+
+type private struct {
+	A int
+	b string
+	C []byte
+}
+
+type skipped struct {
+	A int
+	b string
+	C []byte
+}
+
+func init() {
+	RegisterFlags(reflect.TypeOf(private{}), Unexported)
+	RegisterFlags(reflect.TypeOf(skipped{}), SkipUnexported)
+}
+
+type Inner struct{ A, B int }
+
+type Tagged struct {
+	Inner `enc:"flatten"`
+	C     int
+}
+
+type Embedding struct {
+	Inner
+	C int
+}
+
+type Flat struct{ A, B, C int }
+
+func init() {
+	RegisterFlags(reflect.TypeOf(Embedding{}), Flatten)
+}
+
+func TestFlatten(t *testing.T) {
+	for _, v := range []interface{}{
+		&Tagged{Inner{1, 2}, 3},
+		&Embedding{Inner{1, 2}, 3},
+	} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, v); err != nil {
+			t.Error(err)
+		}
+		var f Flat
+		if err := Decode(&buf, &f); err != nil {
+			t.Error(err)
+		}
+		if f != (Flat{1, 2, 3}) {
+			t.Error("decoded data does not match encoded data")
+		}
+	}
+}
+
+type Sparse struct {
+	A int
+	B string
+	C []byte `enc:"omitempty"`
+}
+
+func TestOmitEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, &Sparse{A: 1, B: "b"}); err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(buf.Bytes(), []byte{2, 2, 1, 'b'}) {
+		t.Errorf("unexpected encoding %x", buf.Bytes())
+	}
+
+	buf.Reset()
+	e := NewEncoder(&buf)
+	e.SetMode(OmitEmpty)
+	if err := e.Encode(&Sparse{A: 1}); err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(buf.Bytes(), []byte{1, 2}) {
+		t.Errorf("unexpected encoding %x", buf.Bytes())
+	}
+	testEquals(t, &Sparse{A: 1}, new(Sparse))
+}
+
+type Nils struct {
+	S, SE []int
+	B, BE []byte
+	M, ME map[int]int
+	P, PE *int
+	C, CE chan int
+}
+
+func TestPreserveNil(t *testing.T) {
+	v := Nils{
+		SE: []int{},
+		BE: []byte{},
+		ME: map[int]int{},
+		PE: new(int),
+		CE: make(chan int),
+	}
+	close(v.CE)
+
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetMode(PreserveNil)
+	if err := e.Encode(&v); err != nil {
+		t.Error(err)
+	}
+
+	var w Nils
+	d := NewDecoder(&buf)
+	d.SetMode(PreserveNil)
+	if err := d.Decode(&w); err != nil {
+		t.Error(err)
+	}
+	if w.S != nil || w.SE == nil || w.B != nil || w.BE == nil || w.M != nil || w.ME == nil ||
+		w.P != nil || w.PE == nil || w.C != nil || w.CE == nil {
+		t.Errorf("nil-ness was not preserved: %+v", w)
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	v := map[string][]int{}
+	for i := 0; i < 64; i++ {
+		v[string(rune('0'+i))] = make([]int, i%3)
+	}
+
+	var a, b bytes.Buffer
+	for _, buf := range []*bytes.Buffer{&a, &b} {
+		e := NewEncoder(buf)
+		e.SetMode(Canonical)
+		if err := e.Encode(v); err != nil {
+			t.Error(err)
+		}
+	}
+	if !bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Error("canonical encodings differ")
+	}
+
+	var w map[string][]int
+	d := NewDecoder(&a)
+	d.SetMode(Canonical)
+	if err := d.Decode(&w); err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(v, w) {
+		t.Error("decoded data does not match encoded data")
+	}
+}
+
+func TestHash(t *testing.T) {
+	a := randomValue(t, reflect.TypeOf(map[int]string{}))
+	b := reflect.New(reflect.TypeOf(map[int]string{})).Interface()
+	testEquals(t, a, b)
+
+	ha, err := Hash(a, fnv.New64a())
+	if err != nil {
+		t.Error(err)
+	}
+	hb, err := Hash(b, fnv.New64a())
+	if err != nil {
+		t.Error(err)
+	}
+	if ha != hb {
+		t.Error("hashes of equal values differ")
+	}
+}
+
+func TestSize(t *testing.T) {
+	v := randomValue(t, reflect.TypeOf(Test{}))
+	var buf bytes.Buffer
+	if err := Encode(&buf, v); err != nil {
+		t.Error(err)
+	}
+	if n, err := Size(v); err != nil || n != buf.Len() {
+		t.Error("expected", buf.Len(), "got", n, err)
+	}
+}
+
+func TestMeasure(t *testing.T) {
+	v := struct {
+		Name  string
+		Items []Flat
+		Tags  map[string]string
+	}{"n", []Flat{{1, 2, 3}, {300, 0, 0}}, map[string]string{"a": "bc"}}
+	r, err := Measure(&v)
+	if n, _ := Size(&v); err != nil || r.Bytes != n {
+		t.Fatal("expected", n, "got", r.Bytes, err)
+	}
+	for path, want := range map[string]Part{
+		".Name":      {reflect.TypeOf(""), 1, 2},
+		".Items":     {reflect.TypeOf([]Flat{}), 1, 10},
+		".Items[]":   {reflect.TypeOf(Flat{}), 2, 9},
+		".Items[].A": {reflect.TypeOf(0), 2, 3},
+		".Tags[]":    {reflect.TypeOf(""), 1, 3},
+	} {
+		if r.Parts[path] != want {
+			t.Errorf("%s: expected %+v got %+v", path, want, r.Parts[path])
+		}
+	}
+	if s := r.String(); !strings.HasPrefix(s, "19 bytes\n        10        1 .Items []enc.Flat\n") {
+		t.Errorf("unexpected report\n%s", s)
+	}
+}
+
+func TestUnexported(t *testing.T) {
+	testEquals(t, &private{1, "b", []byte{3}}, new(private))
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, skipped{1, "b", []byte{3}}); err != nil {
+		t.Error(err)
+	}
+	var v skipped
+	if err := Decode(&buf, &v); err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(v, skipped{A: 1, C: []byte{3}}) {
+		t.Error("decoded data does not match encoded data")
+	}
+}
+
 func testEquals(t *testing.T, a, b interface{}) {
 	var buf bytes.Buffer
 
@@ -139,3 +539,2281 @@ func randomValue(t testing.TB, typ reflect.Type) interface{} {
 
 	return a.Addr().Interface()
 }
+
+func TestDiff(t *testing.T) {
+	a := randomValue(t, reflect.TypeOf(Test{})).(*Test)
+	b := new(Test)
+	testEquals(t, a, b)
+	if !Equal(a, b) {
+		t.Error("equal values reported as different:", Diff(a, b))
+	}
+
+	b.S += "x"
+	b.A[3]++
+	d := Diff(a, b)
+	if len(d) != 2 || d[0].Path != ".S" || d[1].Path != ".A[3]" {
+		t.Error("unexpected differences", d)
+	}
+}
+
+func TestValue(t *testing.T) {
+	a := randomValue(t, reflect.TypeOf(Test{}))
+	b := new(Test)
+
+	var buf bytes.Buffer
+	if _, err := (Value{a}).WriteTo(&buf); err != nil {
+		t.Error(err)
+	}
+	n := int64(buf.Len())
+	if m, err := (Value{b}).ReadFrom(&buf); err != nil || m != n {
+		t.Error("expected", n, "bytes, got", m, err)
+	}
+	if !reflect.DeepEqual(a, b) {
+		t.Error("decoded data does not match encoded data")
+	}
+}
+
+type Envelope struct {
+	Kind    string
+	Payload Raw
+}
+
+func TestRaw(t *testing.T) {
+	a := randomValue(t, reflect.TypeOf(Test{}))
+	p, err := NewRaw(a)
+	if err != nil {
+		t.Error(err)
+	}
+
+	var e Envelope
+	testEquals(t, &Envelope{"test", p}, &e)
+	b := new(Test)
+	if err := e.Payload.Decode(b); err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(a, b) {
+		t.Error("decoded data does not match encoded data")
+	}
+}
+
+type LazyEnvelope struct {
+	Kind    string
+	Payload *Lazy[Test]
+}
+
+func TestLazy(t *testing.T) {
+	a := randomValue(t, reflect.TypeOf(Test{})).(*Test)
+	var buf bytes.Buffer
+	if err := Encode(&buf, &LazyEnvelope{"test", NewLazy(*a)}); err != nil {
+		t.Error(err)
+	}
+
+	var e Envelope
+	if err := Decode(bytes.NewReader(buf.Bytes()), &e); err != nil {
+		t.Error(err)
+	}
+	var l LazyEnvelope
+	if err := Decode(&buf, &l); err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(l.Payload.raw, e.Payload) {
+		t.Error("Lazy is not laid out like Raw")
+	}
+	b, err := l.Payload.Value()
+	if err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(*a, b) {
+		t.Error("decoded data does not match encoded data")
+	}
+}
+
+func TestAll(t *testing.T) {
+	a := randomValue(t, reflect.TypeOf(Test{})).(*Test)
+	var buf bytes.Buffer
+	if err := EncodeAll(&buf, "header", a, uint(7)); err != nil {
+		t.Error(err)
+	}
+
+	var (
+		h string
+		b Test
+		n uint
+	)
+	if err := DecodeAll(&buf, &h, &b, &n); err != nil {
+		t.Error(err)
+	}
+	if h != "header" || !reflect.DeepEqual(*a, b) || n != 7 {
+		t.Error("decoded data does not match encoded data")
+	}
+}
+
+func TestParallel(t *testing.T) {
+	a := make([]Test, 64)
+	for i := range a {
+		a[i] = *randomValue(t, reflect.TypeOf(Test{})).(*Test)
+	}
+	var want, got bytes.Buffer
+	if err := Encode(&want, a); err != nil {
+		t.Error(err)
+	}
+	enc := NewEncoder(&got)
+	enc.SetParallelism(4, 16)
+	if err := enc.Encode(a); err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(want.Bytes(), got.Bytes()) {
+		t.Error("parallel encoding differs")
+	}
+
+	// with a Tracer, elements are reported in order
+	f, g := fieldSizes{}, fieldSizes{}
+	for _, s := range []struct {
+		n int
+		f fieldSizes
+	}{{0, f}, {4, g}} {
+		enc := NewEncoder(io.Discard)
+		enc.SetParallelism(s.n, 16)
+		enc.SetTracer(s.f)
+		if err := enc.Encode(a); err != nil {
+			t.Error(err)
+		}
+	}
+	if len(f) < len(a) || !reflect.DeepEqual(f, g) {
+		t.Error("unexpected sizes", g)
+	}
+}
+
+func TestRegion(t *testing.T) {
+	a := make([]*Test, 16)
+	for i := range a {
+		a[i] = randomValue(t, reflect.TypeOf(Test{})).(*Test)
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, a); err != nil {
+		t.Error(err)
+	}
+
+	var b []*Test
+	dec := NewDecoder(&buf)
+	dec.SetAllocator(new(Region))
+	if err := dec.Decode(&b); err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(a, b) {
+		t.Error("decoded data does not match encoded data")
+	}
+}
+
+type loose struct {
+	A int
+	b string
+}
+
+func TestOptions(t *testing.T) {
+	var buf bytes.Buffer
+	o := Options{Mode: PreserveNil, Flags: Unexported}
+	if err := NewEncoderOptions(&buf, o).Encode(&loose{1, "b"}); err != nil {
+		t.Error(err)
+	}
+
+	var a loose
+	if err := NewDecoderOptions(&buf, o).Decode(&a); err != nil {
+		t.Error(err)
+	}
+	if a != (loose{1, "b"}) {
+		t.Error("decoded data does not match encoded data")
+	}
+
+	defer func() {
+		if _, ok := recover().(TypeError); !ok {
+			t.Error("unexported fields encoded without the Unexported flag")
+		}
+	}()
+	Encode(&buf, &loose{})
+}
+
+func TestCorrupt(t *testing.T) {
+	for _, c := range []struct {
+		data []byte
+		v    interface{}
+	}{
+		{[]byte{0x81, 0x00}, new(uint)},
+		{[]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02}, new(uint64)},
+		{[]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, new([]byte)},
+	} {
+		if _, ok := Decode(bytes.NewReader(c.data), c.v).(CorruptError); !ok {
+			t.Errorf("%x decoded into %T", c.data, c.v)
+		}
+	}
+}
+
+type failing struct{ x int }
+
+func (failing) MarshalBinary() ([]byte, error) { return nil, io.ErrShortWrite }
+
+func TestErrors(t *testing.T) {
+	var buf bytes.Buffer
+	Encode(&buf, randomValue(t, reflect.TypeOf(Test{})))
+	b := buf.Bytes()
+
+	var a Test
+	err := Decode(opaqueReader{bytes.NewReader(b[:len(b)/2])}, &a)
+	if e, ok := err.(EOFError); !ok || e.Offset != int64(len(b)/2) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("unexpected error", err)
+	}
+	// with the size of the input known, a length past its end fails early
+	err = Decode(bytes.NewReader(b[:len(b)/2]), &a)
+	if e, ok := err.(EOFError); !ok || e.Offset > int64(len(b)/2) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("unexpected error", err)
+	}
+	if err := Decode(bytes.NewReader([]byte{0x81, 0x00}), new(uint)); !errors.Is(err, ErrCorrupt) {
+		t.Error("unexpected error", err)
+	}
+	// on 32-bit platforms, the length overflows int
+	if err := Decode(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}), new([]int64)); err != ErrTooLarge && !errors.Is(err, ErrCorrupt) {
+		t.Error("unexpected error", err)
+	}
+	if err := Encode(&buf, &failing{1}); !errors.Is(err, io.ErrShortWrite) {
+		t.Error("unexpected error", err)
+	} else if e, ok := err.(MarshalerError); !ok || e.T != reflect.TypeOf(failing{}) {
+		t.Error("unexpected error", err)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	var buf bytes.Buffer
+	if err := EncodeAll(&buf, &[3]int{1, 2, 3}, "next"); err != nil {
+		t.Error(err)
+	}
+	b := buf.Bytes()
+
+	var (
+		a [2]int
+		s string
+	)
+	if err := DecodeAll(bytes.NewReader(b), &a, &s); err != nil {
+		t.Error(err)
+	}
+	if a != [2]int{1, 2} || s != "next" {
+		t.Error("decoded data does not match encoded data")
+	}
+
+	d := NewDecoder(bytes.NewReader(b))
+	d.SetMode(Strict)
+	if err, ok := d.Decode(&a).(SchemaMismatchError); !ok || err.Expected != 2 || err.Encoded != 3 {
+		t.Error("unexpected error", err)
+	}
+
+	// Decoders are strict by default
+	for _, d := range []*Decoder{NewDecoder(bytes.NewReader(b)), NewDecoderOptions(bytes.NewReader(b), Options{Mode: Typed})} {
+		if _, ok := d.Decode(&a).(SchemaMismatchError); !ok {
+			t.Error("expected a SchemaMismatchError")
+		}
+	}
+	d = NewDecoderOptions(bytes.NewReader(b), Options{Mode: Lenient})
+	if err := d.Decode(&a); err != nil {
+		t.Error(err)
+	}
+	d = NewDecoder(bytes.NewReader(b))
+	d.SetMode(Strict | Lenient)
+	if _, ok := d.Decode(&a).(SchemaMismatchError); !ok {
+		t.Error("expected a SchemaMismatchError")
+	}
+}
+
+func TestFieldCount(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, &Flat{1, 2, 3}); err != nil {
+		t.Error(err)
+	}
+	b := buf.Bytes()
+
+	if err, ok := Decode(bytes.NewReader(b), new(Inner)).(SchemaMismatchError); !ok ||
+		err.T != reflect.TypeOf(Inner{}) || err.Expected != 2 || err.Encoded != 3 {
+		t.Error("unexpected error", err)
+	}
+
+	buf.Reset()
+	if err := Encode(&buf, &Inner{1, 2}); err != nil {
+		t.Error(err)
+	}
+	var f Flat
+	if err := Decode(bytes.NewReader(buf.Bytes()), &f); err != nil || f != (Flat{1, 2, 0}) {
+		t.Error("unexpected result", f, err)
+	}
+	d := NewDecoder(bytes.NewReader(buf.Bytes()))
+	d.SetMode(Strict)
+	if _, ok := d.Decode(&f).(SchemaMismatchError); !ok {
+		t.Error("expected SchemaMismatchError")
+	}
+}
+
+type Shape interface{ Area() int }
+
+type Square struct{ S int }
+
+func (s Square) Area() int { return s.S * s.S }
+
+type Drawing struct {
+	Shapes []Shape
+	Any    interface{}
+	Err    error
+}
+
+func init() {
+	Register(Square{})
+	Register(&Flat{})
+	RegisterName("string", "")
+}
+
+func TestTyped(t *testing.T) {
+	v := Drawing{[]Shape{Square{2}, nil}, &Flat{1, 2, 3}, nil}
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetMode(Typed)
+	if err := e.Encode(&v); err != nil {
+		t.Error(err)
+	}
+
+	var w Drawing
+	d := NewDecoder(&buf)
+	d.SetMode(Typed)
+	if err := d.Decode(&w); err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(v, w) {
+		t.Error("decoded data does not match encoded data")
+	}
+
+	if _, ok := e.Encode(&Drawing{Any: Flat{}}).(UnregisteredError); !ok {
+		t.Error("expected UnregisteredError")
+	}
+}
+
+func TestRegisterBuiltin(t *testing.T) {
+	var old bytes.Buffer
+	e := NewEncoder(&old)
+	e.SetMode(Typed)
+	if err := e.Encode([]interface{}{uintptr(1)}); err != nil {
+		t.Fatal(err)
+	}
+
+	RegisterName("myapp.ptr", uintptr(0))
+	var buf bytes.Buffer
+	e = NewEncoder(&buf)
+	e.SetMode(Typed)
+	if err := e.Encode([]interface{}{uintptr(2)}); err != nil || !bytes.Contains(buf.Bytes(), []byte("myapp.ptr")) {
+		t.Errorf("unexpected encoding %q %v", buf.Bytes(), err)
+	}
+	for _, b := range [][]byte{old.Bytes(), buf.Bytes()} {
+		var v []interface{}
+		d := NewDecoder(bytes.NewReader(b))
+		d.SetMode(Typed)
+		if err := d.Decode(&v); err != nil || len(v) != 1 {
+			t.Errorf("unexpected result %v %v", v, err)
+		} else if _, ok := v[0].(uintptr); !ok {
+			t.Errorf("decoded %T", v[0])
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic renaming a type again")
+		}
+	}()
+	RegisterName("myapp.other", uintptr(0))
+}
+
+func TestNilInterfaceDestination(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetMode(Typed)
+	var s Shape = Square{3}
+	if err := e.Encode(&s); err != nil {
+		t.Error(err)
+	}
+	b := buf.Bytes()
+
+	var r Shape
+	d := NewDecoder(bytes.NewReader(b))
+	d.SetMode(Typed)
+	if err := d.Decode(&r); err != nil || r != s {
+		t.Error("unexpected result", r, err)
+	}
+
+	buf.Reset()
+	if err := Encode(&buf, &s); err != nil {
+		t.Error(err)
+	}
+	if err := Decode(bytes.NewReader(buf.Bytes()), new(Shape)); err != errInterface {
+		t.Error("expected", errInterface, "got", err)
+	}
+	r = Square{}
+	if err := Decode(&buf, &r); err != nil || r != s {
+		t.Error("unexpected result", r, err)
+	}
+}
+
+type Attachment struct {
+	Name string
+	Data Streamed
+}
+
+func TestStreamed(t *testing.T) {
+	data := make([]byte, 1<<16)
+	rd.Read(data)
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, &Attachment{"a", Streamed{bytes.NewReader(data), int64(len(data))}}); err != nil {
+		t.Error(err)
+	}
+	b := buf.Bytes()
+
+	var f struct {
+		Name string
+		Data []byte
+	}
+	if err := Decode(bytes.NewReader(b), &f); err != nil || !bytes.Equal(f.Data, data) {
+		t.Error("decoded data does not match encoded data", err)
+	}
+	var a Attachment
+	if err := Decode(bytes.NewReader(b), &a); err != nil {
+		t.Error(err)
+	}
+	if c, err := io.ReadAll(a.Data.R); err != nil || !bytes.Equal(c, data) || a.Data.N != int64(len(data)) {
+		t.Error("decoded data does not match encoded data", err)
+	}
+
+	if err := Encode(&buf, &Streamed{bytes.NewReader(data), int64(len(data)) + 1}); err != io.ErrUnexpectedEOF {
+		t.Error("expected", io.ErrUnexpectedEOF, "got", err)
+	}
+}
+
+func TestSink(t *testing.T) {
+	data := make([]byte, 1<<12)
+	rd.Read(data)
+	var buf bytes.Buffer
+	if err := Encode(&buf, &struct {
+		Name string
+		Data []byte
+	}{"a", data}); err != nil {
+		t.Error(err)
+	}
+	b := buf.Bytes()
+
+	var w bytes.Buffer
+	f := struct {
+		Name string
+		Data Sink
+	}{Data: Sink{W: &w}}
+	if err := Decode(bytes.NewReader(b), &f); err != nil || !bytes.Equal(w.Bytes(), data) || f.Data.N != int64(len(data)) {
+		t.Error("decoded data does not match encoded data", err)
+	}
+
+	var a Attachment
+	if err := NewDecoderOptions(bytes.NewReader(b), Options{SpillSize: 1 << 10}).Decode(&a); err != nil {
+		t.Error(err)
+	}
+	file, ok := a.Data.R.(*os.File)
+	if !ok {
+		t.Fatal("data was not spilled")
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if c, err := io.ReadAll(file); err != nil || !bytes.Equal(c, data) {
+		t.Error("decoded data does not match encoded data", err)
+	}
+}
+
+func TestMaxMessageBytes(t *testing.T) {
+	var buf bytes.Buffer
+	if err := EncodeAll(&buf, make([]byte, 100), make([]byte, 10)); err != nil {
+		t.Error(err)
+	}
+	b := buf.Bytes()
+
+	var v []byte
+	d := NewDecoder(bytes.NewReader(b))
+	d.SetMaxMessageBytes(64)
+	if err := d.Decode(&v); err != ErrTooLarge {
+		t.Error("expected", ErrTooLarge, "got", err)
+	}
+
+	d = NewDecoder(bytes.NewReader(b[101:]))
+	d.SetMaxMessageBytes(11)
+	if err := d.Decode(&v); err != nil || len(v) != 10 {
+		t.Error("unexpected result", len(v), err)
+	}
+
+	d = NewDecoder(bytes.NewReader([]byte{0xff, 0x7f}))
+	d.SetMaxMessageBytes(64)
+	if err := d.Decode(new([]struct{})); err != ErrTooLarge {
+		t.Error("expected", ErrTooLarge, "got", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	var s Stats
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetStats(&s)
+	for _, v := range []interface{}{"ab", &Flat{1, 2, 3}, "c"} {
+		if err := e.Encode(v); err != nil {
+			t.Error(err)
+		}
+	}
+	n := int64(buf.Len())
+
+	d := NewDecoder(&buf)
+	d.SetStats(&s)
+	var (
+		a, c string
+		f    Flat
+	)
+	for _, v := range []interface{}{&a, &f, &c} {
+		if err := d.Decode(v); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if tot := s.Total(); tot.Encoded != 3 || tot.EncodedBytes != n || tot.Decoded != 3 || tot.DecodedBytes != n {
+		t.Errorf("unexpected totals %+v", tot)
+	}
+	if ts := s.Types()[reflect.TypeOf("")]; ts.Encoded != 2 || ts.EncodedBytes != 5 {
+		t.Errorf("unexpected string counts %+v", ts)
+	}
+	if !strings.Contains(s.String(), `"string":{"encoded":2,"encodedBytes":5,"decoded":2,"decodedBytes":5}`) {
+		t.Error("unexpected JSON", s.String())
+	}
+}
+
+type fieldSizes map[string]int
+
+func (f fieldSizes) OnField(path string, t reflect.Type, n int) {
+	f[path] = n
+}
+
+func TestTracer(t *testing.T) {
+	v := struct {
+		S string
+		L []Flat
+		M map[string]int
+	}{"abc", []Flat{{1, 2, 3}}, map[string]int{"k": 100}}
+
+	for _, m := range []Mode{0, Canonical} {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf)
+		e.SetMode(m)
+		f := fieldSizes{}
+		e.SetTracer(f)
+		if err := e.Encode(&v); err != nil {
+			t.Error(err)
+		}
+		want := fieldSizes{"": buf.Len(), ".S": 4, ".L": 5, ".L[0]": 4, ".L[0].A": 1, ".L[0].B": 1, ".L[0].C": 1, ".M": 5, `.M["k"]`: 2}
+		if !reflect.DeepEqual(f, want) {
+			t.Error("unexpected sizes", f)
+		}
+
+		d := NewDecoder(&buf)
+		d.SetMode(m)
+		g := fieldSizes{}
+		d.SetTracer(g)
+		if err := d.Decode(&v); err != nil {
+			t.Error(err)
+		}
+		if !reflect.DeepEqual(f, g) {
+			t.Error("unexpected sizes", g)
+		}
+	}
+}
+
+type Row struct {
+	Name  sql.NullString
+	Age   sql.NullInt64
+	Score Option[float64]
+	Tags  Option[[]string]
+}
+
+func TestOption(t *testing.T) {
+	v := Row{Name: sql.NullString{String: "a", Valid: true}, Score: Some(1.5), Tags: Option[[]string]{V: []string{"x"}}}
+	var buf bytes.Buffer
+	if err := Encode(&buf, &v); err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(buf.Bytes()[:6], []byte{4, 1, 1, 'a', 0, 1}) || buf.Bytes()[buf.Len()-1] != 0 {
+		t.Errorf("unexpected encoding %x", buf.Bytes())
+	}
+
+	w := Row{Age: sql.NullInt64{Int64: 3, Valid: true}}
+	if err := Decode(&buf, &w); err != nil {
+		t.Error(err)
+	}
+	v.Tags = Option[[]string]{}
+	if !reflect.DeepEqual(v, w) {
+		t.Errorf("decoded data does not match encoded data: %+v", w)
+	}
+	if s, ok := w.Score.Get(); !ok || s != 1.5 {
+		t.Error("unexpected Get result", s, ok)
+	}
+}
+
+type Peer struct {
+	Addr   netip.Addr
+	Zoned  netip.Addr
+	Net    netip.Prefix
+	None   netip.Prefix
+	IP, V6 net.IP
+}
+
+func TestNet(t *testing.T) {
+	v := Peer{
+		Addr:  netip.MustParseAddr("192.0.2.1"),
+		Zoned: netip.MustParseAddr("fe80::1%eth0"),
+		Net:   netip.MustParsePrefix("2001:db8::/32"),
+		IP:    net.IPv4(192, 0, 2, 2).To4(),
+		V6:    net.ParseIP("2001:db8::1"),
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, &v); err != nil {
+		t.Error(err)
+	}
+	if n := 1 + 5 + 22 + 18 + 1 + 5 + 17; buf.Len() != n {
+		t.Errorf("encoded to %d bytes instead of %d", buf.Len(), n)
+	}
+	b := buf.Bytes()
+
+	var w Peer
+	if err := Decode(bytes.NewReader(b), &w); err != nil {
+		t.Error(err)
+	}
+	if !Equal(&v, &w) {
+		t.Error("decoded data does not match encoded data:", Diff(&v, &w))
+	}
+	if err := Describe(reflect.TypeOf(Peer{})).Validate(b); err != nil {
+		t.Error(err)
+	}
+
+	b[1] = 5
+	if err := Decode(bytes.NewReader(b), &w); !errors.Is(err, ErrCorrupt) {
+		t.Error("expected corrupt input, got", err)
+	}
+	if err := Encode(&buf, &Peer{IP: net.IP{1, 2}}); err != errIP {
+		t.Error("expected", errIP, "got", err)
+	}
+}
+
+// upper stores strings in upper case.
+type upper string
+
+type upperCodec struct{}
+
+func (upperCodec) Size() int { return 0 }
+
+func (upperCodec) Append(b []byte, v reflect.Value) ([]byte, error) {
+	return append(b, strings.ToUpper(v.String())...), nil
+}
+
+func (upperCodec) Decode(b []byte, v reflect.Value) error {
+	v.SetString(string(b))
+	return nil
+}
+
+func TestCodec(t *testing.T) {
+	RegisterCodec(reflect.TypeOf(upper("")), upperCodec{})
+	v := []upper{"a", "", "bc"}
+	var buf bytes.Buffer
+	if err := Encode(&buf, &v); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), []byte{3, 1, 'A', 0, 2, 'B', 'C'}) {
+		t.Errorf("unexpected encoding %x", buf.Bytes())
+	}
+	var w []upper
+	if err := Decode(&buf, &w); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(w, []upper{"A", "", "BC"}) {
+		t.Errorf("decoded %q", w)
+	}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Size() int { return 0 }
+
+func (jsonCodec) Append(b []byte, v reflect.Value) ([]byte, error) {
+	j, err := json.Marshal(v.Interface())
+	return append(b, j...), err
+}
+
+func (jsonCodec) Decode(b []byte, v reflect.Value) error {
+	return json.Unmarshal(b, v.Addr().Interface())
+}
+
+type Config struct {
+	Name string
+	Blob map[string]interface{} `enc:",codec=json"`
+	Tag  upper                  `enc:"codec=json"`
+}
+
+func init() {
+	RegisterNamedCodec("json", jsonCodec{})
+}
+
+func TestNamedCodec(t *testing.T) {
+	v := Config{"c", map[string]interface{}{"a": []interface{}{1.5, "b"}}, "x"}
+	var buf bytes.Buffer
+	if err := Encode(&buf, &v); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte(`{"a":[1.5,"b"]}`)) || !bytes.Contains(buf.Bytes(), []byte(`"x"`)) {
+		t.Errorf("unexpected encoding %q", buf.Bytes())
+	}
+	var w Config
+	if err := Decode(&buf, &w); err != nil || !reflect.DeepEqual(v, w) {
+		t.Errorf("unexpected result %+v %v", w, err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("unknown codec used")
+		}
+	}()
+	Encode(&buf, &struct {
+		A int `enc:"codec=unknown"`
+	}{})
+}
+
+type Event struct {
+	At      time.Time `enc:"unixnano"`
+	Took    time.Duration
+	Created time.Time
+}
+
+func TestUnixNano(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 6, time.FixedZone("X", 3600))
+	v := Event{at, 1500 * time.Millisecond, at}
+	var buf bytes.Buffer
+	if err := Encode(&buf, &v); err != nil {
+		t.Fatal(err)
+	}
+	var w Event
+	if err := Decode(&buf, &w); err != nil {
+		t.Fatal(err)
+	}
+	if !w.At.Equal(at) || w.At.Location() != time.UTC || w.Took != v.Took || !w.Created.Equal(at) {
+		t.Errorf("decoded %+v", w)
+	}
+
+	buf.Reset()
+	v = Event{}
+	if err := Encode(&buf, &v); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), []byte{0}) {
+		t.Errorf("unexpected encoding %x", buf.Bytes())
+	}
+
+	v.At = time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := Encode(&buf, &v); err != errUnixNano {
+		t.Error("unexpected error", err)
+	}
+}
+
+func TestMergeMaps(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, map[string]int{"b": 2, "c": 3}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	m := map[string]int{"a": 1, "b": 0}
+	dec := NewDecoder(bytes.NewReader(data))
+	dec.SetMode(MergeMaps)
+	if err := dec.Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, map[string]int{"a": 1, "b": 2, "c": 3}) {
+		t.Error("unexpected merge result", m)
+	}
+
+	m = map[string]int{"a": 1}
+	if err := Decode(bytes.NewReader(data), &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 {
+		t.Error("map was not replaced", m)
+	}
+}
+
+func TestAssign(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, Flat{A: 1}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	m := map[string]Flat{"a": {}}
+	if err := DecodeValue(bytes.NewReader(data), reflect.ValueOf(m).MapIndex(reflect.ValueOf("a"))); !errors.As(err, new(AssignError)) {
+		t.Error("unexpected error for a map element", err)
+	}
+	var i interface{} = Flat{}
+	if err := Decode(bytes.NewReader(data), i); err != (AssignError{reflect.TypeOf(Flat{})}) {
+		t.Error("unexpected error for a non-pointer", err)
+	}
+	if err := Decode(bytes.NewReader(data), nil); err != (AssignError{}) {
+		t.Error("unexpected error for nil", err)
+	}
+
+	if err := Decode(bytes.NewReader(data), &i); err != nil || i != (Flat{A: 1}) {
+		t.Error("unexpected interface result", i, err)
+	}
+	p := map[string]*Flat{"a": {}}
+	if err := DecodeValue(bytes.NewReader(data), reflect.ValueOf(p).MapIndex(reflect.ValueOf("a"))); err != nil || *p["a"] != (Flat{A: 1}) {
+		t.Error("unexpected map pointer result", p["a"], err)
+	}
+}
+
+func TestTopLevel(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, nil); err != errEncodeNil {
+		t.Error("unexpected error for nil", err)
+	}
+	if err := Encode(&buf, (*Flat)(nil)); err != errEncodeNil || buf.Len() != 0 {
+		t.Error("unexpected error for a nil pointer", err)
+	}
+
+	var s Shape = Square{2}
+	if err := EncodeAll(&buf, s, &s); err != nil {
+		t.Fatal(err)
+	}
+	var sq Square
+	w := Shape(Square{})
+	if err := DecodeAll(&buf, &sq, &w); err != nil {
+		t.Fatal(err)
+	}
+	if sq != s || w != s {
+		t.Error("unexpected results", sq, w)
+	}
+}
+
+func TestFloats(t *testing.T) {
+	nan := math.Float64frombits(math.Float64bits(math.NaN()) | 1)
+	var a, b bytes.Buffer
+	ea, eb := NewEncoder(&a), NewEncoder(&b)
+	ea.SetMode(NormalizeFloats)
+	eb.SetMode(NormalizeFloats)
+	if err := ea.Encode([]float64{nan, math.Copysign(0, -1)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := eb.Encode([]float64{math.NaN(), 0}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Errorf("%x != %x", a.Bytes(), b.Bytes())
+	}
+
+	e := NewEncoder(&a)
+	e.SetMode(FiniteFloats)
+	for _, f := range []float64{nan, math.Inf(-1)} {
+		if err := e.Encode(f); err != errFinite {
+			t.Error("unexpected error for", f, err)
+		}
+	}
+	var fs []float64
+	d := NewDecoder(&b)
+	d.SetMode(FiniteFloats)
+	if err := d.Decode(&fs); !errors.Is(err, ErrCorrupt) {
+		t.Error("unexpected decode error", err)
+	}
+}
+
+type Bitmap struct {
+	Bits   []bool   `enc:"rle"`
+	Levels []uint8  `enc:"rle"`
+	Names  []string `enc:"rle"`
+}
+
+func TestRLE(t *testing.T) {
+	v := Bitmap{Bits: make([]bool, 1000), Levels: []uint8{1, 1, 2, 0, 0, 0}, Names: []string{}}
+	v.Bits[500] = true
+	var buf bytes.Buffer
+	if err := Encode(&buf, &v); err != nil {
+		t.Fatal(err)
+	}
+	if l := buf.Len(); l != 1+1+9+1+6+1 {
+		t.Errorf("encoded %d bytes: %x", l, buf.Bytes())
+	}
+	data := buf.Bytes()
+	if err := Describe(reflect.TypeOf(v)).Validate(data); err != nil {
+		t.Error(err)
+	}
+
+	var w Bitmap
+	if err := Decode(bytes.NewReader(data), &w); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v, w) {
+		t.Errorf("decoded %+v", w)
+	}
+
+	d := NewDecoder(bytes.NewReader(data))
+	d.SetTokenType(reflect.TypeOf(v))
+	var toks []Token
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		toks = append(toks, tok)
+	}
+	if len(toks) != 1+1+1000+1+1+6+1+2+1 || toks[502] != true || toks[1006] != uint64(2) {
+		t.Errorf("unexpected tokens %v", toks[1000:])
+	}
+
+	var c CorruptError
+	if err := Decode(bytes.NewReader([]byte{1, 2, 3, 0}), &w); !errors.As(err, &c) || c.Reason != errRun.Reason {
+		t.Error("unexpected error for a run too long", err)
+	}
+
+	// a huge length fails before it is allocated
+	var h struct {
+		S []int64 `enc:"rle"`
+	}
+	huge := []byte{1, 0x80, 0x80, 0x80, 0x80, 0x10, 0x80}
+	d = NewDecoder(bytes.NewReader(huge))
+	d.SetMaxMessageBytes(int64(len(huge)))
+	if err := d.Decode(&h); err != ErrTooLarge {
+		t.Error("unexpected error for a huge length", err)
+	}
+	if err := Decode(bytes.NewReader(huge), &h); err != ErrTooLarge {
+		t.Error("unexpected error for a huge length", err)
+	}
+	// over a reader of unknown size, runs are allocated as they arrive
+	huge = []byte{1, 0x80, 0x80, 0x80, 0x80, 0x10, 0x80, 0x80, 0x80, 0x80, 0x0f, 2, 1, 2}
+	if err := Decode(opaqueReader{bytes.NewReader(huge)}, &h); err != ErrTooLarge {
+		t.Error("unexpected error for a huge run", err)
+	}
+	huge = []byte{1, 0x80, 0x80, 0x80, 0x80, 0x10, 0x80, 0x80, 0x01, 2, 0x80, 0x80, 0x01, 4}
+	if err := Decode(opaqueReader{bytes.NewReader(huge)}, &h); err != (EOFError{int64(len(huge))}) {
+		t.Error("unexpected error for runs cut short", err)
+	}
+	long := Bitmap{Levels: make([]uint8, 100000)}
+	long.Levels[len(long.Levels)-1] = 1
+	buf.Reset()
+	Encode(&buf, long)
+	var got Bitmap
+	if err := Decode(opaqueReader{&buf}, &got); err != nil || !reflect.DeepEqual(long.Levels, got.Levels) {
+		t.Error("unexpected result over a reader of unknown size", err)
+	}
+}
+
+type Setting string
+
+type Level int
+
+func init() {
+	RegisterEnum([]Setting{"timeout", "retries", "verbose"})
+	RegisterEnum([]Level{-1, 0, 10})
+}
+
+func TestEnum(t *testing.T) {
+	v := map[Setting]Level{"timeout": 10, "verbose": -1}
+	var buf bytes.Buffer
+	if err := Encode(&buf, v); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 5 {
+		t.Errorf("unexpected encoding %x", buf.Bytes())
+	}
+	if err := Describe(reflect.TypeOf(v)).Validate(buf.Bytes()); err != nil {
+		t.Error(err)
+	}
+	var w map[Setting]Level
+	if err := Decode(&buf, &w); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v, w) {
+		t.Error("decoded", w)
+	}
+
+	if err := Encode(&buf, Setting("other")); err == nil {
+		t.Error("encoded an unregistered value")
+	}
+	var c CorruptError
+	if err := Decode(bytes.NewReader([]byte{3}), new(Level)); !errors.As(err, &c) || c.Reason != errEnum.Reason {
+		t.Error("unexpected error for an invalid index", err)
+	}
+}
+
+func TestTee(t *testing.T) {
+	var a, b bytes.Buffer
+	h := fnv.New64a()
+	e := NewEncoder(&a)
+	e.Tee(&b)
+	e.Tee(h)
+	if err := e.Encode(&Flat{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Encode("x"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Errorf("%x != %x", a.Bytes(), b.Bytes())
+	}
+	g := fnv.New64a()
+	g.Write(a.Bytes())
+	if g.Sum64() != h.Sum64() {
+		t.Error("hash mismatch")
+	}
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	for _, v := range []Flat{{1, 2, 3}, {4, 5, 6}} {
+		if err := WriteFile(path, &v, 0600); err != nil {
+			t.Fatal(err)
+		}
+		var w Flat
+		if err := ReadFile(path, &w); err != nil || w != v {
+			t.Error("unexpected value", w, err)
+		}
+	}
+	if fs, _ := os.ReadDir(filepath.Dir(path)); len(fs) != 1 {
+		t.Error("temporary files left behind", fs)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(path, append(b, 0), 0600)
+	var c CorruptError
+	if err := ReadFile(path, new(Flat)); !errors.As(err, &c) || c.Offset != int64(len(b)) {
+		t.Error("unexpected error for trailing data", err)
+	}
+
+	b[len(b)-5]++
+	os.WriteFile(path, b, 0600)
+	if err := ReadFile(path, new(Flat)); !errors.Is(err, ErrCorrupt) {
+		t.Error("read a corrupt file", err)
+	}
+}
+
+type Holder struct {
+	V interface{}
+	F float64
+}
+
+func TestZeros(t *testing.T) {
+	// comparing to the zero value used to panic on uncomparable dynamic types
+	v := Holder{V: []int{1}, F: math.Copysign(0, -1)}
+	var buf bytes.Buffer
+	if err := Encode(&buf, &v); err != nil {
+		t.Fatal(err)
+	}
+	w := Holder{V: []int{}}
+	if err := Decode(&buf, &w); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v, w) || !math.Signbit(w.F) {
+		t.Errorf("decoded %+v", w)
+	}
+
+	for _, m := range []Mode{0, ExplicitZeros} {
+		buf.Reset()
+		e := NewEncoder(&buf)
+		e.SetMode(m)
+		if err := e.Encode(&Flat{}); err != nil {
+			t.Fatal(err)
+		}
+		if l := buf.Len(); m == 0 && l != 1 || m != 0 && l != 5+4 {
+			t.Errorf("encoded %x in mode %d", buf.Bytes(), m)
+		}
+		w := Flat{1, 2, 3}
+		d := NewDecoder(&buf)
+		d.SetMode(m)
+		if err := d.Decode(&w); err != nil || w != (Flat{}) {
+			t.Error("unexpected value", w, err)
+		}
+	}
+}
+
+// flag marshals to no data when set, which looks like a zero value.
+type flag struct{ set bool }
+
+func (f flag) MarshalBinary() ([]byte, error) {
+	if f.set {
+		return []byte{}, nil
+	}
+	return []byte{0}, nil
+}
+
+func (f *flag) UnmarshalBinary(b []byte) error {
+	f.set = len(b) == 0
+	return nil
+}
+
+func TestExplicitZeros(t *testing.T) {
+	v := []flag{{true}, {false}}
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetMode(ExplicitZeros)
+	if err := e.Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	var w []flag
+	d := NewDecoder(&buf)
+	if err := d.Decode(&w); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v, w) {
+		t.Error("decoded", w)
+	}
+	if d.Options().Mode&ExplicitZeros == 0 {
+		t.Error("mode not picked up from the header")
+	}
+}
+
+type Plain struct {
+	B    bool
+	I8   int8
+	I    int
+	U16  uint16
+	U    uintptr
+	F32  float32
+	F    float64
+	S    string
+	L    []string
+	Flat `enc:"flatten"`
+}
+
+type FastPlain Plain
+
+func init() {
+	RegisterFlags(reflect.TypeOf(FastPlain{}), FastFields)
+}
+
+func TestFastFields(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		v := randomValue(t, reflect.TypeOf(Plain{})).(*Plain)
+		var a, b bytes.Buffer
+		if err := Encode(&a, v); err != nil {
+			t.Fatal(err)
+		}
+		if err := Encode(&b, (*FastPlain)(v)); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(a.Bytes(), b.Bytes()) {
+			t.Fatalf("%x != %x", a.Bytes(), b.Bytes())
+		}
+		var w FastPlain
+		if err := Decode(&b, &w); err != nil {
+			t.Fatal(err)
+		}
+		if d := Diff(v, (*Plain)(&w)); d != nil {
+			t.Error(d)
+		}
+	}
+}
+
+func TestEncodeSlice(t *testing.T) {
+	in := []Flat{{1, 2, 3}, {4, 5, 6}}
+	var a, b bytes.Buffer
+	if err := EncodeSlice(&a, in); err != nil {
+		t.Fatal(err)
+	}
+	if err := Encode(&b, in); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Error("unexpected encoding", a.Bytes(), b.Bytes())
+	}
+	var out []Flat
+	if err := DecodeSlice(&a, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Error("unexpected result", out)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("no panic for a non-slice")
+			}
+		}()
+		EncodeSlice(&a, Flat{})
+	}()
+}
+
+func TestCompileType(t *testing.T) {
+	if _, err := CompileType(reflect.TypeOf(func() {})); err == nil {
+		t.Error("no error for an invalid type")
+	}
+	if _, err := CompileType(reflect.TypeOf(func() {})); err == nil {
+		t.Error("no error for an invalid type the second time")
+	}
+
+	m, err := CompileType(reflect.TypeOf(Flat{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var a, b bytes.Buffer
+	in := Flat{1, 2, 3}
+	if err := m.Encode(&a, reflect.ValueOf(in)); err != nil {
+		t.Fatal(err)
+	}
+	Encode(&b, in)
+	if !bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Error("unexpected encoding", a.Bytes(), b.Bytes())
+	}
+	var out Flat
+	if err := m.Decode(bytes.NewReader(a.Bytes()[:2]), reflect.ValueOf(&out).Elem()); !errors.As(err, new(EOFError)) {
+		t.Error("unexpected error for truncated input", err)
+	}
+	if err := m.Decode(&a, reflect.ValueOf(&out).Elem()); err != nil {
+		t.Fatal(err)
+	}
+	if out != in {
+		t.Error("unexpected result", out)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	var buf bytes.Buffer
+	in := make([]int, 100)
+	Encode(&buf, in)
+	data := buf.Bytes()
+
+	var calls []Progress
+	dec := NewDecoder(bytes.NewReader(data))
+	dec.SetProgress(func(p Progress) error {
+		calls = append(calls, p)
+		return nil
+	}, 30)
+	var out []int
+	if err := dec.Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 3 || calls[2].Elements != 90 || calls[2].Bytes < 90 {
+		t.Error("unexpected progress", calls)
+	}
+
+	stop := errors.New("stop")
+	dec = NewDecoder(bytes.NewReader(data))
+	dec.SetProgress(func(p Progress) error { return stop }, 10)
+	if err := dec.Decode(&out); err != stop {
+		t.Error("unexpected error", err)
+	}
+}
+
+type cancelTracer func()
+
+func (c cancelTracer) OnField(string, reflect.Type, int) {
+	c()
+}
+
+func TestCancel(t *testing.T) {
+	in := make([]int, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	e := NewEncoder(new(bytes.Buffer))
+	e.SetTracer(cancelTracer(cancel))
+	if err := e.EncodeContext(ctx, in); err != context.Canceled {
+		t.Error("expected", context.Canceled, "got", err)
+	}
+
+	var buf bytes.Buffer
+	Encode(&buf, in)
+	ctx, cancel = context.WithCancel(context.Background())
+	d := NewDecoder(&buf)
+	d.SetProgress(func(Progress) error {
+		cancel()
+		return nil
+	}, 10)
+	var out []int
+	if err := d.DecodeContext(ctx, &out); err != context.Canceled {
+		t.Error("expected", context.Canceled, "got", err)
+	}
+}
+
+type Point struct {
+	X, Y int
+	P    *int
+}
+
+func TestMapKeys(t *testing.T) {
+	x := 1
+	in := map[Point]string{{1, 2, nil}: "a", {2, 1, &x}: "b", {0, 0, nil}: "c", {-1, 3, &x}: "d"}
+	var a, b bytes.Buffer
+	for _, buf := range []*bytes.Buffer{&a, &b} {
+		e := NewEncoder(buf)
+		e.SetMode(Canonical | Refs)
+		if err := e.Encode(in); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Error("canonical encodings differ")
+	}
+	d := NewDecoder(&a)
+	d.SetMode(Canonical | Refs)
+	var out map[Point]string
+	if err := d.Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	var p *int
+	for k, v := range out {
+		if k.P != nil {
+			if p != nil && p != k.P || *k.P != 1 || v != "b" && v != "d" {
+				t.Error("unexpected entry", k, v)
+			}
+			p = k.P
+		}
+	}
+	if len(out) != len(in) || p == nil {
+		t.Error("unexpected result", out)
+	}
+
+	func() {
+		defer func() {
+			if err, ok := recover().(KeyError); !ok || err.Key != reflect.TypeOf(func() {}) {
+				t.Error("expected KeyError, got", err)
+			}
+		}()
+		Encode(new(bytes.Buffer), map[struct{ F *func() }]int{})
+	}()
+
+	Register([]int{})
+	Register([1]int{})
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetMode(Typed)
+	if err := e.Encode(map[interface{}]int{[1]int{1}: 2}); err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Replace(buf.Bytes(), []byte("[1]int"), []byte("[]int\x01"), 1)
+	data[1]--
+	var m map[interface{}]int
+	d = NewDecoder(bytes.NewReader(data))
+	d.SetMode(Typed)
+	if err := d.Decode(&m); !errors.As(err, new(KeyError)) {
+		t.Error("expected KeyError, got", err)
+	}
+}
+
+func TestLengthLeft(t *testing.T) {
+	// a length of 1<<28 elements in a few bytes of input fails right after it
+	b := []byte{0x80, 0x80, 0x80, 0x80, 0x01, 1, 2}
+	if err := Decode(bytes.NewReader(b), new([]bool)); err != (EOFError{5}) {
+		t.Error("unexpected error", err)
+	}
+	if err := Decode(bytes.NewReader(b), new(string)); err != (EOFError{5}) {
+		t.Error("unexpected error", err)
+	}
+	if err := Decode(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}), new([]int64)); !errors.Is(err, ErrCorrupt) {
+		t.Error("expected a length overflowing int, got", err)
+	}
+}
+
+func TestLengthUnknown(t *testing.T) {
+	// a length of 1<<39 bytes over a reader of unknown size
+	b := []byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x20}
+	if err := Decode(opaqueReader{bytes.NewReader(b)}, new([]byte)); err != (EOFError{int64(len(b))}) {
+		t.Error("unexpected error", err)
+	}
+	b = []byte{0x80, 0x80, 0x80, 0x80, 0x01, 1, 2}
+	if err := Decode(opaqueReader{bytes.NewReader(b)}, new([]int64)); err != (EOFError{int64(len(b))}) {
+		t.Error("unexpected error", err)
+	}
+	if err := Decode(opaqueReader{bytes.NewReader(b)}, new(chan int64)); err != (EOFError{int64(len(b))}) {
+		t.Error("unexpected error", err)
+	}
+	var buf bytes.Buffer
+	long := make([]int32, 100000)
+	for i := range long {
+		long[i] = int32(i)
+	}
+	Encode(&buf, long)
+	var got []int32
+	if err := Decode(opaqueReader{&buf}, &got); err != nil || !reflect.DeepEqual(got, long) {
+		t.Error("unexpected result", err)
+	}
+}
+
+type opaqueReader struct{ r io.Reader }
+
+func (o opaqueReader) Read(p []byte) (int, error) {
+	return o.r.Read(p)
+}
+
+func TestInputSize(t *testing.T) {
+	b := []byte{0x80, 0x80, 0x80, 0x80, 0x01, 1, 2}
+	if err := Decode(io.LimitReader(bytes.NewReader(b), 100), new([]bool)); err != (EOFError{5}) {
+		t.Error("unexpected error", err)
+	}
+	d := NewDecoder(opaqueReader{bytes.NewReader(b)})
+	d.SetInputSize(int64(len(b)))
+	if err := d.Decode(new([]bool)); err != (EOFError{5}) {
+		t.Error("unexpected error", err)
+	}
+
+	var buf bytes.Buffer
+	EncodeAll(&buf, []bool{true, false}, "ok")
+	d = NewDecoder(opaqueReader{&buf})
+	d.SetInputSize(int64(buf.Len()))
+	var s string
+	if err := d.Decode(new([]bool)); err != nil {
+		t.Error(err)
+	}
+	if err := d.Decode(&s); err != nil || s != "ok" {
+		t.Error("unexpected result", s, err)
+	}
+}
+
+type Named1 struct {
+	A int
+	B string
+	C []int
+	N *Named1
+}
+
+type Named2 struct {
+	C []int
+	D bool
+	A int
+	N *Named2
+}
+
+func TestNamedFields(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetVersion(Version1)
+	e.SetMode(NamedFields)
+	in := Named1{A: 1, B: "b", C: []int{2, 3}, N: &Named1{A: 4}}
+	if err := e.Encode(&in); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	var out Named2
+	if err := Decode(bytes.NewReader(data), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, Named2{C: []int{2, 3}, A: 1, N: &Named2{C: []int{}, A: 4}}) {
+		t.Errorf("unexpected result %+v", out)
+	}
+
+	d := NewDecoder(bytes.NewReader(data))
+	d.SetMode(Strict)
+	if err := d.Decode(new(Named2)); err != (FieldError{reflect.TypeOf(Named2{}), "B"}) {
+		t.Error("expected FieldError, got", err)
+	}
+
+	var some Named2
+	if err := DecodeFields(bytes.NewReader(data), &some, "A"); err != nil || !reflect.DeepEqual(some, Named2{A: 1}) {
+		t.Errorf("unexpected fields %+v %v", some, err)
+	}
+	d = NewDecoder(bytes.NewReader(data))
+	if err := d.Skip(reflect.TypeOf(Named2{})); err != nil {
+		t.Error(err)
+	}
+	if _, err := d.Skip(reflect.TypeOf(0)), d.Skip(reflect.TypeOf(0)); err != io.EOF {
+		t.Error("expected the end of the stream, got", err)
+	}
+
+	var js bytes.Buffer
+	if err := ToJSON(bytes.NewReader(data), reflect.TypeOf(Named2{}), &js); err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"C":[2,3],"A":1,"N":{"C":[],"A":4,"N":null}}`; strings.TrimSpace(js.String()) != want {
+		t.Error("unexpected JSON", js.String())
+	}
+
+	d = NewDecoder(bytes.NewReader(data))
+	d.SetTokenType(reflect.TypeOf(Named2{}))
+	var toks []Token
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		toks = append(toks, tok)
+	}
+	if len(toks) != 23 || toks[0] != (Begin{reflect.Struct, 4}) || toks[1] != "A" || toks[3] != "B" || !bytes.Equal(toks[4].([]byte), []byte{1, 'b'}) {
+		t.Errorf("unexpected tokens %#v", toks)
+	}
+}
+
+type Aliased struct{ P *int }
+
+type Aliasing struct {
+	X    Aliased
+	Y, Z *int
+	W    *int
+}
+
+func TestNamedFieldsRefs(t *testing.T) {
+	p, q := new(int), new(int)
+	*p, *q = 1, 2
+	in := Aliasing{Aliased{p}, q, p, q}
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetMode(Refs | NamedFields)
+	if err := e.Encode(&in); err != nil {
+		t.Fatal(err)
+	}
+	var out Aliasing
+	d := NewDecoder(&buf)
+	d.SetMode(Refs | NamedFields)
+	if err := d.Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.X.P != out.Z || out.Y != out.W || out.X.P == out.Y || *out.Z != 1 || *out.W != 2 {
+		t.Errorf("aliasing lost: %v %v %v %v", *out.X.P, *out.Y, *out.Z, *out.W)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	var old, migrated bytes.Buffer
+	if err := EncodeAll(&old, &Named1{A: 1, B: "b"}, &Named1{A: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(&old, &migrated, reflect.TypeOf(Named1{}), 0, NamedFields); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDecoder(&migrated)
+	d.SetMode(NamedFields | Lenient)
+	var a, b Named2
+	if err := d.Decode(&a); err != nil || a.A != 1 {
+		t.Error("unexpected result", a, err)
+	}
+	if err := d.Decode(&b); err != nil || b.A != 2 {
+		t.Error("unexpected result", b, err)
+	}
+}
+
+type Login struct {
+	User     string
+	Password string `enc:"redact"`
+	Token    []byte `enc:"redact,omitempty"`
+}
+
+func TestRedact(t *testing.T) {
+	in := Login{"user", "secret", []byte{1, 2}}
+	var plain, redacted bytes.Buffer
+	Encode(&plain, &in)
+	e := NewEncoder(&redacted)
+	e.SetMode(Redact)
+	if err := e.Encode(&in); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(redacted.Bytes(), []byte("secret")) || redacted.Len() >= plain.Len() {
+		t.Errorf("secrets encoded: %q", redacted.Bytes())
+	}
+	var out Login
+	if err := Decode(&redacted, &out); err != nil || !reflect.DeepEqual(out, Login{User: "user"}) {
+		t.Errorf("unexpected result %+v %v", out, err)
+	}
+	if err := Decode(&plain, &out); err != nil || !reflect.DeepEqual(in, out) {
+		t.Errorf("unexpected result %+v %v", out, err)
+	}
+}
+
+type Defaults struct {
+	A int
+	B string
+	C []int
+}
+
+func (d *Defaults) SetDefaults() {
+	d.B = "default"
+	d.C = []int{1}
+}
+
+func TestDefaults(t *testing.T) {
+	for _, mode := range []Mode{0, NamedFields} {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf)
+		e.SetMode(mode)
+		if err := e.Encode(&struct{ A int }{7}); err != nil {
+			t.Fatal(err)
+		}
+		b := buf.Bytes()
+		for i := 0; i < 2; i++ {
+			out := Defaults{B: "stale", C: []int{2}}
+			d := NewDecoder(bytes.NewReader(b))
+			d.SetMode(mode | Lenient)
+			if err := d.Decode(&out); err != nil || !reflect.DeepEqual(out, Defaults{7, "default", []int{1}}) {
+				t.Errorf("%v: unexpected result %+v %v", mode, out, err)
+			}
+			out.C[0] = 3
+		}
+	}
+}
+
+type Checked struct {
+	N     int
+	Inner *CheckedInner
+}
+
+type CheckedInner struct{ N int }
+
+var errInvalid = errors.New("invalid")
+
+var validated []string
+
+func (c *Checked) ValidateDecode() error {
+	validated = append(validated, "outer")
+	if c.Inner != nil && c.N < c.Inner.N {
+		return errInvalid
+	}
+	return nil
+}
+
+func (c *CheckedInner) ValidateDecode() error {
+	validated = append(validated, "inner")
+	if c.N < 0 {
+		return errInvalid
+	}
+	return nil
+}
+
+func TestValidator(t *testing.T) {
+	for _, c := range []struct {
+		in   Checked
+		err  error
+		want []string
+	}{
+		{Checked{2, &CheckedInner{1}}, nil, []string{"inner", "outer"}},
+		{Checked{}, nil, []string{"outer"}},
+		{Checked{1, &CheckedInner{2}}, errInvalid, []string{"inner", "outer"}},
+		{Checked{1, &CheckedInner{-1}}, errInvalid, []string{"inner"}},
+	} {
+		var buf bytes.Buffer
+		Encode(&buf, &c.in)
+		validated = nil
+		var out Checked
+		if err := Decode(&buf, &out); !errors.Is(err, c.err) || !reflect.DeepEqual(validated, c.want) {
+			t.Errorf("%+v: unexpected result %v %v", c.in, validated, err)
+		}
+	}
+}
+
+type Sorted struct{ L []int }
+
+func (s *Sorted) PrepareEncode() error {
+	if s.L == nil {
+		return errInvalid
+	}
+	sort.Ints(s.L)
+	return nil
+}
+
+func TestPreparer(t *testing.T) {
+	in := []Sorted{{[]int{3, 1, 2}}, {[]int{}}}
+	var buf bytes.Buffer
+	if err := Encode(&buf, &in); err != nil {
+		t.Fatal(err)
+	}
+	var out []Sorted
+	if err := Decode(&buf, &out); err != nil || !reflect.DeepEqual(in, out) || !sort.IntsAreSorted(in[0].L) {
+		t.Errorf("unexpected result %+v %+v %v", in, out, err)
+	}
+	if err := Encode(&buf, Sorted{[]int{2, 1}}); err != nil {
+		t.Error(err)
+	}
+	if err := Encode(&buf, &Sorted{}); !errors.Is(err, errInvalid) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestPointerChain(t *testing.T) {
+	f := &Flat{1, 2, 3}
+	pf := &f
+	type chain struct {
+		P   ***Flat
+		Q   **Flat
+		A   *[4]byte
+		Nil **Flat
+		Mid **Flat
+	}
+	in := chain{P: &pf, Q: pf, A: &[4]byte{1, 2, 3, 4}, Mid: new(*Flat)}
+	for _, mode := range []Mode{0, PreserveNil, Refs} {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf)
+		e.SetMode(mode)
+		if err := e.Encode(&in); err != nil {
+			t.Fatal(err)
+		}
+		var out chain
+		d := NewDecoder(&buf)
+		d.SetMode(mode)
+		if err := d.Decode(&out); err != nil {
+			t.Fatalf("%v: %v", mode, err)
+		}
+		want := in
+		if mode == 0 {
+			want.Mid = nil
+		}
+		if !reflect.DeepEqual(out, want) {
+			t.Errorf("%v: unexpected result %+v", mode, out)
+		}
+		if mode == Refs && *out.P != out.Q {
+			t.Error("reference lost")
+		}
+	}
+}
+
+func TestNoMarshalers(t *testing.T) {
+	type stamped struct {
+		Flat
+		T time.Time
+	}
+	var buf bytes.Buffer
+	o := Options{Flags: NoMarshalers | UnixNano}
+	if err := NewEncoderOptions(&buf, o).Encode(&stamped{Flat{1, 2, 3}, time.Unix(1, 0)}); err != nil {
+		t.Error(err)
+	}
+	defer func() {
+		if e, ok := recover().(TypeError); !ok || e.T != timeType {
+			t.Errorf("marshaler used with NoMarshalers: %v", e)
+		}
+	}()
+	NewEncoderOptions(&buf, Options{Flags: NoMarshalers}).Encode(&stamped{})
+}
+
+// Versioned marshals only A.
+type Versioned struct{ A, B int }
+
+func (v Versioned) MarshalBinary() ([]byte, error) {
+	return []byte{byte(v.A)}, nil
+}
+
+func (v *Versioned) UnmarshalBinary(b []byte) error {
+	*v = Versioned{A: int(b[0])}
+	return nil
+}
+
+type Preferred struct{ Versioned }
+
+type Pinned struct {
+	Versioned
+	C int
+}
+
+func init() {
+	RegisterFlags(reflect.TypeOf(Preferred{}), Marshalers)
+	RegisterFlags(reflect.TypeOf(Pinned{}), NoMarshalers)
+}
+
+func TestMarshalers(t *testing.T) {
+	v := Versioned{1, 2}
+	for _, c := range []struct {
+		in   interface{}
+		o    Options
+		want interface{}
+	}{
+		{&v, Options{}, &v},
+		{&v, Options{Flags: Marshalers}, &Versioned{A: 1}},
+		{&Preferred{v}, Options{}, &Preferred{Versioned{A: 1}}},
+		{&Pinned{v, 3}, Options{Flags: Marshalers}, &Pinned{Versioned{A: 1}, 3}},
+	} {
+		var buf bytes.Buffer
+		if err := NewEncoderOptions(&buf, c.o).Encode(c.in); err != nil {
+			t.Fatal(err)
+		}
+		out := reflect.New(reflect.TypeOf(c.in).Elem()).Interface()
+		if err := NewDecoderOptions(&buf, c.o).Decode(out); err != nil || !reflect.DeepEqual(out, c.want) {
+			t.Errorf("%+v: unexpected result %+v %v", c.in, out, err)
+		}
+	}
+}
+
+type Article struct {
+	Title CompressedString
+	Body  CompressedString
+	Data  CompressedBytes
+}
+
+func TestCompressed(t *testing.T) {
+	body := strings.Repeat("all work and no play makes jack a dull boy\n", 100)
+	in := Article{"short", CompressedString(body), CompressedBytes(body)}
+	var buf bytes.Buffer
+	if err := Encode(&buf, &in); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() > len(body)/4 || !bytes.Contains(buf.Bytes(), []byte("short")) {
+		t.Errorf("encoded %d bytes", buf.Len())
+	}
+	b := buf.Bytes()
+	if err := Describe(reflect.TypeOf(in)).Validate(b); err != nil {
+		t.Error(err)
+	}
+	var out Article
+	if err := Decode(bytes.NewReader(b), &out); err != nil || !reflect.DeepEqual(in, out) {
+		t.Errorf("unexpected result %.20q %v", out.Body, err)
+	}
+	if d := Diff(&in, &out); d != nil {
+		t.Error(d)
+	}
+	var j bytes.Buffer
+	if err := ToJSON(bytes.NewReader(b), reflect.TypeOf(in), &j); err != nil || !bytes.Contains(j.Bytes(), []byte(`"Title":"short"`)) {
+		t.Errorf("unexpected JSON %.50s %v", j.Bytes(), err)
+	}
+
+	// a compressed body claiming a larger length
+	bad := append([]byte(nil), b...)
+	bad[9]++
+	if err := Decode(bytes.NewReader(bad), &out); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	// a hostile length fails before anything is allocated for it
+	var cb CompressedBytes
+	hostile := []byte{1, 0x80, 0x80, 0x80, 0x80, 0x40, 0}
+	dec := NewDecoder(bytes.NewReader(hostile))
+	dec.SetMaxMessageBytes(5)
+	if err := dec.Decode(&cb); err != ErrTooLarge {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := Decode(bytes.NewReader(hostile), &cb); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("unexpected error %v", err)
+	}
+	hostile = []byte{1, 0x80, 0x80, 0x80, 0x80, 0x40, 4, 0, 0, 0, 0}
+	if err := Decode(bytes.NewReader(hostile), &cb); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+// opaqueWriter hides the WriteByte and WriteString methods of w.
+type opaqueWriter struct{ w io.Writer }
+
+func (o opaqueWriter) Write(p []byte) (int, error) {
+	return o.w.Write(p)
+}
+
+func TestPooledWriter(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(opaqueWriter{&buf})
+	for i := 0; i < 3; i++ {
+		if err := e.Encode(&Flat{i, i, i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var want bytes.Buffer
+	EncodeAll(&want, &Flat{0, 0, 0}, &Flat{1, 1, 1}, &Flat{2, 2, 2})
+	if !bytes.Equal(buf.Bytes(), want.Bytes()) {
+		t.Errorf("%x != %x", buf.Bytes(), want.Bytes())
+	}
+	if e.buf.b != nil {
+		t.Error("buffer kept after encoding")
+	}
+
+	// errors are not overwritten by flushing
+	e.SetSealer(MACSealer(sha256.New, nil))
+	if err := e.Encode(1); err != errSealer {
+		t.Errorf("unexpected error %v", err)
+	}
+	// buffers are reused
+	n := testing.AllocsPerRun(10, func() { Encode(&buf, 1) })
+	if m := testing.AllocsPerRun(10, func() { Encode(opaqueWriter{&buf}, 1) }); m > n+2 {
+		t.Errorf("%v allocations, %v without buffering", m, n)
+	}
+}
+
+func TestTypedDefaults(t *testing.T) {
+	in := map[string]interface{}{
+		"name":    "config",
+		"enabled": true,
+		"port":    uint16(8080),
+		"ratio":   0.5,
+		"raw":     []byte{1, 2},
+		"servers": []interface{}{"a", int64(-1), map[string]interface{}{"nested": []interface{}{}}},
+		"none":    nil,
+	}
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetMode(Typed)
+	if err := e.Encode(&in); err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]interface{}
+	d := NewDecoder(&buf)
+	d.SetMode(Typed)
+	if err := d.Decode(&out); err != nil || !reflect.DeepEqual(in, out) {
+		t.Errorf("unexpected result %v %v", out, err)
+	}
+}
+
+func TestMapStream(t *testing.T) {
+	in := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		in[fmt.Sprint(i)] = i
+	}
+	for _, mode := range []Mode{0, PreserveNil} {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf)
+		e.SetMode(mode)
+		i := 0
+		err := e.EncodeMapStream(len(in), func() (interface{}, interface{}, bool) {
+			i++
+			return fmt.Sprint(i - 1), i - 1, true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out map[string]int
+		d := NewDecoder(bytes.NewReader(buf.Bytes()))
+		d.SetMode(mode)
+		if err := d.Decode(&out); err != nil || !reflect.DeepEqual(in, out) {
+			t.Errorf("%v: unexpected result %v %v", mode, out, err)
+		}
+
+		buf.Reset()
+		e.Encode(&in)
+		out = make(map[string]int)
+		var k string
+		var v int
+		d = NewDecoder(&buf)
+		d.SetMode(mode)
+		if err := d.DecodeMapStream(&k, &v, func() error { out[k] = v; return nil }); err != nil || !reflect.DeepEqual(in, out) {
+			t.Errorf("%v: unexpected result %v %v", mode, out, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	err := NewEncoder(&buf).EncodeMapStream(2, func() (interface{}, interface{}, bool) { return nil, nil, false })
+	if err != errMapStream {
+		t.Error("expected", errMapStream, "got", err)
+	}
+	buf.Reset()
+	Encode(&buf, &map[int]int{1: 1, 2: 2})
+	var k, v int
+	errStop := errors.New("stop")
+	if err := NewDecoder(&buf).DecodeMapStream(&k, &v, func() error { return errStop }); err != errStop {
+		t.Error("expected", errStop, "got", err)
+	}
+}
+
+type Bounded struct {
+	Level  int     `enc:"min=1,max=10"`
+	Weight float64 `enc:"max=0.5"`
+	Port   uint16  `enc:"min=1024"`
+}
+
+func TestBounds(t *testing.T) {
+	for _, c := range []struct {
+		in   interface{}
+		name string
+	}{
+		{&Bounded{1, 0.5, 1024}, ""},
+		{&Bounded{10, -1, 65535}, ""},
+		{&Bounded{11, 0, 2000}, "Level"},
+		{&Bounded{5, 0.75, 2000}, "Weight"},
+		{&Bounded{5, 0, 80}, "Port"},
+		{&Bounded{}, "Level"},
+	} {
+		var buf bytes.Buffer
+		Encode(&buf, c.in)
+		var out Bounded
+		err := Decode(&buf, &out)
+		if r, ok := err.(RangeError); c.name == "" && err != nil || c.name != "" && (!ok || r.Name != c.name || r.T != reflect.TypeOf(out)) {
+			t.Errorf("%+v: unexpected error %v", c.in, err)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("bounds on a string")
+		}
+	}()
+	Encode(new(bytes.Buffer), &struct {
+		S string `enc:"min=1"`
+	}{})
+}
+
+func TestClone(t *testing.T) {
+	var stats Stats
+	enc := NewEncoderOptions(nil, Options{Mode: NamedFields | Framed, Stats: &stats})
+	dec := NewDecoderOptions(nil, Options{Mode: NamedFields | Framed, Stats: &stats})
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var buf bytes.Buffer
+			enc := enc.Clone(&buf)
+			dec := dec.Clone(&buf)
+			for j := 0; j < 100; j++ {
+				in := Bounded{Level: i + 1, Port: uint16(1024 + j)}
+				var out Bounded
+				if err := enc.Encode(&in); err != nil {
+					errs <- err
+					return
+				}
+				if err := dec.Decode(&out); err != nil || out != in {
+					errs <- fmt.Errorf("%+v != %+v: %v", out, in, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if s := stats.Total(); s.Encoded != 800 || s.Decoded != 800 {
+		t.Errorf("stats %+v", s)
+	}
+}
+
+// A stalling reader or writer blocks its first call until released.
+type stalling struct {
+	once             sync.Once
+	started, release chan struct{}
+}
+
+func (s *stalling) stall() {
+	s.once.Do(func() {
+		close(s.started)
+		<-s.release
+	})
+}
+
+func (s *stalling) Write(p []byte) (int, error) {
+	s.stall()
+	return len(p), nil
+}
+
+func (s *stalling) Read(p []byte) (int, error) {
+	s.stall()
+	p[0] = 2
+	return 1, nil
+}
+
+func TestConcurrentUse(t *testing.T) {
+	expectPanic := func(f func() error) {
+		defer func() {
+			if recover() == nil {
+				t.Error("no panic on concurrent use")
+			}
+		}()
+		f()
+	}
+
+	s := &stalling{started: make(chan struct{}), release: make(chan struct{})}
+	enc := NewEncoder(s)
+	done := make(chan error)
+	go func() { done <- enc.Encode(1) }()
+	<-s.started
+	expectPanic(func() error { return enc.Encode(2) })
+	close(s.release)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	if err := enc.Encode(3); err != nil {
+		t.Error(err)
+	}
+
+	s = &stalling{started: make(chan struct{}), release: make(chan struct{})}
+	dec := NewDecoder(s)
+	var a, b int
+	go func() { done <- dec.Decode(&a) }()
+	<-s.started
+	expectPanic(func() error { return dec.Decode(&b) })
+	close(s.release)
+	if err := <-done; err != nil || a != 1 {
+		t.Error(a, err)
+	}
+}
+
+func TestChunkFunc(t *testing.T) {
+	var calls []int64
+	stop := errors.New("stop")
+	enc := NewEncoder(new(bytes.Buffer))
+	enc.SetChunkFunc(func(n int64) error {
+		calls = append(calls, n)
+		if len(calls) == 3 {
+			return stop
+		}
+		return nil
+	}, 100)
+
+	if err := enc.Encode(make([]uint16, 40)); err != nil || len(calls) != 0 {
+		t.Fatal(calls, err)
+	}
+	if err := enc.Encode(make([]int32, 200)); err != nil || !reflect.DeepEqual(calls, []int64{100, 200}) {
+		t.Fatal(calls, err)
+	}
+	calls = calls[:0]
+	if err := enc.Encode(make([][]byte, 500)); err != stop || len(calls) != 3 || calls[2] != 300 {
+		t.Error(calls, err)
+	}
+}
+
+// Appended is encoded through AppendBinary, and Marshaled through MarshalBinary.
+type Appended struct{ n uint32 }
+
+func (a *Appended) AppendBinary(b []byte) ([]byte, error) {
+	return binary.BigEndian.AppendUint32(b, a.n), nil
+}
+
+func (a *Appended) MarshalBinary() ([]byte, error) {
+	return nil, errors.New("MarshalBinary called")
+}
+
+func (a *Appended) UnmarshalBinary(b []byte) error {
+	a.n = binary.BigEndian.Uint32(b)
+	return nil
+}
+
+type Marshaled struct{ n uint32 }
+
+func (m *Marshaled) MarshalBinary() ([]byte, error) {
+	return binary.BigEndian.AppendUint32(nil, m.n), nil
+}
+
+func (m *Marshaled) UnmarshalBinary(b []byte) error {
+	m.n = binary.BigEndian.Uint32(b)
+	return nil
+}
+
+func TestBinaryAppender(t *testing.T) {
+	in := []Appended{{1}, {0}, {1 << 31}}
+	var out []Appended
+	testEquals(t, &in, &out)
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	a, m := Appended{7}, Marshaled{7}
+	appended := testing.AllocsPerRun(100, func() {
+		buf.Reset()
+		enc.Encode(&a)
+	})
+	marshaled := testing.AllocsPerRun(100, func() {
+		buf.Reset()
+		enc.Encode(&m)
+	})
+	if appended >= marshaled {
+		t.Errorf("%v allocations with AppendBinary, %v with MarshalBinary", appended, marshaled)
+	}
+
+	// shards encoded in parallel have scratch buffers of their own
+	many := make([]Appended, 1000)
+	for i := range many {
+		many[i] = Appended{uint32(i)}
+	}
+	var want bytes.Buffer
+	Encode(&want, many)
+	buf.Reset()
+	enc.SetParallelism(4, 16)
+	if err := enc.Encode(many); err != nil || !bytes.Equal(buf.Bytes(), want.Bytes()) {
+		t.Error("parallel encoding differs", err)
+	}
+	if cap(enc.scratch) == 0 {
+		t.Error("scratch buffer not handed back")
+	}
+}
+
+func TestEncodeMax(t *testing.T) {
+	v := make([]byte, 100)
+	var buf bytes.Buffer
+	if err := EncodeMax(&buf, v, 101); err != nil || buf.Len() != 101 {
+		t.Fatal(buf.Len(), err)
+	}
+	buf.Reset()
+	if err := EncodeMax(&buf, v, 100); err != ErrTooLarge || buf.Len() != 0 {
+		t.Fatal(buf.Len(), err)
+	}
+
+	enc := NewEncoder(&buf)
+	enc.SetMaxMessageBytes(1 << 10)
+	if err := enc.Encode(make([]string, 1<<20)); err != ErrTooLarge {
+		t.Error(err)
+	}
+
+	enc.SetMode(Framed)
+	enc.SetMaxMessageBytes(50)
+	if err := enc.Encode(v[:40]); err != nil {
+		t.Error(err)
+	}
+	if err := enc.Encode(v[:45]); err != ErrTooLarge {
+		t.Error(err)
+	}
+}
+
+// A queue is a Writer and a Reader over a byte slice.
+type queue struct {
+	b []byte
+	r int
+}
+
+func (q *queue) Write(p []byte) (int, error) {
+	q.b = append(q.b, p...)
+	return len(p), nil
+}
+
+func (q *queue) WriteByte(c byte) error {
+	q.b = append(q.b, c)
+	return nil
+}
+
+func (q *queue) WriteString(s string) (int, error) {
+	q.b = append(q.b, s...)
+	return len(s), nil
+}
+
+func (q *queue) Read(p []byte) (int, error) {
+	if q.r == len(q.b) {
+		return 0, io.EOF
+	}
+	n := copy(p, q.b[q.r:])
+	q.r += n
+	return n, nil
+}
+
+func (q *queue) ReadByte() (byte, error) {
+	if q.r == len(q.b) {
+		return 0, io.EOF
+	}
+	q.r++
+	return q.b[q.r-1], nil
+}
+
+func (q *queue) UnreadByte() error {
+	q.r--
+	return nil
+}
+
+var (
+	_ Writer = (*queue)(nil)
+	_ Reader = (*queue)(nil)
+)
+
+func TestWriterReader(t *testing.T) {
+	q := new(queue)
+	enc := NewEncoder(q)
+	if err := enc.Encode("first"); err != nil || len(q.b) != 6 {
+		t.Fatal("output buffered", q.b, err)
+	}
+	enc.Encode(uint16(300))
+
+	dec := NewDecoder(q)
+	var s string
+	if err := dec.Decode(&s); err != nil || s != "first" || q.r != 6 {
+		t.Fatal("input read ahead", s, q.r, err)
+	}
+	var u uint16
+	if err := dec.Decode(&u); err != nil || u != 300 || q.r != len(q.b) {
+		t.Error(u, q.r, err)
+	}
+}
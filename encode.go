@@ -6,20 +6,127 @@ package enc
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/binary"
 	"io"
+	"math"
+	"math/bits"
 	"reflect"
+	"time"
 )
 
-// Encode marshals a value and writes it to w.
+// Encode marshals v, or the value it points to if v is a pointer, and writes it to w.
+// As v is an interface, values of interface types are encoded as the value
+// they hold; to encode one as an interface, pass a pointer to it, and decode
+// into a pointer to an interface alike. Encoding nil or a nil pointer fails.
 // It panics if the value is of an invalid type.
 func Encode(w io.Writer, v interface{}) error {
-	return EncodeValue(w, reflect.ValueOf(v))
+	return NewEncoder(w).EncodeValue(reflect.ValueOf(v))
 }
 
 // EncodeValue marshals a reflection value and writes it to w.
+// Unless v can be set, a pointer is followed to the value it points to.
 // It panics if the value is of an invalid type.
-func EncodeValue(w io.Writer, v reflect.Value) (err error) {
+func EncodeValue(w io.Writer, v reflect.Value) error {
+	return NewEncoder(w).EncodeValue(v)
+}
+
+// EncodeContext is like Encode, but gives up waiting on channels
+// and encoding further struct fields, elements and map values
+// once ctx is done and returns ctx.Err().
+func EncodeContext(ctx context.Context, w io.Writer, v interface{}) error {
+	return NewEncoder(w).EncodeContext(ctx, v)
+}
+
+// EncodeAll marshals several values and writes them to w back to back.
+// It panics if a value is of an invalid type.
+func EncodeAll(w io.Writer, vs ...interface{}) error {
+	enc := NewEncoder(w)
+	for _, v := range vs {
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// An Encoder writes values to an output stream.
+// It must not be used by several goroutines at once, which panics
+// when detected; use a Clone per goroutine instead.
+type Encoder struct {
+	w        Writer
+	buf      *pooledWriter
+	o        Options
+	header   bool // the stream started, with a header or without
+	frame    bytes.Buffer
+	count    *countWriter
+	tees     []*bufio.Writer
+	sealed   []byte
+	guard    guard
+	deadline writeDeadliner
+	scratch  []byte
+	offset   int64 // of the next frame, see Sealer
+}
+
+// NewEncoder returns a new Encoder writing to w.
+// Unless w is a Writer, output is buffered
+// and flushed after every value, in buffers shared between Encoders.
+func NewEncoder(w io.Writer) *Encoder {
+	enc := new(Encoder)
+	if bw, ok := w.(Writer); ok {
+		enc.w = bw
+	} else {
+		enc.buf = &pooledWriter{w: w}
+		enc.w = enc.buf
+	}
+	enc.deadline, _ = w.(writeDeadliner)
+	return enc
+}
+
+// SetMode sets the modes used for subsequent values.
+func (enc *Encoder) SetMode(m Mode) {
+	enc.o.Mode = m
+}
+
+// SetVersion sets the wire format version of the stream.
+// Unless it is 0, the stream starts with a header declaring the version
+// and the modes changing the wire format, which the Decoder picks up.
+// It must be called before the first value is encoded.
+func (enc *Encoder) SetVersion(v Version) {
+	enc.o.Version = v
+}
+
+// Encode marshals v, or the value it points to if v is a pointer,
+// and writes it to the stream, see the Encode function.
+// It panics if the value is of an invalid type.
+func (enc *Encoder) Encode(v interface{}) error {
+	return enc.encode(nil, reflect.ValueOf(v), false)
+}
+
+// EncodeValue marshals a reflection value and writes it to the stream.
+// It panics if the value is of an invalid type.
+func (enc *Encoder) EncodeValue(v reflect.Value) error {
+	return enc.encode(nil, v, false)
+}
+
+// EncodeContext is like Encode, but gives up waiting on channels
+// and encoding further struct fields, elements and map values
+// once ctx is done and returns ctx.Err().
+func (enc *Encoder) EncodeContext(ctx context.Context, v interface{}) error {
+	return enc.encode(ctx, reflect.ValueOf(v), false)
+}
+
+// encode writes v, or the elements of the slice v as a batch.
+func (enc *Encoder) encode(ctx context.Context, v reflect.Value, batch bool) (err error) {
+	if !v.CanSet() {
+		v = reflect.Indirect(v)
+	}
+	if !v.IsValid() {
+		return errEncodeNil
+	}
+	enc.guard.enter("Encoder")
+	defer enc.guard.exit()
 	defer func() {
 		switch p := recover(); p := p.(type) {
 		case nil:
@@ -30,25 +137,169 @@ func EncodeValue(w io.Writer, v reflect.Value) (err error) {
 		}
 	}()
 
-	var e encoder
-	if w, ok := w.(writer); ok {
-		e.w = w
-	} else {
-		tmp := bufio.NewWriter(w)
-		defer func() { err = tmp.Flush() }()
-		w = tmp
+	if enc.o.WriteTimeout > 0 && enc.deadline != nil {
+		enc.setDeadline(time.Now().Add(enc.o.WriteTimeout))
+		defer enc.setDeadline(time.Time{})
+	}
+	if enc.o.Stats != nil && enc.count == nil {
+		enc.count = &countWriter{Writer: enc.w}
+		enc.w = enc.count
+	}
+	if enc.o.Chunk != nil && enc.o.ChunkSize > 0 {
+		w := enc.w
+		enc.w = &chunkWriter{Writer: w, f: enc.o.Chunk, every: enc.o.ChunkSize, at: enc.o.ChunkSize}
+		defer func() { enc.w = w }()
+	}
+	if enc.o.MaxMessageBytes > 0 {
+		w := enc.w
+		enc.w = &limitWriter{Writer: w, left: enc.o.MaxMessageBytes}
+		defer func() { enc.w = w }()
+	}
+	e := encoder{
+		w:         enc.w,
+		mode:      enc.o.Mode.implied(),
+		version:   enc.o.Version,
+		types:     cache(enc.o.Flags),
+		parallel:  enc.o.Parallelism,
+		threshold: enc.o.Threshold,
+		scratch:   enc.scratch,
+	}
+	if ctx != nil && ctx.Done() != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		e.ctx = ctx
+	}
+	if enc.tees != nil {
+		defer func() {
+			if ferr := enc.flushTees(); err == nil {
+				err = ferr
+			}
+		}()
+	}
+	if enc.buf != nil {
+		defer func() {
+			if ferr := enc.buf.Flush(); err == nil {
+				err = ferr
+			}
+		}()
 	}
 
-	if !v.CanSet() {
-		v = reflect.Indirect(v)
+	var start int64
+	if enc.count != nil {
+		start = enc.count.n
+	}
+	if enc.o.Sealer != nil && e.mode&Framed == 0 {
+		return errSealer
+	}
+	if (e.version != 0 || e.mode&ExplicitZeros != 0) && !enc.header {
+		if e.version == 0 {
+			e.version = Version1
+		}
+		e.writeHeader()
+		enc.header = true
+	}
+	if !enc.header {
+		if e.mode&Framed != 0 {
+			// frames start with syncMarker
+			enc.header = true
+		} else {
+			w := &leadWriter{Writer: e.w, e: &e, enc: enc}
+			e.w = w
+			defer w.finish()
+		}
+	}
+	if e.mode&Framed != 0 {
+		enc.frame.Reset()
+		e.w = &enc.frame
+	}
+	get := e.types.get
+	if batch {
+		get = e.types.batch
+	}
+	if enc.o.Tracer != nil {
+		w := &countWriter{Writer: e.w}
+		_, fold := enc.o.Tracer.(*measurer)
+		e.w, e.trace = w, &tracer{t: enc.o.Tracer, pos: func() int64 { return w.n }, fold: fold}
+		e.trace.run("", v.Type(), func() { get(v.Type()).encode(&e, v) })
+		e.w = w.Writer
+	} else {
+		get(v.Type()).encode(&e, v)
+	}
+	if cap(e.scratch) <= maxScratch {
+		enc.scratch = e.scratch[:0]
+	}
+	if e.mode&Framed != 0 {
+		e.writeFrame(enc)
+	}
+	if enc.o.Stats != nil {
+		enc.o.Stats.add(v.Type(), true, enc.count.n-start)
 	}
-	types.get(v.Type()).encode(&e, v)
 	return
 }
 
 type encoder struct {
-	w   writer
-	buf [binary.MaxVarintLen64]byte
+	w       Writer
+	mode    Mode
+	version Version
+	ctx     context.Context
+	types   *_types
+	trace   *tracer
+	refs    map[ref]uint64
+	buf     [binary.MaxVarintLen64]byte
+
+	// scratch is reused for the output of marshalers, see marshalerMachine
+	scratch []byte
+
+	parallel, threshold int
+}
+
+// maxScratch is the largest scratch buffer kept between values.
+const maxScratch = 64 << 10
+
+type ref struct {
+	p uintptr
+	t reflect.Type
+}
+
+// ref writes the reference tag of the non-nil pointer v
+// and reports whether its target has yet to be encoded.
+func (e *encoder) ref(v reflect.Value) bool {
+	k := ref{v.Pointer(), v.Type()}
+	if id, ok := e.refs[k]; ok {
+		e.encodeUint(id + 2)
+		return false
+	}
+	if e.refs == nil {
+		e.refs = make(map[ref]uint64)
+	}
+	e.refs[k] = uint64(len(e.refs))
+	e.writeByte(1)
+	return true
+}
+
+// recv receives from c, giving up once e.ctx is done.
+func (e *encoder) recv(c reflect.Value) (reflect.Value, bool) {
+	if e.ctx == nil {
+		return c.Recv()
+	}
+	i, x, ok := reflect.Select([]reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(e.ctx.Done())},
+		{Dir: reflect.SelectRecv, Chan: c},
+	})
+	if i == 0 {
+		panic(noPanic{e.ctx.Err()})
+	}
+	return x, ok
+}
+
+// cancel fails once e.ctx is done.
+func (e *encoder) cancel() {
+	select {
+	case <-e.ctx.Done():
+		panic(noPanic{e.ctx.Err()})
+	default:
+	}
 }
 
 func (e *encoder) encodeInt(i int64) {
@@ -59,6 +310,40 @@ func (e *encoder) encodeUint(u uint64) {
 	e.write(e.buf[:binary.PutUvarint(e.buf[:], u)])
 }
 
+func (e *encoder) encodeFloat(f float64, f32 bool) {
+	if e.mode&FiniteFloats != 0 && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		panic(noPanic{errFinite})
+	}
+	if e.mode&NormalizeFloats != 0 {
+		switch {
+		case f != f:
+			f = math.NaN()
+		case f == 0:
+			f = 0
+		}
+	}
+	switch {
+	case e.version < Version2:
+		e.encodeUint(math.Float64bits(f))
+	case f32:
+		e.encodeUint(uint64(bits.ReverseBytes32(math.Float32bits(float32(f)))))
+	default:
+		e.encodeUint(bits.ReverseBytes64(math.Float64bits(f)))
+	}
+}
+
+// encodeLen writes the length of v, telling nil apart in PreserveNil mode.
+func (e *encoder) encodeLen(v reflect.Value) {
+	switch {
+	case e.mode&PreserveNil == 0:
+		e.encodeUint(uint64(v.Len()))
+	case v.IsNil():
+		e.writeByte(0)
+	default:
+		e.encodeUint(uint64(v.Len()) + 1)
+	}
+}
+
 func (e *encoder) write(b []byte) {
 	if _, err := e.w.Write(b); err != nil {
 		panic(noPanic{err})
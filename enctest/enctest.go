@@ -0,0 +1,75 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package enctest provides helpers to verify that types round-trip through enc.
+package enctest
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	"github.com/koneu/enc"
+)
+
+// RoundTrip encodes v in mode m, decodes the result into a new value of the
+// same type and reports every difference in what gets encoded to t.
+// It returns the decoded value.
+func RoundTrip(t testing.TB, v interface{}, m enc.Mode) interface{} {
+	t.Helper()
+	typ := reflect.TypeOf(v)
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	var buf bytes.Buffer
+	e := enc.NewEncoder(&buf)
+	e.SetMode(m)
+	if err := e.Encode(v); err != nil {
+		t.Error(err)
+		return nil
+	}
+	w := reflect.New(typ).Interface()
+	d := enc.NewDecoder(&buf)
+	d.SetMode(m)
+	if err := d.Decode(w); err != nil {
+		t.Error(err)
+		return w
+	}
+	for _, f := range enc.Diff(v, w) {
+		t.Errorf("%s: %v after a round trip", typ, f)
+	}
+	return w
+}
+
+// Random returns a pointer to a random value of type typ, created by testing/quick.
+// Types holding values quick cannot generate, like interfaces, must implement quick.Generator.
+func Random(t testing.TB, typ reflect.Type, r *rand.Rand) interface{} {
+	t.Helper()
+	v, ok := quick.Value(typ, r)
+	if !ok {
+		t.Fatalf("cannot create a random %s", typ)
+	}
+	p := reflect.New(typ)
+	p.Elem().Set(v)
+	return p.Interface()
+}
+
+// Check round-trips random values of type typ in mode m with quick.Check.
+func Check(t *testing.T, typ reflect.Type, m enc.Mode, c *quick.Config) {
+	t.Helper()
+	f := reflect.MakeFunc(reflect.FuncOf([]reflect.Type{typ}, []reflect.Type{reflect.TypeOf(true)}, false),
+		func(args []reflect.Value) []reflect.Value {
+			p := reflect.New(typ)
+			p.Elem().Set(args[0])
+			failed := t.Failed()
+			RoundTrip(t, p.Interface(), m)
+			return []reflect.Value{reflect.ValueOf(failed || !t.Failed())}
+		})
+	if err := quick.Check(f.Interface(), c); err != nil {
+		t.Error(err)
+	}
+}
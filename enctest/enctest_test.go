@@ -0,0 +1,75 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enctest
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/koneu/enc"
+)
+
+type Message struct {
+	ID      uint64
+	Tags    map[string][]int
+	Payload []byte
+	Sent    time.Time
+	Next    *Message
+}
+
+func TestRoundTrip(t *testing.T) {
+	RoundTrip(t, &Message{ID: 1, Sent: time.Unix(1, 2)}, enc.PreserveNil)
+}
+
+func TestRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	m := Random(t, reflect.TypeOf(map[string][4]int16{}), r).(*map[string][4]int16)
+	RoundTrip(t, m, 0)
+}
+
+func TestCheck(t *testing.T) {
+	Check(t, reflect.TypeOf(Message{}.Tags), enc.Canonical, nil)
+}
+
+type Generated struct {
+	Message
+	Nested map[string]map[int8][]string
+	Queue  chan Message
+	Recv   <-chan [2]float32
+	Any    interface{}
+}
+
+func TestGenerate(t *testing.T) {
+	typ := reflect.TypeOf(Generated{})
+	a, b := Generate(typ, 1).Interface().(Generated), Generate(typ, 1).Interface().(Generated)
+	if !reflect.DeepEqual(a.Message, b.Message) || !reflect.DeepEqual(a.Nested, b.Nested) || len(a.Queue) != len(b.Queue) {
+		t.Error("different values generated from the same seed")
+	}
+	if len(a.Nested) == 0 || len(a.Queue) == 0 || len(a.Recv) == 0 {
+		t.Errorf("values left empty: %+v", a)
+	}
+	for seed := int64(0); seed < 20; seed++ {
+		v := Generate(typ, seed).Interface().(Generated)
+		RoundTrip(t, &v.Message, 0)
+		RoundTrip(t, &v.Nested, 0)
+		var buf bytes.Buffer
+		if err := enc.Encode(&buf, &v); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGolden(t *testing.T) {
+	Golden(t, "message", &Message{
+		ID:      42,
+		Tags:    map[string][]int{"a": {1, 2}},
+		Payload: []byte("payload"),
+		Sent:    time.Unix(1e9, 5).UTC(),
+		Next:    &Message{ID: 43},
+	})
+}
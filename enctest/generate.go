@@ -0,0 +1,118 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enctest
+
+import (
+	"math/rand"
+	"reflect"
+	"testing/quick"
+	"time"
+)
+
+// maxLen and maxDepth bound the size of generated values.
+const (
+	maxLen   = 8
+	maxDepth = 4
+)
+
+var (
+	generatorType = reflect.TypeOf(new(quick.Generator)).Elem()
+	timeType      = reflect.TypeOf(time.Time{})
+)
+
+// Generate returns a random value of type t, the same for every seed.
+// Unlike testing/quick, it nests maps, creates times and fills channels,
+// which it closes so that they can be encoded.
+// Types implementing quick.Generator generate themselves.
+// Slices and maps are empty rather than nil, and channels nil rather than
+// empty, so that values round-trip in every mode. Interfaces, functions and
+// unexported struct fields are left zero. Slices and maps nested too deep
+// in recursive types are empty, and pointers nil.
+func Generate(t reflect.Type, seed int64) reflect.Value {
+	v := reflect.New(t).Elem()
+	generate(rand.New(rand.NewSource(seed)), v, 0)
+	return v
+}
+
+// generate sets the settable v to a random value.
+func generate(r *rand.Rand, v reflect.Value, depth int) {
+	t := v.Type()
+	if t.Implements(generatorType) {
+		v.Set(v.Interface().(quick.Generator).Generate(r, maxLen))
+		return
+	}
+	if t == timeType {
+		v.Set(reflect.ValueOf(time.Unix(r.Int63n(1<<40), r.Int63n(1e9)).UTC()))
+		return
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		v.SetBool(r.Intn(2) == 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(int64(r.Uint64()) >> r.Intn(64))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		v.SetUint(r.Uint64() >> r.Intn(64))
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(r.NormFloat64() * float64(r.Intn(1000)))
+	case reflect.Complex64, reflect.Complex128:
+		v.SetComplex(complex(r.NormFloat64(), r.NormFloat64()))
+	case reflect.String:
+		b := make([]rune, r.Intn(maxLen))
+		for i := range b {
+			b[i] = rune(r.Intn(0xd800))
+		}
+		v.SetString(string(b))
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			generate(r, v.Index(i), depth)
+		}
+	case reflect.Slice:
+		l := r.Intn(maxLen)
+		if depth >= maxDepth {
+			l = 0
+		}
+		v.Set(reflect.MakeSlice(t, l, l))
+		for i := 0; i < l; i++ {
+			generate(r, v.Index(i), depth+1)
+		}
+	case reflect.Map:
+		l := r.Intn(maxLen)
+		if depth >= maxDepth {
+			l = 0
+		}
+		v.Set(reflect.MakeMap(t))
+		for i := 0; i < l; i++ {
+			k, e := reflect.New(t.Key()).Elem(), reflect.New(t.Elem()).Elem()
+			generate(r, k, depth+1)
+			generate(r, e, depth+1)
+			v.SetMapIndex(k, e)
+		}
+	case reflect.Chan:
+		l := r.Intn(maxLen)
+		if l == 0 || depth >= maxDepth {
+			return
+		}
+		c := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, t.Elem()), l)
+		for i := 0; i < l; i++ {
+			e := reflect.New(t.Elem()).Elem()
+			generate(r, e, depth+1)
+			c.Send(e)
+		}
+		c.Close()
+		v.Set(c.Convert(t))
+	case reflect.Ptr:
+		if depth >= maxDepth {
+			return
+		}
+		v.Set(reflect.New(t.Elem()))
+		generate(r, v.Elem(), depth+1)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if t.Field(i).IsExported() {
+				generate(r, v.Field(i), depth)
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enctest
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/koneu/enc"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of enctest.Golden")
+
+// Golden checks that v encodes to the bytes in testdata/name.golden
+// and decodes from them, so that changes to the wire format of a type,
+// like reordered fields, fail tests rather than go unnoticed.
+// With -update, it writes the file instead; packages using Golden
+// must not define a flag of that name themselves.
+// v must be a pointer for its type to be decoded into.
+func Golden(t *testing.T, name string, v interface{}) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := enc.Encode(&buf, v); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.Bytes()
+
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = os.WriteFile(path, got, 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		t.Fatalf("%s is missing, run the test with -update to create it", path)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	typ := reflect.TypeOf(v)
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("encoding of %s differs from %s:\n%s\nwant\n%s", typ, path, dump(got, typ), dump(want, typ))
+	}
+	w := reflect.New(typ)
+	if err := enc.Decode(bytes.NewReader(want), w.Interface()); err != nil {
+		t.Errorf("decoding %s: %v", path, err)
+		return
+	}
+	buf.Reset()
+	if err := enc.Encode(&buf, w.Interface()); err != nil || !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("%s does not decode to a %s encoding to it: %v", path, typ, err)
+	}
+}
+
+// dump describes b in hex and as values of type t.
+func dump(b []byte, t reflect.Type) string {
+	var s strings.Builder
+	fmt.Fprintf(&s, "%x\n", b)
+	if err := enc.Dump(bytes.NewReader(b), t, &s); err != nil {
+		s.WriteString(err.Error() + "\n")
+	}
+	return s.String()
+}
@@ -0,0 +1,89 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+const maxEnum = 256
+
+var enums = struct {
+	sync.RWMutex
+	m map[reflect.Type]*enumMachine
+}{m: make(map[reflect.Type]*enumMachine)}
+
+var errEnum = CorruptError{Reason: "invalid enum index"}
+
+// RegisterEnum makes the values of the slice values the only valid values
+// of their element type, an integer or string type, such as the keys of a
+// config map. Each encodes as a single byte, its index in values, and other
+// values fail to encode and decode. values holds at most 256 distinct values.
+// It panics if values of the type have already been encoded or decoded,
+// so it is best called from an init function.
+func RegisterEnum(values interface{}) {
+	v := reflect.ValueOf(values)
+	if v.Kind() != reflect.Slice || v.Len() == 0 || v.Len() > maxEnum {
+		panic("enc: RegisterEnum needs a slice of 1 to 256 values")
+	}
+	t := v.Type().Elem()
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.String:
+	default:
+		panic("enc: RegisterEnum of " + t.String())
+	}
+	m := &enumMachine{t, v, make(map[interface{}]byte, v.Len())}
+	for i := 0; i < v.Len(); i++ {
+		x := v.Index(i).Interface()
+		if _, ok := m.index[x]; ok {
+			panic(fmt.Sprintf("enc: RegisterEnum of %s with %v twice", t, x))
+		}
+		m.index[x] = byte(i)
+	}
+
+	enums.Lock()
+	defer enums.Unlock()
+	if used(t) {
+		panic("enc: RegisterEnum called after first use of " + t.String())
+	}
+	enums.m[t] = m
+}
+
+func enumOf(t reflect.Type) *enumMachine {
+	enums.RLock()
+	defer enums.RUnlock()
+	return enums.m[t]
+}
+
+// enumMachine encodes the values of a registered enum as their index.
+type enumMachine struct {
+	t      reflect.Type
+	values reflect.Value
+	index  map[interface{}]byte
+}
+
+func (m *enumMachine) encode(e *encoder, v reflect.Value) {
+	i, ok := m.index[v.Interface()]
+	if !ok {
+		panic(noPanic{fmt.Errorf("enc: %v is not a registered value of %s", v, m.t)})
+	}
+	e.writeByte(i)
+}
+
+func (m *enumMachine) decode(d *decoder, v reflect.Value) {
+	v.Set(m.value(d))
+}
+
+// value reads an index and returns the value it stands for.
+func (m *enumMachine) value(d *decoder) reflect.Value {
+	i := int(d.readByte())
+	if i >= m.values.Len() {
+		panic(noPanic{errEnum})
+	}
+	return m.values.Index(i)
+}
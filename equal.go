@@ -0,0 +1,238 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"bytes"
+	"encoding"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// A FieldDiff describes a difference between two values.
+type FieldDiff struct {
+	// Path locates the difference, like .Field[2]["key"].
+	Path string
+	// A and B hold the differing values, or nil where one is missing.
+	A, B interface{}
+}
+
+func (f FieldDiff) String() string {
+	return fmt.Sprintf("%s: %v != %v", f.Path, f.A, f.B)
+}
+
+// Equal reports whether a and b are deeply equal in everything that gets encoded.
+// Fields that are not encoded are ignored and channels are compared by identity.
+// It panics if the values are of an invalid type.
+func Equal(a, b interface{}) bool {
+	var c comparer
+	c.compare(a, b)
+	return len(c.diffs) == 0
+}
+
+// Diff returns the differences between a and b, like Equal finds them.
+// It panics if the values are of an invalid type.
+func Diff(a, b interface{}) []FieldDiff {
+	c := comparer{all: true}
+	c.compare(a, b)
+	return c.diffs
+}
+
+type comparer struct {
+	all     bool
+	diffs   []FieldDiff
+	visited map[visit]bool
+}
+
+type visit struct {
+	a, b uintptr
+	t    reflect.Type
+}
+
+func (c *comparer) compare(a, b interface{}) {
+	va, vb := reflect.Indirect(reflect.ValueOf(a)), reflect.Indirect(reflect.ValueOf(b))
+	if !va.IsValid() || !vb.IsValid() || va.Type() != vb.Type() {
+		if va.IsValid() || vb.IsValid() {
+			c.diff("", va, vb)
+		}
+		return
+	}
+	c.walk(types.get(va.Type()), "", va, vb)
+}
+
+func (c *comparer) diff(path string, a, b reflect.Value) {
+	d := FieldDiff{Path: path}
+	if a.IsValid() {
+		d.A = a.Interface()
+	}
+	if b.IsValid() {
+		d.B = b.Interface()
+	}
+	c.diffs = append(c.diffs, d)
+}
+
+func (c *comparer) walk(m machine, path string, a, b reflect.Value) {
+	if !c.all && len(c.diffs) != 0 {
+		return
+	}
+
+	switch m := m.(type) {
+	case *recurseMachine:
+		c.walk(m.get(), path, a, b)
+	case *compareMachine:
+		c.walk(m.m, path, a, b)
+	case boolMachine:
+		if a.Bool() != b.Bool() {
+			c.diff(path, a, b)
+		}
+	case intMachine:
+		if a.Int() != b.Int() {
+			c.diff(path, a, b)
+		}
+	case uintMachine:
+		if a.Uint() != b.Uint() {
+			c.diff(path, a, b)
+		}
+	case floatMachine:
+		if x, y := a.Float(), b.Float(); x != y && (x == x || y == y) {
+			c.diff(path, a, b)
+		}
+	case *enumMachine:
+		if a.Interface() != b.Interface() {
+			c.diff(path, a, b)
+		}
+	case unixNanoMachine:
+		if !a.Interface().(time.Time).Equal(b.Interface().(time.Time)) {
+			c.diff(path, a, b)
+		}
+	case complexMachine:
+		if x, y := a.Complex(), b.Complex(); x != y && (x == x || y == y) {
+			c.diff(path, a, b)
+		}
+	case netMachine:
+		if m.t.Kind() == reflect.Slice && !bytes.Equal(a.Bytes(), b.Bytes()) ||
+			m.t.Kind() != reflect.Slice && a.Interface() != b.Interface() {
+			c.diff(path, a, b)
+		}
+	case compressedMachine:
+		if !bytes.Equal(m.bytes(a), m.bytes(b)) {
+			c.diff(path, a, b)
+		}
+	case *optionMachine:
+		switch x, y := a.Field(1).Bool(), b.Field(1).Bool(); {
+		case x != y:
+			c.diff(path, a, b)
+		case x:
+			c.walk(m.m, path, a.Field(0), b.Field(0))
+		}
+	case *arrayMachine:
+		for i := 0; i < m.l; i++ {
+			c.walk(m.m, fmt.Sprintf("%s[%d]", path, i), a.Index(i), b.Index(i))
+		}
+	case *chanMachine:
+		if a.Pointer() != b.Pointer() {
+			c.diff(path, a, b)
+		}
+	case *interfaceMachine:
+		switch {
+		case a.IsNil() && b.IsNil():
+		case a.IsNil() || b.IsNil() || a.Elem().Type() != b.Elem().Type():
+			c.diff(path, a, b)
+		default:
+			c.walk(types.get(a.Elem().Type()), path, a.Elem(), b.Elem())
+		}
+	case *mapMachine:
+		if a.IsNil() != b.IsNil() {
+			c.diff(path, a, b)
+			return
+		}
+		for _, k := range a.MapKeys() {
+			p := fmt.Sprintf("%s[%#v]", path, k)
+			if y := b.MapIndex(k); y.IsValid() {
+				c.walk(m.v, p, a.MapIndex(k), y)
+			} else {
+				c.diff(p, a.MapIndex(k), y)
+			}
+		}
+		for _, k := range b.MapKeys() {
+			if x := a.MapIndex(k); !x.IsValid() {
+				c.diff(fmt.Sprintf("%s[%#v]", path, k), x, b.MapIndex(k))
+			}
+		}
+	case *ptrMachine:
+		switch {
+		case a.Pointer() == b.Pointer():
+		case a.IsNil() || b.IsNil():
+			c.diff(path, a, b)
+		default:
+			k := visit{a.Pointer(), b.Pointer(), a.Type()}
+			if c.visited[k] {
+				return
+			}
+			if c.visited == nil {
+				c.visited = make(map[visit]bool)
+			}
+			c.visited[k] = true
+			c.walk(m.m, path, a.Elem(), b.Elem())
+		}
+	case *rleMachine:
+		c.walk(&sliceMachine{m.t, m.m}, path, a, b)
+	case *sliceMachine:
+		switch {
+		case a.IsNil() != b.IsNil() || a.Len() != b.Len():
+			c.diff(path, a, b)
+		case a.Pointer() != b.Pointer():
+			for i, l := 0, a.Len(); i < l; i++ {
+				c.walk(m.m, fmt.Sprintf("%s[%d]", path, i), a.Index(i), b.Index(i))
+			}
+		}
+	case stringMachine:
+		if a.String() != b.String() {
+			c.diff(path, a, b)
+		}
+	case bytesMachine:
+		if a.IsNil() != b.IsNil() || !bytes.Equal(a.Bytes(), b.Bytes()) {
+			c.diff(path, a, b)
+		}
+	case streamedMachine, sinkMachine:
+		if a.Interface() != b.Interface() {
+			c.diff(path, a, b)
+		}
+	case *structMachine:
+		a, b = m.addressable(a), m.addressable(b)
+		for i := range m.fields {
+			f := &m.fields[i]
+			c.walk(f.m, path+"."+f.name, f.value(a), f.value(b))
+		}
+	case unsupportedMachine:
+	case *marshalerMachine:
+		x, err := marshal(m, a)
+		y, err2 := marshal(m, b)
+		if err != nil || err2 != nil || !bytes.Equal(x, y) {
+			c.diff(path, a, b)
+		}
+	case *codecMachine:
+		x, err := m.c.Append(nil, a)
+		y, err2 := m.c.Append(nil, b)
+		if err != nil || err2 != nil || !bytes.Equal(x, y) {
+			c.diff(path, a, b)
+		}
+	default:
+		panic("enc: unknown machine")
+	}
+}
+
+func marshal(m *marshalerMachine, v reflect.Value) ([]byte, error) {
+	if m.e {
+		if !v.CanAddr() {
+			c := reflect.New(v.Type()).Elem()
+			c.Set(v)
+			v = c
+		}
+		v = v.Addr()
+	}
+	return v.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+}
@@ -0,0 +1,123 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// An offset locates a struct field of a basic type in memory.
+// Its kind is Invalid for other fields.
+type offset struct {
+	off  uintptr
+	kind reflect.Kind
+}
+
+// compile sets the offsets of the fields of m for FastFields.
+func (m *structMachine) compile() {
+	m.offsets = make([]offset, len(m.fields))
+	for i := range m.fields {
+		f := &m.fields[i]
+		if f.redact {
+			continue
+		}
+		switch f.m.(type) {
+		case boolMachine, intMachine, uintMachine, floatMachine, stringMachine:
+		default:
+			continue
+		}
+		t := m.t
+		for _, j := range f.index {
+			sf := t.Field(j)
+			m.offsets[i].off += sf.Offset
+			t = sf.Type
+		}
+		m.offsets[i].kind = t.Kind()
+	}
+}
+
+// fast reports whether the fields of v can be accessed through their offsets.
+func (m *structMachine) fast(v reflect.Value, trace *tracer) bool {
+	return m.offsets != nil && trace == nil && v.CanAddr()
+}
+
+func (o offset) encode(e *encoder, p unsafe.Pointer) {
+	p = unsafe.Add(p, o.off)
+	switch o.kind {
+	case reflect.Bool:
+		if *(*bool)(p) {
+			e.writeByte(1)
+		} else {
+			e.writeByte(0)
+		}
+	case reflect.Int:
+		e.encodeInt(int64(*(*int)(p)))
+	case reflect.Int8:
+		e.encodeInt(int64(*(*int8)(p)))
+	case reflect.Int16:
+		e.encodeInt(int64(*(*int16)(p)))
+	case reflect.Int32:
+		e.encodeInt(int64(*(*int32)(p)))
+	case reflect.Int64:
+		e.encodeInt(*(*int64)(p))
+	case reflect.Uint:
+		e.encodeUint(uint64(*(*uint)(p)))
+	case reflect.Uint8:
+		e.encodeUint(uint64(*(*uint8)(p)))
+	case reflect.Uint16:
+		e.encodeUint(uint64(*(*uint16)(p)))
+	case reflect.Uint32:
+		e.encodeUint(uint64(*(*uint32)(p)))
+	case reflect.Uint64:
+		e.encodeUint(*(*uint64)(p))
+	case reflect.Uintptr:
+		e.encodeUint(uint64(*(*uintptr)(p)))
+	case reflect.Float32:
+		e.encodeFloat(float64(*(*float32)(p)), true)
+	case reflect.Float64:
+		e.encodeFloat(*(*float64)(p), false)
+	case reflect.String:
+		s := *(*string)(p)
+		e.encodeUint(uint64(len(s)))
+		e.writeString(s)
+	}
+}
+
+func (o offset) decode(d *decoder, p unsafe.Pointer) {
+	p = unsafe.Add(p, o.off)
+	switch o.kind {
+	case reflect.Bool:
+		*(*bool)(p) = d.readByte() == 1
+	case reflect.Int:
+		*(*int)(p) = int(d.decodeInt())
+	case reflect.Int8:
+		*(*int8)(p) = int8(d.decodeInt())
+	case reflect.Int16:
+		*(*int16)(p) = int16(d.decodeInt())
+	case reflect.Int32:
+		*(*int32)(p) = int32(d.decodeInt())
+	case reflect.Int64:
+		*(*int64)(p) = d.decodeInt()
+	case reflect.Uint:
+		*(*uint)(p) = uint(d.decodeUint())
+	case reflect.Uint8:
+		*(*uint8)(p) = uint8(d.decodeUint())
+	case reflect.Uint16:
+		*(*uint16)(p) = uint16(d.decodeUint())
+	case reflect.Uint32:
+		*(*uint32)(p) = uint32(d.decodeUint())
+	case reflect.Uint64:
+		*(*uint64)(p) = d.decodeUint()
+	case reflect.Uintptr:
+		*(*uintptr)(p) = uintptr(d.decodeUint())
+	case reflect.Float32:
+		*(*float32)(p) = float32(d.decodeFloat(true))
+	case reflect.Float64:
+		*(*float64)(p) = d.decodeFloat(false)
+	case reflect.String:
+		*(*string)(p) = string(d.read(d.decodeUint()))
+	}
+}
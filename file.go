@@ -0,0 +1,96 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// WriteFile encodes v into the file at path, creating it with permissions perm
+// if necessary. The value is written as a single frame with a header
+// in the latest version, see Framed. The file is replaced atomically by
+// writing to a temporary file in the same directory and renaming it,
+// so that readers see either the old or the new contents.
+// It panics if the value is of an invalid type.
+func WriteFile(path string, v interface{}, perm os.FileMode) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	enc := NewEncoder(w)
+	enc.SetVersion(LatestVersion)
+	enc.SetMode(Framed)
+	if err = enc.Encode(v); err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = f.Chmod(perm); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir flushes the directory at path to disk, so that
+// a file renamed into it is still there after a crash.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// ReadFile decodes the value written by WriteFile to the file at path into v.
+// Data corrupted on disk fails with a CorruptError.
+// It panics if the value is of an invalid type.
+func ReadFile(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := NewDecoder(bufio.NewReader(f))
+	dec.SetMode(Framed)
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	off := dec.in.n
+	if _, err := dec.r.ReadByte(); err != io.EOF {
+		if err == nil {
+			e := errTrailing
+			e.Offset = off
+			return e
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// syncMarker starts every frame.
+var syncMarker = [4]byte{0xfe, 0x6e, 0x63, 0xc4}
+
+// writeFrame writes the value buffered in enc.frame to enc.w as a frame.
+func (e *encoder) writeFrame(enc *Encoder) {
+	e.w = enc.w
+	b := enc.frame.Bytes()
+	if s := enc.o.Sealer; s != nil {
+		var err error
+		if enc.sealed, err = s.Seal(enc.sealed[:0], b, enc.offset); err != nil {
+			panic(noPanic{err})
+		}
+		b = enc.sealed
+	}
+	n := len(syncMarker) + binary.PutUvarint(e.buf[:], uint64(len(b))) + len(b) + 4
+	e.write(syncMarker[:])
+	e.encodeUint(uint64(len(b)))
+	e.write(b)
+	binary.BigEndian.PutUint32(e.buf[:], crc32.ChecksumIEEE(b))
+	e.write(e.buf[:4])
+	enc.offset += int64(n)
+}
+
+// A deadliner can time out reads, like a net.Conn.
+type deadliner interface {
+	SetReadDeadline(time.Time) error
+}
+
+// SetReadTimeout makes the Decoder give up reading a frame in Framed mode
+// d after it started, if the reader it was created with has a SetReadDeadline
+// method like net.Conn. As whole frames are read before they are decoded,
+// a peer stalling mid-value makes decoding fail with the timeout error of
+// the reader, after which Resync finds the next frame. Waiting for a frame
+// to start does not time out. If d is 0, reads never time out.
+func (dec *Decoder) SetReadTimeout(d time.Duration) {
+	dec.o.ReadTimeout = d
+}
+
+func (dec *Decoder) setDeadline(t time.Time) {
+	if err := dec.deadline.SetReadDeadline(t); err != nil {
+		panic(noPanic{err})
+	}
+}
+
+// readFrame reads the next frame into dec.frame.
+// The read timeout starts once the frame does.
+func (dec *Decoder) readFrame() {
+	d := decoder{r: dec.r, left: dec.left}
+	var s [len(syncMarker)]byte
+	offset := dec.in.n - dec.base
+	if dec.synced {
+		offset -= int64(len(syncMarker))
+	} else {
+		s[0] = d.readByte()
+	}
+	if dec.o.ReadTimeout > 0 && dec.deadline != nil {
+		dec.setDeadline(time.Now().Add(dec.o.ReadTimeout))
+		defer dec.setDeadline(time.Time{})
+	}
+	if dec.synced {
+		dec.synced = false
+	} else {
+		if _, err := io.ReadFull(d.r, s[1:]); err != nil {
+			panic(noPanic{err})
+		}
+		if s != syncMarker {
+			panic(noPanic{errFrame})
+		}
+	}
+
+	l := d.decodeUint()
+	d.checkAlloc(l, 1)
+	if n := dec.o.MaxMessageBytes; n > 0 && l > uint64(n) {
+		panic(noPanic{ErrTooLarge})
+	}
+	var b []byte
+	if uint64(cap(dec.buf)) < l+4 && l+4 > maxPrealloc && d.lim == nil && d.left == nil {
+		// the frame may be shorter than it claims, it grows as it arrives
+		b = d.readGrowing(l + 4)
+		dec.buf = b
+	} else {
+		if uint64(cap(dec.buf)) < l+4 {
+			dec.buf = make([]byte, l+4)
+		}
+		b = dec.buf[:l+4]
+		if _, err := io.ReadFull(d.r, b); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			panic(noPanic{err})
+		}
+	}
+	if crc32.ChecksumIEEE(b[:l]) != binary.BigEndian.Uint32(b[l:]) {
+		panic(noPanic{errFrame})
+	}
+	b = b[:l]
+	if s := dec.o.Sealer; s != nil {
+		var err error
+		if dec.opened, err = s.Open(dec.opened[:0], b, offset); err != nil {
+			panic(noPanic{CorruptError{Reason: "frame does not open: " + err.Error()}})
+		}
+		b = dec.opened
+	}
+	dec.frame.Reset(b)
+}
+
+// Resync skips ahead to the next frame in Framed mode, so that decoding can go on
+// after an error. Data that merely looks like the start of a frame may fool it,
+// in which case the next value fails to decode and Resync can be called again.
+func (dec *Decoder) Resync() error {
+	dec.frame.Reset(nil)
+	if dec.tok != nil {
+		dec.tok.stack = dec.tok.stack[:0]
+	}
+	var s [len(syncMarker)]byte
+	for {
+		b, err := dec.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		copy(s[:], s[1:])
+		s[len(s)-1] = b
+		if s == syncMarker {
+			dec.synced = true
+			return nil
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestResync(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetVersion(Version1)
+	e.SetMode(Framed)
+	var ends []int
+	for _, s := range []string{"a", "b", "c"} {
+		if err := e.Encode(s); err != nil {
+			t.Error(err)
+		}
+		ends = append(ends, buf.Len())
+	}
+	b := buf.Bytes()
+	b[ends[1]-5]++ // corrupt the payload of the second frame
+
+	d := NewDecoder(bytes.NewReader(b))
+	var s string
+	if err := d.Decode(&s); err != nil || s != "a" {
+		t.Error("unexpected value", s, err)
+	}
+	if err, ok := d.Decode(&s).(CorruptError); !ok || err.Reason != errFrame.Reason {
+		t.Error("expected", errFrame, "got", err)
+	}
+	if err := d.Resync(); err != nil {
+		t.Error(err)
+	}
+	if err := d.Decode(&s); err != nil || s != "c" {
+		t.Error("unexpected value", s, err)
+	}
+	if err := d.Decode(&s); err != io.EOF {
+		t.Error("expected", io.EOF, "got", err)
+	}
+}
+
+func TestSealer(t *testing.T) {
+	block, err := aes.NewCipher(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []Sealer{AEADSealer(gcm), MACSealer(sha256.New, []byte("key"))} {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf)
+		e.SetMode(Framed)
+		e.SetVersion(Version1)
+		e.SetSealer(s)
+		var ends []int
+		for _, v := range []string{"secret", "hidden"} {
+			if err := e.Encode(v); err != nil {
+				t.Fatal(err)
+			}
+			ends = append(ends, buf.Len())
+		}
+		b := buf.Bytes()
+
+		d := NewDecoder(bytes.NewReader(b))
+		d.SetMode(Framed)
+		d.SetSealer(s)
+		var v string
+		if err := d.Decode(&v); err != nil || v != "secret" {
+			t.Error("unexpected value", v, err)
+		}
+		if err := d.Decode(&v); err != nil || v != "hidden" {
+			t.Error("unexpected value", v, err)
+		}
+
+		// frames are bound to their offset in the stream, both of the same length here
+		start := 2*ends[0] - ends[1]
+		header, first, second := b[:start], b[start:ends[0]], b[ends[0]:]
+		for _, frames := range [][]byte{
+			append(append(append([]byte(nil), header...), second...), first...),
+			append(append(append([]byte(nil), header...), first...), first...),
+		} {
+			d = NewDecoder(bytes.NewReader(frames))
+			d.SetMode(Framed)
+			d.SetSealer(s)
+			d.Decode(&v)
+			if err := d.Decode(&v); !errors.Is(err, ErrCorrupt) {
+				t.Error("opened a frame out of place", v, err)
+			}
+		}
+
+		d = NewDecoder(bytes.NewReader(b))
+		d.SetMode(Framed)
+		d.SetSealer(MACSealer(sha256.New, []byte("other")))
+		if err := d.Decode(&v); !errors.Is(err, ErrCorrupt) {
+			t.Error("opened a frame sealed with another key", err)
+		}
+	}
+
+	var out bytes.Buffer
+	e := NewEncoder(&out)
+	e.SetVersion(Version1)
+	e.SetSealer(MACSealer(sha256.New, nil))
+	if err := e.Encode(1); err != errSealer || out.Len() != 0 {
+		t.Error("expected", errSealer, "got", err, out.Bytes())
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetMode(Framed)
+	e.Encode("stalled")
+	e.Encode("next")
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go func() {
+		a.Write(buf.Bytes()[:6])
+		time.Sleep(50 * time.Millisecond)
+		a.Write(buf.Bytes()[6:])
+	}()
+
+	d := NewDecoder(b)
+	d.SetMode(Framed)
+	d.SetReadTimeout(10 * time.Millisecond)
+	var s string
+	if err := d.Decode(&s); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("expected", os.ErrDeadlineExceeded, "got", err)
+	}
+	if err := d.Resync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Decode(&s); err != nil || s != "next" {
+		t.Error("unexpected value", s, err)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	var next bytes.Buffer
+	e := NewEncoder(&next)
+	e.SetMode(Framed)
+	e.Encode("next")
+
+	a, b := net.Pipe()
+	defer a.Close()
+	resume := make(chan struct{})
+	read := make(chan []byte)
+	go func() {
+		p := make([]byte, 6)
+		io.ReadFull(b, p)
+		<-resume
+		rest, _ := io.ReadAll(b)
+		read <- rest
+	}()
+
+	e = NewEncoder(a)
+	e.SetMode(Framed)
+	e.SetWriteTimeout(10 * time.Millisecond)
+	if err := e.Encode("stalled"); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("expected", os.ErrDeadlineExceeded, "got", err)
+	}
+	close(resume)
+	if err := e.Encode("next"); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+	if rest := <-read; !bytes.HasSuffix(rest, next.Bytes()) {
+		t.Errorf("%x does not end in %x", rest, next.Bytes())
+	}
+}
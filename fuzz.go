@@ -0,0 +1,56 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+)
+
+// fuzzModes are the modes FuzzDecode decodes in.
+var fuzzModes = []Mode{Lenient, Refs, PreserveNil, Typed, Strict}
+
+// FuzzDecode is meant to be called by fuzz targets. It decodes data into
+// a new value of each of types in several modes. Values that decode are
+// encoded and decoded once more, and it fails if that changes their encoding.
+// Decoding errors are expected and ignored, panics are bugs.
+func FuzzDecode(data []byte, types []reflect.Type) error {
+	for _, t := range types {
+		for _, m := range fuzzModes {
+			v := reflect.New(t)
+			d := NewDecoder(bytes.NewReader(data))
+			d.SetMode(m)
+			d.SetMaxMessageBytes(int64(len(data)))
+			if d.DecodeValue(v) != nil {
+				continue
+			}
+
+			a, err := fuzzEncode(v, m)
+			if err != nil {
+				continue
+			}
+			w := reflect.New(t)
+			d = NewDecoder(bytes.NewReader(a))
+			d.SetMode(m | Canonical)
+			if err := d.DecodeValue(w); err != nil {
+				return errors.New("enc: " + t.String() + " does not decode after encoding: " + err.Error())
+			}
+			b, err := fuzzEncode(w, m)
+			if err != nil || !bytes.Equal(a, b) {
+				return errors.New("enc: " + t.String() + " changes in a round trip")
+			}
+		}
+	}
+	return nil
+}
+
+func fuzzEncode(v reflect.Value, m Mode) ([]byte, error) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetMode(m | Canonical | SnapshotChans)
+	err := e.EncodeValue(v)
+	return buf.Bytes(), err
+}
@@ -0,0 +1,55 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+var fuzzTypes = []reflect.Type{
+	reflect.TypeOf(Test{}),
+	reflect.TypeOf(Nils{}),
+	reflect.TypeOf(Node{}),
+	reflect.TypeOf(Drawing{}),
+	reflect.TypeOf(Attachment{}),
+	reflect.TypeOf([]chan int{}),
+	reflect.TypeOf(map[[2]int8]*string{}),
+}
+
+func fuzzSeeds(tb testing.TB) []interface{} {
+	c := make(chan int, 2)
+	c <- 1
+	return []interface{}{
+		randomValue(tb, reflect.TypeOf(Test{})),
+		randomValue(tb, reflect.TypeOf(Node{})),
+		randomValue(tb, reflect.TypeOf(map[[2]int8]*string{})),
+		&Nils{SE: []int{1}, PE: new(int), C: c},
+		&Drawing{Shapes: []Shape{Square{2}}, Any: "a"},
+		&Attachment{"a", Streamed{bytes.NewReader([]byte("data")), 4}},
+		[]chan int{c},
+	}
+}
+
+func FuzzMachines(f *testing.F) {
+	for _, m := range fuzzModes {
+		for _, v := range fuzzSeeds(f) {
+			var buf bytes.Buffer
+			e := NewEncoder(&buf)
+			e.SetMode(m | SnapshotChans)
+			if err := e.Encode(v); err != nil {
+				f.Fatal(err)
+			}
+			f.Add(buf.Bytes())
+		}
+	}
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0x0f})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if err := FuzzDecode(data, fuzzTypes); err != nil {
+			t.Error(err)
+		}
+	})
+}
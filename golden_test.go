@@ -0,0 +1,140 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"bytes"
+	goflag "flag"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var update = goflag.Bool("update", false, "write missing golden files to testdata")
+
+// Golden holds a field for every machine with a fixed encoding.
+type Golden struct {
+	Bool bool
+	I    int
+	I8   int8
+	I16  int16
+	I32  int32
+	I64  int64
+	U    uint
+	U8   uint8
+	U16  uint16
+	U32  uint32
+	U64  uint64
+	Ptr  uintptr
+
+	F32  float32
+	F64  float64
+	C64  complex64
+	C128 complex128
+
+	S     string
+	Bytes []byte
+	Slice []int16
+	Array [3]uint
+	Map   map[string]int
+	P     *Flat
+	Nil   *Flat
+	Zero  Flat
+
+	Time time.Time
+	At   time.Time `enc:"unixnano"`
+	Opt  Option[int]
+	None Option[string]
+	Addr netip.Addr
+	Net  netip.Prefix
+	Lvl  Level
+	Bits []bool `enc:"rle"`
+	Raw  Raw
+}
+
+var golden = Golden{
+	Bool: true,
+	I:    -300, I8: -128, I16: 1 << 14, I32: -1 << 30, I64: 1<<62 + 1,
+	U: 300, U8: 255, U16: 1 << 15, U32: 1<<32 - 1, U64: 1<<64 - 1, Ptr: 0xdead,
+
+	F32: 1.5, F64: -0.1, C64: 2 + 3i, C128: -1i,
+
+	S: "golden", Bytes: []byte{0, 1, 2}, Slice: []int16{-1, 0, 1}, Array: [3]uint{1, 2, 3},
+	Map: map[string]int{"one": 1},
+	P:   &Flat{1, 2, 3},
+
+	Time: time.Date(2024, 2, 29, 12, 30, 0, 5, time.UTC),
+	At:   time.Date(1999, 12, 31, 23, 59, 59, 999, time.UTC),
+	Opt:  Some(7),
+	Addr: netip.MustParseAddr("fe80::1"),
+	Net:  netip.MustParsePrefix("10.0.0.0/8"),
+	Lvl:  10,
+	Bits: []bool{true, true, true, false, true},
+	Raw:  Raw{1, 2},
+}
+
+var goldenCases = []struct {
+	name    string
+	v       interface{}
+	mode    Mode
+	version Version
+}{
+	{"values", &golden, 0, 0},
+	{"version1", &golden, 0, Version1},
+	{"version2", &golden, 0, Version2},
+	{"canonical", &map[string]int{"a": 1, "b": 2, "c": 3, "d": 4}, Canonical, 0},
+	{"preservenil", &Nils{}, PreserveNil, Version1},
+	{"refs", &[]*Flat{golden.P, golden.P, nil}, Refs, Version1},
+	{"typed", &Drawing{Shapes: []Shape{Square{2}}, Any: "any"}, Typed, Version1},
+	{"framed", &golden, Framed, Version1},
+	{"zeros", &Flat{}, ExplicitZeros, 0},
+}
+
+// TestGolden checks that values encode to the fixtures in testdata/golden,
+// which must never change, and decode from them.
+// Run with -update to add fixtures for new cases.
+func TestGolden(t *testing.T) {
+	if WireVersion() != Version2 {
+		t.Error("the wire version changed, add fixtures for it")
+	}
+	for _, c := range goldenCases {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf)
+		e.SetMode(c.mode)
+		e.SetVersion(c.version)
+		if err := e.Encode(c.v); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+
+		path := filepath.Join("testdata", "golden", c.name+".bin")
+		want, err := os.ReadFile(path)
+		if os.IsNotExist(err) && *update {
+			if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+				err = os.WriteFile(path, buf.Bytes(), 0644)
+			}
+			want = buf.Bytes()
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("%s: encoding changed:\n%x\nwant\n%x", c.name, buf.Bytes(), want)
+		}
+
+		v := reflect.New(reflect.TypeOf(c.v).Elem())
+		d := NewDecoder(bytes.NewReader(want))
+		d.SetMode(c.mode)
+		if err := d.Decode(v.Interface()); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if !reflect.DeepEqual(v.Interface(), c.v) {
+			t.Errorf("%s: decoded %+v", c.name, v.Elem())
+		}
+	}
+}
@@ -0,0 +1,37 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"hash"
+	"io"
+)
+
+// Hash writes the canonical encoding of v to h and returns the resulting sum.
+// Channels are snapshotted rather than drained.
+// It panics if the value is of an invalid type.
+func Hash(v interface{}, h hash.Hash64) (uint64, error) {
+	enc := NewEncoder(&hashWriter{Hash64: h})
+	enc.SetMode(Canonical | SnapshotChans)
+	if err := enc.Encode(v); err != nil {
+		return 0, err
+	}
+	return h.Sum64(), nil
+}
+
+type hashWriter struct {
+	hash.Hash64
+	b [1]byte
+}
+
+func (w *hashWriter) WriteByte(c byte) error {
+	w.b[0] = c
+	_, err := w.Write(w.b[:])
+	return err
+}
+
+func (w *hashWriter) WriteString(s string) (int, error) {
+	return io.WriteString(w.Hash64, s)
+}
@@ -0,0 +1,71 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import "reflect"
+
+var (
+	defaulterType = reflect.TypeOf(new(Defaulter)).Elem()
+	validatorType = reflect.TypeOf(new(Validator)).Elem()
+	preparerType  = reflect.TypeOf(new(Preparer)).Elem()
+)
+
+// A Defaulter sets the fields of a struct to their default values.
+// Fields missing from the input when decoding a struct type whose
+// pointer implements Defaulter are set to their default values,
+// rather than left untouched. Defaults are set on a new value every time,
+// so they do not alias each other.
+type Defaulter interface {
+	SetDefaults()
+}
+
+// A Validator checks a decoded value.
+// After decoding a struct type whose pointer implements Validator,
+// ValidateDecode is called on it, and decoding fails with its error.
+// Nested structs are validated before the structs holding them.
+type Validator interface {
+	ValidateDecode() error
+}
+
+// A Preparer normalizes a value before it is encoded.
+// Before encoding a struct type whose pointer implements Preparer,
+// PrepareEncode is called on it, and encoding fails with its error.
+// Values that are not addressable are prepared and encoded as a copy.
+type Preparer interface {
+	PrepareEncode() error
+}
+
+// setDefaults sets the fields of v that are missing to their default values.
+func (m *structMachine) setDefaults(v reflect.Value, missing func(i int) bool) {
+	d := reflect.New(m.t)
+	d.Interface().(Defaulter).SetDefaults()
+	for i := range m.fields {
+		if missing(i) {
+			f := &m.fields[i]
+			f.value(v).Set(f.value(d.Elem()))
+		}
+	}
+}
+
+// validate calls ValidateDecode on the decoded struct v.
+func validate(v reflect.Value) {
+	if err := v.Addr().Interface().(Validator).ValidateDecode(); err != nil {
+		panic(noPanic{err})
+	}
+}
+
+// prepare calls PrepareEncode on the struct v, or an addressable copy of it,
+// and returns the value to encode.
+func prepare(v reflect.Value) reflect.Value {
+	if !v.CanAddr() {
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		v = c
+	}
+	if err := v.Addr().Interface().(Preparer).PrepareEncode(); err != nil {
+		panic(noPanic{err})
+	}
+	return v
+}
@@ -0,0 +1,485 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	jsonMarshalerType = reflect.TypeOf(new(json.Marshaler)).Elem()
+	textMarshalerType = reflect.TypeOf(new(encoding.TextMarshaler)).Elem()
+)
+
+// ToJSON reads a value of type t from r and writes it to w as JSON,
+// laid out like encoding/json marshals values of type t: the fields of
+// embedded structs are promoted, fields tagged `json:"-"` are left out,
+// and the omitempty and string options of json tags apply.
+// Values of types implementing encoding.BinaryMarshaler, json.Marshaler or
+// encoding.TextMarshaler are decoded and handed to encoding/json.
+// Channels and complex numbers become JSON arrays.
+// It panics if t is an invalid type.
+func ToJSON(r io.Reader, t reflect.Type, w io.Writer) error {
+	m := types.get(t)
+	bw := bufio.NewWriter(w)
+	err := lenient(r).run(nil, func(d *decoder) {
+		toJSON(d, m, bw)
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// FromJSON reads a JSON value from r as encoding/json unmarshals values of type t,
+// and writes its encoding to w. Struct fields tagged `json:"-"` are not read
+// and encoded as their zero value.
+// It panics if t is an invalid type.
+func FromJSON(r io.Reader, t reflect.Type, w io.Writer) error {
+	v := reflect.New(t)
+	if err := json.NewDecoder(r).Decode(v.Interface()); err != nil {
+		return err
+	}
+	return EncodeValue(w, v.Elem())
+}
+
+func toJSON(d *decoder, m machine, w Writer) {
+	switch m := m.(type) {
+	case *recurseMachine:
+		toJSON(d, m.get(), w)
+	case *compareMachine:
+		if d.zeroValue() {
+			// zero values are laid out like any other value of their type
+			var b bytes.Buffer
+			e := encoder{w: &b, mode: d.mode, version: d.version, types: d.types}
+			m.m.encode(&e, m.zv)
+			z := *d
+			z.r, z.lim, z.left, z.trace, z.in = &b, nil, b.Len, nil, nil
+			toJSON(&z, m.m, w)
+			return
+		}
+		toJSON(d, m.m, w)
+	case boolMachine:
+		w.WriteString(strconv.FormatBool(d.readByte() == 1))
+	case intMachine, unixNanoMachine:
+		w.WriteString(strconv.FormatInt(d.decodeInt(), 10))
+	case uintMachine:
+		w.WriteString(strconv.FormatUint(d.decodeUint(), 10))
+	case floatMachine:
+		writeJSON(w, d.decodeFloat(m.f32))
+	case complexMachine:
+		w.WriteByte('[')
+		writeJSON(w, d.decodeFloat(m.f32))
+		w.WriteByte(',')
+		writeJSON(w, d.decodeFloat(m.f32))
+		w.WriteByte(']')
+	case stringMachine:
+		writeJSON(w, string(d.read(d.decodeUint())))
+	case bytesMachine, streamedMachine, sinkMachine:
+		l, ok := d.decodeLen()
+		if !ok {
+			w.WriteString("null")
+			return
+		}
+		w.WriteByte('"')
+		w.WriteString(base64.StdEncoding.EncodeToString(d.read(uint64(l))))
+		w.WriteByte('"')
+	case *marshalerMachine:
+		v := reflect.New(m.t).Elem()
+		m.decode(d, v)
+		writeJSON(w, v.Interface())
+	case *enumMachine:
+		writeJSON(w, m.value(d).Interface())
+	case *rleMachine:
+		v := reflect.New(m.t).Elem()
+		m.decode(d, v)
+		writeJSON(w, v.Interface())
+	case *codecMachine:
+		v := reflect.New(m.t).Elem()
+		m.decode(d, v)
+		writeJSON(w, v.Interface())
+	case *arrayMachine:
+		arrayToJSON(d, m.m, d.decodeCount(), w)
+	case *chanMachine:
+		if d.zero() {
+			w.WriteString("null")
+			return
+		}
+		l, _ := d.decodeLen()
+		arrayToJSON(d, m.m, l, w)
+	case *sliceMachine:
+		l, ok := d.decodeLen()
+		if !ok {
+			w.WriteString("null")
+			return
+		}
+		arrayToJSON(d, m.m, l, w)
+	case *mapMachine:
+		l, ok := d.decodeLen()
+		if !ok {
+			w.WriteString("null")
+			return
+		}
+		w.WriteByte('{')
+		for i := 0; i < l; i++ {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			switch m.k.(type) {
+			case stringMachine:
+				toJSON(d, m.k, w)
+			case intMachine, uintMachine:
+				w.WriteByte('"')
+				toJSON(d, m.k, w)
+				w.WriteByte('"')
+			default:
+				panic(noPanic{&json.UnsupportedTypeError{Type: m.t}})
+			}
+			w.WriteByte(':')
+			toJSON(d, m.v, w)
+		}
+		w.WriteByte('}')
+	case *structMachine:
+		if p := reflect.PtrTo(m.t); p.Implements(jsonMarshalerType) || p.Implements(textMarshalerType) {
+			v := reflect.New(m.t).Elem()
+			m.decode(d, v)
+			writeJSON(w, v.Addr().Interface())
+			return
+		}
+		structToJSON(d, m, w)
+	case *ptrMachine:
+		if d.zero() {
+			w.WriteString("null")
+			return
+		}
+		if d.mode&Refs != 0 {
+			if d.decodeUint() != 1 {
+				panic(noPanic{errJSONRef})
+			}
+		} else if d.mode&PreserveNil != 0 {
+			d.present()
+		}
+		toJSON(d, m.m, w)
+	case netMachine:
+		v := reflect.New(m.t).Elem()
+		m.decode(d, v)
+		writeJSON(w, v.Interface())
+	case compressedMachine:
+		v := reflect.New(m.t).Elem()
+		m.decode(d, v)
+		writeJSON(w, v.Interface())
+	case *optionMachine:
+		if d.zero() {
+			w.WriteString("null")
+			return
+		}
+		d.present()
+		toJSON(d, m.m, w)
+	case *interfaceMachine:
+		if !d.zero() {
+			panic(noPanic{&json.UnsupportedTypeError{Type: m.z.Type()}})
+		}
+		w.WriteString("null")
+	default:
+		panic("enc: unknown machine")
+	}
+}
+
+func arrayToJSON(d *decoder, m machine, l int, w Writer) {
+	w.WriteByte('[')
+	for i := 0; i < l; i++ {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		toJSON(d, m, w)
+	}
+	w.WriteByte(']')
+}
+
+func writeJSON(w Writer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(noPanic{err})
+	}
+	w.Write(b)
+}
+
+func structToJSON(d *decoder, m *structMachine, w Writer) {
+	fields := jsonFields(m.t)
+	byIndex := make(map[string]*jsonField, len(fields))
+	for i := range fields {
+		byIndex[indexKey(fields[i].index)] = &fields[i]
+	}
+	values := make(map[string]json.RawMessage, len(fields))
+
+	l := d.decodeCount()
+	named := d.mode&NamedFields != 0
+	if l > len(m.fields) && !named {
+		panic(noPanic{errFields})
+	}
+	for i := 0; i < l; i++ {
+		j, n := i, uint64(0)
+		if named {
+			if j, n = m.readName(d); j < 0 {
+				d.discard(n)
+				continue
+			}
+		}
+		f := &m.fields[j]
+		if u, ok := f.m.(unsupportedMachine); ok {
+			skip(d, u)
+			d.discard(n)
+			continue
+		}
+		sf := m.t.FieldByIndex(f.index)
+		jf, ok := byIndex[indexKey(f.index)]
+		promoted := promotes(sf)
+		if !ok && !promoted {
+			if named {
+				d.discard(n)
+			} else {
+				skip(d, f.m)
+			}
+			continue
+		}
+		var b bytes.Buffer
+		if named {
+			d.within(n, func(d *decoder) { toJSON(d, f.m, &b) })
+		} else {
+			toJSON(d, f.m, &b)
+		}
+		if !promoted {
+			if v := jf.value(b.Bytes()); v != nil {
+				values[indexKey(f.index)] = v
+			}
+			continue
+		}
+		// the fields of an embedded struct are laid out by its own type
+		if b.String() == "null" {
+			continue
+		}
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(b.Bytes(), &obj); err != nil {
+			panic(noPanic{err})
+		}
+		t := sf.Type
+		if t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		for _, ef := range jsonFields(t) {
+			if v, ok := obj[ef.name]; ok {
+				values[indexKey(append(f.index[:len(f.index):len(f.index)], ef.index...))] = v
+			}
+		}
+	}
+
+	w.WriteByte('{')
+	first := true
+	for _, f := range fields {
+		v, ok := values[indexKey(f.index)]
+		if !ok {
+			continue
+		}
+		if !first {
+			w.WriteByte(',')
+		}
+		first = false
+		writeJSON(w, f.name)
+		w.WriteByte(':')
+		w.Write(v)
+	}
+	w.WriteByte('}')
+}
+
+// A jsonField is a struct field as encoding/json lays it out.
+type jsonField struct {
+	name   string
+	index  []int
+	t      reflect.Type
+	tagged bool
+
+	omitEmpty, quoted bool
+}
+
+// value returns the JSON of the field given that of its value,
+// or nil if the field is left out.
+func (f *jsonField) value(b []byte) json.RawMessage {
+	if f.omitEmpty && emptyJSON(f.t, b) {
+		return nil
+	}
+	v := json.RawMessage(append([]byte(nil), b...))
+	if f.quoted && string(b) != "null" {
+		v, _ = json.Marshal(string(b))
+	}
+	return v
+}
+
+// emptyJSON reports whether b is the JSON of a value of type t
+// that the omitempty option leaves out.
+func emptyJSON(t reflect.Type, b []byte) bool {
+	switch s := string(b); t.Kind() {
+	case reflect.Array:
+		return t.Len() == 0
+	case reflect.Map, reflect.Slice, reflect.String, reflect.Chan:
+		return s == "null" || s == "[]" || s == "{}" || s == `""`
+	case reflect.Bool:
+		return s == "false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		return err == nil && f == 0
+	case reflect.Interface, reflect.Pointer:
+		return s == "null"
+	}
+	return false
+}
+
+// promotes reports whether encoding/json promotes the fields of the embedded struct field f.
+func promotes(f reflect.StructField) bool {
+	t := f.Type
+	if t.Name() == "" && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	return f.Anonymous && t.Kind() == reflect.Struct && name == "" && f.Tag.Get("json") != "-"
+}
+
+func indexKey(index []int) string {
+	return fmt.Sprint(index)
+}
+
+var jsonFieldCache sync.Map // map[reflect.Type][]jsonField
+
+// jsonFields returns the fields of the struct type t that encoding/json marshals,
+// in order, resolving the names of promoted fields like it does.
+func jsonFields(t reflect.Type) []jsonField {
+	if f, ok := jsonFieldCache.Load(t); ok {
+		return f.([]jsonField)
+	}
+	type level struct {
+		t     reflect.Type
+		index []int
+	}
+	var fields []jsonField
+	next := []level{{t: t}}
+	count, nextCount := map[reflect.Type]int{}, map[reflect.Type]int{}
+	visited := map[reflect.Type]bool{}
+	for len(next) > 0 {
+		current := next
+		next = nil
+		count, nextCount = nextCount, map[reflect.Type]int{}
+		for _, l := range current {
+			if visited[l.t] {
+				continue
+			}
+			visited[l.t] = true
+			for i := 0; i < l.t.NumField(); i++ {
+				sf := l.t.Field(i)
+				ft := sf.Type
+				if ft.Name() == "" && ft.Kind() == reflect.Pointer {
+					ft = ft.Elem()
+				}
+				if !sf.IsExported() && (!sf.Anonymous || ft.Kind() != reflect.Struct || sf.Type.Kind() == reflect.Pointer) {
+					continue
+				}
+				tag := sf.Tag.Get("json")
+				if tag == "-" {
+					continue
+				}
+				index := append(l.index[:len(l.index):len(l.index)], i)
+				if promotes(sf) {
+					if nextCount[ft]++; nextCount[ft] == 1 {
+						next = append(next, level{ft, index})
+					}
+					continue
+				}
+				name, opts, _ := strings.Cut(tag, ",")
+				f := jsonField{name: name, index: index, t: sf.Type, tagged: name != ""}
+				if name == "" {
+					f.name = sf.Name
+				}
+				for _, o := range strings.Split(opts, ",") {
+					switch o {
+					case "omitempty":
+						f.omitEmpty = true
+					case "string":
+						f.quoted = quotable(ft)
+					}
+				}
+				fields = append(fields, f)
+				if count[l.t] > 1 {
+					// the same struct embedded twice at a level conflicts with itself
+					fields = append(fields, f)
+				}
+			}
+		}
+	}
+
+	sort.Slice(fields, func(i, j int) bool {
+		a, b := &fields[i], &fields[j]
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		if len(a.index) != len(b.index) {
+			return len(a.index) < len(b.index)
+		}
+		if a.tagged != b.tagged {
+			return a.tagged
+		}
+		return lessIndex(a.index, b.index)
+	})
+	// of the fields with a name, the shallowest one wins, a tagged one over an untagged one,
+	// and there is none if that leaves several
+	out := fields[:0]
+	for i, n := 0, 0; i < len(fields); i += n {
+		for n = 1; i+n < len(fields) && fields[i+n].name == fields[i].name; n++ {
+		}
+		if n == 1 || len(fields[i+1].index) > len(fields[i].index) || fields[i].tagged && !fields[i+1].tagged {
+			out = append(out, fields[i])
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return lessIndex(out[i].index, out[j].index) })
+
+	f, _ := jsonFieldCache.LoadOrStore(t, out)
+	return f.([]jsonField)
+}
+
+func lessIndex(a, b []int) bool {
+	for i := range a {
+		if i >= len(b) {
+			return false
+		}
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// quotable reports whether the string option of json tags applies to values of type t.
+func quotable(t reflect.Type) bool {
+	if t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType) {
+		return false
+	}
+	switch t.Kind() {
+	case reflect.Bool, reflect.String, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type JSON struct {
+	I int
+	U uint8
+	F float64
+	S string `json:"s"`
+	L []byte
+	A [3]int
+	P *int
+	M map[string][]JSON
+	K map[int]bool
+	T Time
+}
+
+func TestJSON(t *testing.T) {
+	typ := reflect.TypeOf(JSON{})
+	v := &JSON{
+		I: -1, U: 2, F: 1.5, S: "s\"", L: []byte{3, 4}, A: [3]int{5},
+		M: map[string][]JSON{"a": {{I: 6}}},
+		K: map[int]bool{7: true},
+		T: Time{time.Now().UTC().Round(0)},
+	}
+
+	var bin, js, want bytes.Buffer
+	if err := Encode(&bin, v); err != nil {
+		t.Error(err)
+	}
+	u := new(JSON)
+	if err := Decode(bytes.NewReader(bin.Bytes()), u); err != nil {
+		t.Error(err)
+	}
+	if err := ToJSON(&bin, typ, &js); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.NewEncoder(&want).Encode(u); err != nil {
+		t.Error(err)
+	}
+	var a, b interface{}
+	json.Unmarshal(js.Bytes(), &a)
+	json.Unmarshal(want.Bytes(), &b)
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("unexpected JSON\n%s\n%s", js.Bytes(), want.Bytes())
+	}
+
+	bin.Reset()
+	if err := FromJSON(&js, typ, &bin); err != nil {
+		t.Error(err)
+	}
+	w := new(JSON)
+	if err := Decode(&bin, w); err != nil {
+		t.Error(err)
+	}
+	if !Equal(u, w) {
+		t.Error("round trip through JSON changed the value:", Diff(u, w))
+	}
+}
+
+type Hidden struct {
+	A      int
+	Secret string `json:"-"`
+	Dash   int    `json:"-,"`
+	B      []int
+}
+
+func TestJSONHidden(t *testing.T) {
+	for _, m := range []Mode{0, NamedFields} {
+		var bin bytes.Buffer
+		e := NewEncoder(&bin)
+		e.SetMode(m)
+		e.Encode(&Hidden{1, "secret", 2, []int{3}})
+		var js bytes.Buffer
+		d := NewDecoder(&bin)
+		d.SetMode(m)
+		err := d.run(nil, func(d *decoder) {
+			w := bufio.NewWriter(&js)
+			toJSON(d, types.get(reflect.TypeOf(Hidden{})), w)
+			w.Flush()
+		})
+		if want := `{"A":1,"-":2,"B":[3]}`; err != nil || js.String() != want {
+			t.Errorf("mode %d: %s, %v", m, js.Bytes(), err)
+		}
+	}
+
+	var bin bytes.Buffer
+	if err := FromJSON(bytes.NewReader([]byte(`{"A":1,"Secret":"s","-":2}`)), reflect.TypeOf(Hidden{}), &bin); err != nil {
+		t.Fatal(err)
+	}
+	var h Hidden
+	if err := Decode(&bin, &h); err != nil || h.Secret != "" || h.A != 1 || h.Dash != 2 {
+		t.Errorf("decoded %+v, %v", h, err)
+	}
+}
+
+type RvIn struct{ A, B int }
+
+type Extra struct{ X int }
+
+type Layout struct {
+	RvIn
+	*Extra
+	C int
+	D string `json:",omitempty"`
+	E int    `json:",string"`
+	F *int   `json:",omitempty"`
+	G []int  `json:"g,omitempty"`
+}
+
+func TestJSONLayout(t *testing.T) {
+	one := 1
+	for _, v := range []Layout{
+		{RvIn: RvIn{A: 1, B: 2}, C: 3},
+		{RvIn: RvIn{A: 1}, Extra: &Extra{4}, D: "d", E: 5, F: &one, G: []int{6}},
+		{},
+	} {
+		for _, m := range []Mode{0, NamedFields} {
+			var bin, js bytes.Buffer
+			e := NewEncoder(&bin)
+			e.SetMode(m)
+			if err := e.Encode(&v); err != nil {
+				t.Fatal(err)
+			}
+			d := NewDecoder(&bin)
+			d.SetMode(m)
+			err := d.run(nil, func(d *decoder) {
+				toJSON(d, types.get(reflect.TypeOf(v)), &js)
+			})
+			want, _ := json.Marshal(v)
+			if err != nil || js.String() != string(want) {
+				t.Errorf("mode %d: %s, %v, want %s", m, js.Bytes(), err, want)
+			}
+
+			bin.Reset()
+			if err := FromJSON(&js, reflect.TypeOf(v), &bin); err != nil {
+				t.Fatal(err)
+			}
+			var u Layout
+			err = Decode(&bin, &u)
+			if got, _ := json.Marshal(u); err != nil || u.RvIn != v.RvIn || string(got) != string(want) {
+				t.Errorf("mode %d: round trip through JSON changed %+v to %+v, %v", m, v, u, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+// Lazy holds a value of type T that is only decoded once it is asked for.
+// It is laid out on the wire like a Raw holding the value.
+// A Lazy must not be used concurrently.
+type Lazy[T any] struct {
+	raw  Raw
+	v    T
+	err  error
+	done bool
+}
+
+// NewLazy returns a Lazy holding v.
+func NewLazy[T any](v T) *Lazy[T] {
+	return &Lazy[T]{v: v, done: true}
+}
+
+// Value returns the held value, decoding it on first use.
+func (l *Lazy[T]) Value() (T, error) {
+	if !l.done {
+		l.err = l.raw.Decode(&l.v)
+		l.raw, l.done = nil, true
+	}
+	return l.v, l.err
+}
+
+// Set replaces the held value.
+func (l *Lazy[T]) Set(v T) {
+	l.raw, l.v, l.err, l.done = nil, v, nil, true
+}
+
+// MarshalBinary returns the encoding of the held value,
+// reusing the decoded bytes if the value was never asked for.
+func (l *Lazy[T]) MarshalBinary() ([]byte, error) {
+	if !l.done {
+		return l.raw, nil
+	}
+	return NewRaw(&l.v)
+}
+
+// UnmarshalBinary keeps a copy of data to decode the value from later on.
+func (l *Lazy[T]) UnmarshalBinary(data []byte) error {
+	var zero T
+	l.raw, l.v, l.err, l.done = append(Raw(nil), data...), zero, nil, false
+	return nil
+}
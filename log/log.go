@@ -0,0 +1,126 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package log implements an append-only log of records encoded with enc,
+// each in a frame with its length and checksum, see enc.Framed.
+//
+// A crash while appending may leave a torn final record behind.
+// Reading such a log ends with ErrTorn, after which the log can be cut
+// back to its complete records:
+//
+//	for {
+//		err := r.Next(&v)
+//		if err == log.ErrTorn {
+//			err = f.Truncate(r.Offset())
+//		}
+//		...
+//	}
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/koneu/enc"
+)
+
+// ErrTorn indicates that the final record of a log is incomplete.
+var ErrTorn = errors.New("log: torn final record")
+
+// A Writer appends records to a log.
+type Writer struct {
+	w   io.Writer
+	buf bytes.Buffer
+	enc *enc.Encoder
+}
+
+// NewWriter returns a Writer appending to w, which is positioned
+// at the end of the log.
+func NewWriter(w io.Writer) *Writer {
+	lw := &Writer{w: w}
+	lw.enc = enc.NewEncoder(&lw.buf)
+	lw.enc.SetMode(enc.Framed)
+	return lw
+}
+
+// Append encodes v as a record and writes it with a single call to Write.
+// It panics if the value is of an invalid type.
+func (w *Writer) Append(v interface{}) error {
+	w.buf.Reset()
+	if err := w.enc.Encode(v); err != nil {
+		return err
+	}
+	_, err := w.w.Write(w.buf.Bytes())
+	return err
+}
+
+// A Reader reads the records of a log.
+type Reader struct {
+	r      countReader
+	dec    *enc.Decoder
+	offset int64
+}
+
+// NewReader returns a Reader reading a log from its start.
+func NewReader(r io.Reader) *Reader {
+	lr := &Reader{r: countReader{r: bufio.NewReader(r)}}
+	lr.dec = enc.NewDecoder(&lr.r)
+	lr.dec.SetMode(enc.Framed)
+	return lr
+}
+
+// Next decodes the next record into v. It returns io.EOF at the end
+// of the log, ErrTorn if the final record is incomplete, and an
+// enc.CorruptError for a damaged record, which Resync skips.
+// It panics if the value is of an invalid type.
+func (r *Reader) Next(v interface{}) error {
+	err := r.dec.Decode(v)
+	switch {
+	case err == nil:
+		r.offset = r.r.n
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		err = ErrTorn
+	}
+	return err
+}
+
+// Offset returns the end of the last record read by Next.
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+// Resync skips ahead to the next record after Next failed.
+func (r *Reader) Resync() error {
+	return r.dec.Resync()
+}
+
+// countReader counts the bytes read.
+type countReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *countReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.n++
+	}
+	return b, err
+}
+
+func (r *countReader) UnreadByte() error {
+	err := r.r.UnreadByte()
+	if err == nil {
+		r.n--
+	}
+	return err
+}
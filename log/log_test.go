@@ -0,0 +1,51 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package log
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+type entry struct {
+	Key   string
+	Value int
+}
+
+func TestLog(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for i, k := range []string{"a", "b", "c"} {
+		if err := w.Append(&entry{k, i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	good := buf.Len()
+	w.Append(&entry{"torn", 3})
+	b := buf.Bytes()[:buf.Len()-2]
+
+	r := NewReader(bytes.NewReader(b))
+	var e entry
+	for i := 0; i < 3; i++ {
+		if err := r.Next(&e); err != nil || e.Value != i {
+			t.Fatal("unexpected record", e, err)
+		}
+	}
+	if err := r.Next(&e); err != ErrTorn {
+		t.Fatal("expected", ErrTorn, "got", err)
+	}
+	if r.Offset() != int64(good) {
+		t.Error("unexpected offset", r.Offset(), good)
+	}
+
+	r = NewReader(bytes.NewReader(b[:good]))
+	for i := 0; i < 3; i++ {
+		r.Next(&e)
+	}
+	if err := r.Next(&e); err != io.EOF {
+		t.Error("expected", io.EOF, "got", err)
+	}
+}
@@ -5,25 +5,72 @@
 package enc
 
 import (
+	"bytes"
 	"encoding"
-	"math"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"unsafe"
 )
 
-var types = _types{m: make(map[reflect.Type]machine)}
+var types = cache(0)
 
-type _types struct {
+// caches holds a machine cache for every set of flags given in Options.
+var caches sync.Map
+
+var flags = struct {
 	sync.RWMutex
-	m map[reflect.Type]machine
+	m map[reflect.Type]Flags
+}{m: make(map[reflect.Type]Flags)}
+
+// A _types caches machines by type.
+// Lookups do not take a lock, so goroutines encoding different types do not contend.
+type _types struct {
+	m     sync.Map
+	flags Flags
+}
+
+// cache returns the machine cache for types with the additional flags f.
+func cache(f Flags) *_types {
+	g, ok := caches.Load(f)
+	if !ok {
+		g, _ = caches.LoadOrStore(f, &_types{flags: f})
+	}
+	return g.(*_types)
+}
+
+// RegisterFlags sets the flags for values of type t.
+// It panics if values of type t have already been encoded or decoded,
+// so it is best called from an init function.
+func RegisterFlags(t reflect.Type, f Flags) {
+	flags.Lock()
+	defer flags.Unlock()
+	if used(t) {
+		panic("enc: RegisterFlags called after first use of " + t.String())
+	}
+	flags.m[t] = f
+}
+
+// used reports whether a machine for type t is cached.
+func used(t reflect.Type) (ok bool) {
+	caches.Range(func(_, g interface{}) bool {
+		_, ok = g.(*_types).m.Load(t)
+		return !ok
+	})
+	return
+}
+
+// flagsOf returns the flags for values of type t.
+func (g *_types) flagsOf(t reflect.Type) Flags {
+	flags.RLock()
+	defer flags.RUnlock()
+	return flags.m[t] | g.flags
 }
 
 func (g *_types) get(t reflect.Type) machine {
-	g.RLock()
-	ret, ok := g.m[t]
-	g.RUnlock()
-	if ok {
-		return ret
+	if ret, ok := g.m.Load(t); ok {
+		return ret.(machine)
 	}
 	return g.register(t)
 }
@@ -32,23 +79,56 @@ func (g *_types) get(t reflect.Type) machine {
 // Once a machine has been generated, the type can be encoded without the need to walk its definition.
 func (g *_types) register(t reflect.Type) (ret machine) {
 	// special care must be taken for recursive types
-	g.Lock()
-	if r, ok := g.m[t]; ok {
-		g.Unlock()
-		return r
-	}
+	flags := g.flagsOf(t)
 	lock := &recurseMachine{c: make(chan machine, 1)}
-	g.m[t] = lock
-	g.Unlock()
+	if r, ok := g.m.LoadOrStore(t, lock); ok {
+		return r.(machine)
+	}
+	misses.Add(1)
 
 	defer func() {
-		g.Lock()
-		g.m[t] = ret
-		g.Unlock()
-
+		if ret == nil {
+			// t is invalid, do not cache its lock
+			g.m.Delete(t)
+		} else {
+			g.m.Store(t, ret)
+		}
 		lock.c <- ret
 	}()
 
+	if c := codecOf(t); c != nil {
+		return &codecMachine{t, c}
+	}
+	if m := enumOf(t); m != nil {
+		return m
+	}
+	switch t {
+	case streamedType:
+		return streamedMachine{}
+	case sinkType:
+		return sinkMachine{}
+	case mapStreamType:
+		return mapStreamMachine{}
+	case addrType, prefixType:
+		return netMachine{t}
+	case compressedStringType, compressedBytesType:
+		return compressedMachine{t}
+	}
+	if isIP(t) {
+		return netMachine{t}
+	}
+	if t == timeType && flags&UnixNano != 0 {
+		return unixNanoMachine{}
+	}
+	if isOption(t) {
+		return &optionMachine{reflect.Zero(t), g.get(t.Field(0).Type)}
+	}
+
+	if flags&(Marshalers|NoMarshalers) == Marshalers && implements(t, marshalerType) && implements(t, unmarshalerType) {
+		ret = marshalerOf(t)
+		goto zero
+	}
+
 bigswitch:
 	switch t.Kind() {
 	case reflect.Bool:
@@ -58,11 +138,11 @@ bigswitch:
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
 		return uintMachine{}
 	case reflect.Float32, reflect.Float64:
-		return floatMachine{}
+		return floatMachine{t.Kind() == reflect.Float32}
 	case reflect.Complex64, reflect.Complex128:
-		return complexMachine{}
+		return complexMachine{t.Kind() == reflect.Complex64}
 	case reflect.Array:
-		ret = &arrayMachine{t.Len(), g.get(t.Elem())}
+		ret = &arrayMachine{t, t.Len(), g.get(t.Elem())}
 	case reflect.Chan:
 		e, s := t.Elem(), reflect.SliceOf(t.Elem())
 		return &chanMachine{reflect.Zero(t), e, s, t, g.get(e), g.get(s)}
@@ -70,53 +150,129 @@ bigswitch:
 		return &interfaceMachine{reflect.Zero(t)}
 	case reflect.Map:
 		k, v := t.Key(), t.Elem()
-		return &mapMachine{t, k, v, g.get(k), g.get(v)}
+		return &mapMachine{t, k, v, g.key(t), g.get(v), dynamic(k)}
 	case reflect.Ptr:
-		return &ptrMachine{reflect.Zero(t), t.Elem(), g.get(t.Elem())}
+		r := &ptrMachine{z: reflect.Zero(t), t: t.Elem(), m: g.get(t.Elem())}
+		r.next, _ = r.m.(*ptrMachine)
+		return r
 	case reflect.Slice:
-		if t == bytesType {
+		if t == bytesType || t == rawType {
 			return bytesMachine{}
 		}
 		return &sliceMachine{t, g.get(t.Elem())}
 	case reflect.String:
 		return stringMachine{}
 	case reflect.Struct:
-		r := make(structMachine, t.NumField())
-		for i := range r {
-			f := t.Field(i)
-			if f.PkgPath != "" && !f.Anonymous {
-				break bigswitch
-			}
-			r[i] = g.get(f.Type)
+		p := reflect.PtrTo(t)
+		r := &structMachine{t: t}
+		r.defaults, r.validate, r.prepare = p.Implements(defaulterType), p.Implements(validatorType), p.Implements(preparerType)
+		if !g.fields(r, t, nil, flags) {
+			break bigswitch
+		}
+		if flags&FastFields != 0 {
+			r.compile()
 		}
 		ret = r
 	}
 
 	// support BinaryMarshaler as a last resort
 	if ret == nil {
-		p := reflect.PtrTo(t)
-		r := marshalerMachine{p.Implements(marshalerType), p.Implements(unmarshalerType)}
-		if !(r.e || t.Implements(marshalerType)) && !(r.d || t.Implements(unmarshalerType)) {
+		if flags&NoMarshalers != 0 || !implements(t, marshalerType) && !implements(t, unmarshalerType) {
 			panic(TypeError{t})
 		}
-		ret = &r
+		ret = marshalerOf(t)
 	}
 
+zero:
 	// encode zero values as a single 0 byte
 	if t.Comparable() {
-		z := reflect.Zero(t)
-		ret = &compareMachine{z, z.Interface(), ret}
+		ret = &compareMachine{reflect.Zero(t), ret}
 	}
 
 	return
 }
 
+// fields appends the fields of the struct type t to r, flattening embedded structs where requested.
+// It reports false if t has unexported fields that may not be encoded.
+func (g *_types) fields(r *structMachine, t reflect.Type, index []int, flags Flags) bool {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			if flags&SkipUnexported != 0 {
+				continue
+			}
+			if flags&Unexported == 0 {
+				return false
+			}
+		}
+		r.unexported = r.unexported || f.PkgPath != ""
+		fi := append(index[:len(index):len(index)], i)
+		tag := tag(f.Tag.Get("enc"))
+
+		if f.Anonymous && f.Type.Kind() == reflect.Struct && (flags&Flatten != 0 || tag.has("flatten")) {
+			if !g.fields(r, f.Type, fi, g.flagsOf(f.Type)|flags&Flatten) {
+				return false
+			}
+			continue
+		}
+
+		fm := field{name: f.Name, tag: f.Tag, index: fi, omitEmpty: tag.has("omitempty"), redact: tag.has("redact")}
+		r.omitEmpty = r.omitEmpty || fm.omitEmpty
+		if fm.bounds = parseBounds(f, tag); fm.bounds != nil {
+			r.bounded = true
+		}
+		name, codec := tag.value("codec")
+		switch {
+		case codec:
+			c := namedCodec(name)
+			if c == nil {
+				panic("enc: unknown codec " + name + " on field " + f.Name + " of " + t.String())
+			}
+			fm.m = &codecMachine{f.Type, c}
+		case f.Type.Kind() == reflect.Func || f.Type.Kind() == reflect.UnsafePointer:
+			fm.m = unsupportedMachine{f.Type}
+		case f.Type == timeType && tag.has("unixnano"):
+			fm.m = unixNanoMachine{}
+		case tag.has("rle"):
+			if !rleable(f.Type) {
+				panic("enc: rle tag on field " + f.Name + " of " + f.Type.String())
+			}
+			fm.m = &rleMachine{f.Type, g.get(f.Type.Elem())}
+		default:
+			fm.m = g.get(f.Type)
+		}
+		r.fields = append(r.fields, fm)
+	}
+	return true
+}
+
+// tag holds the comma separated options of an enc struct tag.
+type tag string
+
+func (t tag) has(o string) bool {
+	for _, s := range strings.Split(string(t), ",") {
+		if s == o {
+			return true
+		}
+	}
+	return false
+}
+
+// value returns the value of the option key=value.
+func (t tag) value(key string) (string, bool) {
+	for _, s := range strings.Split(string(t), ",") {
+		if strings.HasPrefix(s, key+"=") {
+			return s[len(key)+1:], true
+		}
+	}
+	return "", false
+}
+
 func decodeZero(d *decoder, v, z reflect.Value) bool {
-	if d.readByte() == 0 {
+	if d.zero() {
 		v.Set(z)
 		return true
 	}
-	d.unreadByte()
 	return false
 }
 
@@ -132,39 +288,53 @@ type recurseMachine struct {
 	m machine
 }
 
-func (m *recurseMachine) encode(e *encoder, v reflect.Value) {
+// get returns the machine generated for the recursive type.
+func (m *recurseMachine) get() machine {
 	m.o.Do(func() {
 		m.m = <-m.c
 	})
-	m.m.encode(e, v)
+	return m.m
+}
+
+func (m *recurseMachine) encode(e *encoder, v reflect.Value) {
+	m.get().encode(e, v)
 }
 
 func (m *recurseMachine) decode(d *decoder, v reflect.Value) {
-	m.o.Do(func() {
-		m.m = <-m.c
-	})
-	m.m.decode(d, v)
+	m.get().decode(d, v)
 }
 
+// compareMachine encodes zero values as a single 0 byte, unless in ExplicitZeros mode.
 type compareMachine struct {
 	zv reflect.Value
-	z  interface{}
 	m  machine
 }
 
 func (m *compareMachine) encode(e *encoder, v reflect.Value) {
-	// too bad reflect.Value lacks an Equals() method
-	if m.z == v.Interface() {
+	s, _ := m.m.(*structMachine)
+	if s != nil && s.prepare {
+		v = prepare(v)
+	}
+	if e.mode&ExplicitZeros == 0 && v.IsZero() {
 		e.writeByte(0)
 		return
 	}
-	m.m.encode(e, v)
+	if s != nil {
+		s.encodeFields(e, v)
+	} else {
+		m.m.encode(e, v)
+	}
 }
 
 func (m *compareMachine) decode(d *decoder, v reflect.Value) {
-	if !decodeZero(d, v, m.zv) {
-		m.m.decode(d, v)
+	if d.zeroValue() {
+		v.Set(m.zv)
+		if s, ok := m.m.(*structMachine); ok {
+			s.check(v, nil)
+		}
+		return
 	}
+	m.m.decode(d, v)
 }
 
 type boolMachine struct{}
@@ -195,32 +365,30 @@ type uintMachine struct{}
 func (uintMachine) encode(e *encoder, v reflect.Value) { e.encodeUint(v.Uint()) }
 func (uintMachine) decode(d *decoder, v reflect.Value) { v.SetUint(d.decodeUint()) }
 
-type floatMachine struct{}
+type floatMachine struct{ f32 bool }
 
-func (floatMachine) encode(e *encoder, v reflect.Value) {
-	e.encodeUint(math.Float64bits(v.Float()))
+func (m floatMachine) encode(e *encoder, v reflect.Value) {
+	e.encodeFloat(v.Float(), m.f32)
 }
 
-func (floatMachine) decode(d *decoder, v reflect.Value) {
-	v.SetFloat(math.Float64frombits(d.decodeUint()))
+func (m floatMachine) decode(d *decoder, v reflect.Value) {
+	v.SetFloat(d.decodeFloat(m.f32))
 }
 
-type complexMachine struct{}
+type complexMachine struct{ f32 bool }
 
-func (complexMachine) encode(e *encoder, v reflect.Value) {
+func (m complexMachine) encode(e *encoder, v reflect.Value) {
 	c := v.Complex()
-	e.encodeUint(math.Float64bits(real(c)))
-	e.encodeUint(math.Float64bits(imag(c)))
+	e.encodeFloat(real(c), m.f32)
+	e.encodeFloat(imag(c), m.f32)
 }
 
-func (complexMachine) decode(d *decoder, v reflect.Value) {
-	v.SetComplex(complex(
-		math.Float64frombits(d.decodeUint()),
-		math.Float64frombits(d.decodeUint()),
-	))
+func (m complexMachine) decode(d *decoder, v reflect.Value) {
+	v.SetComplex(complex(d.decodeFloat(m.f32), d.decodeFloat(m.f32)))
 }
 
 type arrayMachine struct {
+	t reflect.Type
 	l int
 	m machine
 }
@@ -228,17 +396,21 @@ type arrayMachine struct {
 func (m *arrayMachine) encode(e *encoder, v reflect.Value) {
 	e.encodeUint(uint64(m.l))
 	for i := 0; i < m.l; i++ {
-		m.m.encode(e, v.Index(i))
+		e.encodeAt(m.m, v.Index(i), step{i: i})
 	}
 }
 
 func (m *arrayMachine) decode(d *decoder, v reflect.Value) {
-	l := m.l
-	if t := int(d.decodeUint()); t < l {
-		l = t
-	}
-	for i := 0; i < l; i++ {
-		m.m.decode(d, v.Index(i))
+	n := d.decodeCount()
+	if n != m.l && d.mode&Strict != 0 {
+		panic(noPanic{SchemaMismatchError{m.t, m.l, n}})
+	}
+	for i := 0; i < n; i++ {
+		if i < m.l {
+			d.decodeAt(m.m, v.Index(i), step{i: i})
+		} else {
+			skip(d, m.m)
+		}
 	}
 }
 
@@ -253,26 +425,79 @@ func (m *chanMachine) encode(e *encoder, v reflect.Value) {
 		e.writeByte(0)
 		return
 	}
+	if e.mode&SnapshotChans != 0 {
+		m.ms.encode(e, snapshot(m.ts, v))
+		return
+	}
 	s := reflect.MakeSlice(m.ts, 0, 8)
-	for e, ok := v.Recv(); ok; e, ok = v.Recv() {
-		s = reflect.Append(s, e)
+	for x, ok := e.recv(v); ok; x, ok = e.recv(v) {
+		s = reflect.Append(s, x)
 	}
 	m.ms.encode(e, s)
 }
 
+// snapshot copies the buffered elements of c to a new slice of type t,
+// sending them back to c unless it was closed. If others sent to c
+// meanwhile, the elements that no longer fit are lost: it puts back
+// all others in order and fails.
+func snapshot(t reflect.Type, c reflect.Value) reflect.Value {
+	s := reflect.MakeSlice(t, 0, c.Len())
+	for i := s.Cap(); i > 0; i-- {
+		x, ok := c.TryRecv()
+		if !ok {
+			break
+		}
+		s = reflect.Append(s, x)
+	}
+	if x, ok := c.TryRecv(); ok {
+		s = reflect.Append(s, x)
+	} else if x.IsValid() {
+		return s
+	}
+	lost := false
+	for i, l := 0, s.Len(); i < l; i++ {
+		if !c.TrySend(s.Index(i)) {
+			lost = true
+		}
+	}
+	if lost {
+		panic(noPanic{errSnapshot})
+	}
+	return s
+}
+
 func (m *chanMachine) decode(d *decoder, v reflect.Value) {
 	if decodeZero(d, v, m.z) {
 		return
 	}
 
-	l := int(d.decodeUint())
+	l, _ := d.decodeLen()
+	if d.maxChan > 0 && l > d.maxChan {
+		panic(noPanic{ErrTooLarge})
+	}
 	if v.IsNil() {
-		v.Set(reflect.MakeChan(m.tc, int(l)))
+		if d.chanBuf > 0 && l > d.chanBuf {
+			panic(noPanic{ErrTooLarge})
+		}
+		// the elements are decoded before the channel buffering them is made
+		s := reflect.New(reflect.SliceOf(m.t)).Elem()
+		s.Set(d.makeSlice(s.Type(), l))
+		for i := 0; i < l; i++ {
+			if i == s.Len() {
+				d.grow(s, i+1, l)
+			}
+			m.m.decode(d, s.Index(i))
+		}
+		v.Set(reflect.MakeChan(m.tc, l))
+		for i := 0; i < l; i++ {
+			v.Send(s.Index(i))
+		}
+		return
 	}
 	for i := 0; i < l; i++ {
 		e := reflect.New(m.t).Elem()
 		m.m.decode(d, e)
-		v.Send(e)
+		d.send(v, e)
 	}
 }
 
@@ -284,61 +509,201 @@ func (*interfaceMachine) encode(e *encoder, v reflect.Value) {
 		return
 	}
 	v = v.Elem()
-	types.get(v.Type()).encode(e, v)
+	switch {
+	case e.mode&Typed != 0:
+		e.encodeType(v.Type())
+	case e.mode&PreserveNil != 0:
+		e.writeByte(1)
+	}
+	e.types.get(v.Type()).encode(e, v)
 }
 
 func (m *interfaceMachine) decode(d *decoder, v reflect.Value) {
-	if !decodeZero(d, v, m.z) {
-		v = v.Elem()
-		types.get(v.Type()).decode(d, v)
+	if decodeZero(d, v, m.z) {
+		return
+	}
+	if d.mode&Typed != 0 {
+		t := d.decodeType()
+		if !t.AssignableTo(m.z.Type()) {
+			panic(noPanic{TypeError{t}})
+		}
+		x := reflect.New(t).Elem()
+		d.types.get(t).decode(d, x)
+		v.Set(x)
+		return
+	}
+	if d.mode&PreserveNil != 0 {
+		d.present()
+	}
+	if v.IsNil() {
+		panic(noPanic{errInterface})
 	}
+	// values held by interfaces cannot be set, so decode into a copy
+	x := reflect.New(v.Elem().Type()).Elem()
+	x.Set(v.Elem())
+	d.types.get(x.Type()).decode(d, x)
+	v.Set(x)
 }
 
 type mapMachine struct {
 	t, tk, tv reflect.Type
 	k, v      machine
+	// dynamic is set if decoded keys may not be comparable
+	dynamic bool
+}
+
+// key returns the machine for the keys of the map type t,
+// turning a TypeError for them into a KeyError.
+func (g *_types) key(t reflect.Type) machine {
+	defer func() {
+		switch p := recover(); p := p.(type) {
+		case nil:
+		case TypeError:
+			panic(KeyError{t, p.T})
+		default:
+			panic(p)
+		}
+	}()
+	return g.get(t.Key())
+}
+
+// dynamic reports whether values of type t hold interfaces,
+// which makes their comparability depend on their contents.
+func dynamic(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Interface:
+		return true
+	case reflect.Array:
+		return dynamic(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if dynamic(t.Field(i).Type) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func (m *mapMachine) encode(e *encoder, v reflect.Value) {
-	e.encodeUint(uint64(v.Len()))
+	e.encodeLen(v)
+	if e.mode&Canonical != 0 {
+		m.encodeSorted(e, v)
+		return
+	}
+	for i := v.MapRange(); i.Next(); {
+		k := i.Key()
+		m.k.encode(e, k)
+		e.encodeAt(m.v, i.Value(), step{k: k})
+	}
+}
+
+// encodeSorted writes the entries of v ordered by the encoding of their keys.
+func (m *mapMachine) encodeSorted(e *encoder, v reflect.Value) {
+	type entry struct {
+		k    reflect.Value
+		s, e int
+	}
+	var buf bytes.Buffer
+	k := *e
+	k.w, k.trace, k.mode = &buf, nil, e.mode&^Refs
+	es := make([]entry, 0, v.Len())
 	for _, i := range v.MapKeys() {
-		m.k.encode(e, i)
-		m.v.encode(e, v.MapIndex(i))
+		s := buf.Len()
+		m.k.encode(&k, i)
+		es = append(es, entry{i, s, buf.Len()})
+	}
+	b := buf.Bytes()
+	sort.Slice(es, func(i, j int) bool {
+		return bytes.Compare(b[es[i].s:es[i].e], b[es[j].s:es[j].e]) < 0
+	})
+	for _, i := range es {
+		if e.mode&Refs != 0 {
+			// references have to be numbered in the order they are written
+			m.k.encode(e, i.k)
+		} else {
+			e.write(b[i.s:i.e])
+		}
+		e.encodeAt(m.v, v.MapIndex(i.k), step{k: i.k})
 	}
 }
 
 func (m *mapMachine) decode(d *decoder, v reflect.Value) {
-	v.Set(reflect.MakeMap(m.t))
-	for i, l := uint64(0), d.decodeUint(); i < l; i++ {
+	l, ok := d.decodeLen()
+	if !ok {
+		v.Set(reflect.Zero(m.t))
+		return
+	}
+	if d.mode&MergeMaps == 0 || v.IsNil() {
+		v.Set(reflect.MakeMap(m.t))
+	}
+	for i := 0; i < l; i++ {
 		key, val := reflect.New(m.tk).Elem(), reflect.New(m.tv).Elem()
 		m.k.decode(d, key)
-		m.v.decode(d, val)
+		if m.dynamic && !key.Comparable() {
+			if key.Kind() == reflect.Interface {
+				key = key.Elem()
+			}
+			panic(noPanic{KeyError{m.t, key.Type()}})
+		}
+		d.decodeAt(m.v, val, step{k: key})
 		v.SetMapIndex(key, val)
 	}
 }
 
+// ptrMachine dereferences chains of pointers in a loop rather than calling
+// the machine of each pointer in turn.
 type ptrMachine struct {
-	z reflect.Value
-	t reflect.Type
-	m machine
+	z    reflect.Value
+	t    reflect.Type
+	m    machine
+	next *ptrMachine
 }
 
 func (m *ptrMachine) encode(e *encoder, v reflect.Value) {
-	if v.IsNil() {
-		e.writeByte(0)
-		return
+	for {
+		if v.IsNil() {
+			e.writeByte(0)
+			return
+		}
+		if e.mode&Refs != 0 {
+			if !e.ref(v) {
+				return
+			}
+		} else if e.mode&PreserveNil != 0 {
+			e.writeByte(1)
+		}
+		if v = v.Elem(); m.next == nil {
+			break
+		}
+		m = m.next
 	}
-	m.m.encode(e, v.Elem())
+	m.m.encode(e, v)
 }
 
 func (m *ptrMachine) decode(d *decoder, v reflect.Value) {
-	if decodeZero(d, v, m.z) {
-		return
-	}
-	if v.IsNil() {
-		v.Set(reflect.New(m.t))
+	for {
+		if decodeZero(d, v, m.z) {
+			return
+		}
+		if d.mode&Refs != 0 {
+			if !d.ref(v) {
+				return
+			}
+		} else {
+			if d.mode&PreserveNil != 0 {
+				d.present()
+			}
+			if v.IsNil() {
+				v.Set(d.new(m.t))
+			}
+		}
+		if v = v.Elem(); m.next == nil {
+			break
+		}
+		m = m.next
 	}
-	m.m.decode(d, v.Elem())
+	m.m.decode(d, v)
 }
 
 type sliceMachine struct {
@@ -347,17 +712,27 @@ type sliceMachine struct {
 }
 
 func (m *sliceMachine) encode(e *encoder, v reflect.Value) {
-	e.encodeUint(uint64(v.Len()))
+	e.encodeLen(v)
+	if e.encodeParallel(m.m, v) {
+		return
+	}
 	for i, l := 0, v.Len(); i < l; i++ {
-		m.m.encode(e, v.Index(i))
+		e.encodeAt(m.m, v.Index(i), step{i: i})
 	}
 }
 
 func (m *sliceMachine) decode(d *decoder, v reflect.Value) {
-	l := int(d.decodeUint())
-	v.Set(reflect.MakeSlice(m.t, l, l))
+	l, ok := d.decodeLen()
+	if !ok {
+		v.Set(reflect.Zero(m.t))
+		return
+	}
+	v.Set(d.makeSlice(m.t, l))
 	for i := 0; i < l; i++ {
-		m.m.decode(d, v.Index(i))
+		if i == v.Len() {
+			d.grow(v, i+1, l)
+		}
+		d.decodeAt(m.m, v.Index(i), step{i: i})
 	}
 }
 
@@ -372,45 +747,229 @@ func (stringMachine) decode(d *decoder, v reflect.Value) {
 	v.SetString(string(d.read(d.decodeUint())))
 }
 
-type structMachine []machine
+type structMachine struct {
+	t          reflect.Type
+	fields     []field
+	unexported bool
+	omitEmpty  bool
+	offsets    []offset
+	// defaults, validate and prepare are set if the type implements
+	// Defaulter, Validator and Preparer
+	defaults, validate, prepare bool
+	// bounded is set if fields have min or max tags
+	bounded bool
+}
+
+type field struct {
+	name      string
+	tag       reflect.StructTag
+	index     []int
+	m         machine
+	omitEmpty bool
+	redact    bool
+	bounds    *bounds
+}
+
+// value returns the field of the struct v,
+// going through package unsafe for unexported fields.
+func (f *field) value(v reflect.Value) reflect.Value {
+	for _, i := range f.index {
+		v = v.Field(i)
+		if !v.CanInterface() {
+			v = reflect.NewAt(v.Type(), unsafe.Pointer(v.UnsafeAddr())).Elem()
+		}
+	}
+	return v
+}
 
-func (m structMachine) encode(e *encoder, v reflect.Value) {
-	e.encodeUint(uint64(len(m)))
-	for i, m := range m {
-		m.encode(e, v.Field(i))
+// encoded returns the field of the struct v to encode,
+// which is its zero value if it is redacted in Redact mode.
+func (f *field) encoded(e *encoder, v reflect.Value) reflect.Value {
+	fv := f.value(v)
+	if f.redact && e.mode&Redact != 0 {
+		return reflect.Zero(fv.Type())
 	}
+	return fv
 }
 
-func (m structMachine) decode(d *decoder, v reflect.Value) {
-	l := len(m)
-	if t := int(d.decodeUint()); t < l {
-		l = t
+// field returns the index of the named field, or -1.
+func (m *structMachine) field(name string) int {
+	for i := range m.fields {
+		if m.fields[i].name == name {
+			return i
+		}
 	}
-	for i := 0; i < l; i++ {
-		m[i].decode(d, v.Field(i))
+	return -1
+}
+
+// addressable returns v, or an addressable copy of it if unexported fields need to be accessed.
+func (m *structMachine) addressable(v reflect.Value) reflect.Value {
+	if m.unexported && !v.CanAddr() {
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		v = c
+	}
+	return v
+}
+
+func (m *structMachine) encode(e *encoder, v reflect.Value) {
+	if m.prepare {
+		v = prepare(v)
+	}
+	m.encodeFields(e, v)
+}
+
+func (m *structMachine) encodeFields(e *encoder, v reflect.Value) {
+	v = m.addressable(v)
+	if e.mode&NamedFields != 0 {
+		m.encodeNamed(e, v)
+		return
+	}
+	l := len(m.fields)
+	if e.mode&OmitEmpty != 0 || m.omitEmpty {
+		for ; l > 0; l-- {
+			f := &m.fields[l-1]
+			if !(e.mode&OmitEmpty != 0 || f.omitEmpty) || !f.encoded(e, v).IsZero() {
+				break
+			}
+		}
+	}
+	e.encodeUint(uint64(l))
+	if m.fast(v, e.trace) {
+		p := unsafe.Pointer(v.UnsafeAddr())
+		for i := range m.fields[:l] {
+			if o := m.offsets[i]; o.kind != reflect.Invalid {
+				o.encode(e, p)
+			} else {
+				m.fields[i].m.encode(e, m.fields[i].encoded(e, v))
+			}
+		}
+		return
+	}
+	for i := range m.fields[:l] {
+		f := &m.fields[i]
+		e.encodeAt(f.m, f.encoded(e, v), step{name: f.name})
+	}
+}
+
+func (m *structMachine) decode(d *decoder, v reflect.Value) {
+	m.decodeOnly(d, v, nil)
+}
+
+// decodeOnly decodes the fields of v that want is set for, or all of them
+// if want is nil, and skips over the others, see DecodeFields.
+func (m *structMachine) decodeOnly(d *decoder, v reflect.Value, want []bool) {
+	if d.mode&NamedFields != 0 {
+		m.decodeNamed(d, v, want)
+	} else {
+		m.decodeFields(d, v, want)
+	}
+	m.check(v, want)
+}
+
+// check runs the range checks of the fields that want is set for
+// and the Validator of the decoded struct v.
+func (m *structMachine) check(v reflect.Value, want []bool) {
+	if m.bounded {
+		m.checkBounds(v, want)
+	}
+	if m.validate {
+		validate(v)
 	}
 }
 
+func (m *structMachine) decodeFields(d *decoder, v reflect.Value, want []bool) {
+	n := d.decodeCount()
+	if n > len(m.fields) || n < len(m.fields) && d.mode&(Strict|OmitEmpty) == Strict {
+		panic(noPanic{SchemaMismatchError{m.t, len(m.fields), n}})
+	}
+	if want == nil && m.fast(v, d.trace) {
+		p := unsafe.Pointer(v.UnsafeAddr())
+		for i := 0; i < n; i++ {
+			if o := m.offsets[i]; o.kind != reflect.Invalid {
+				o.decode(d, p)
+			} else {
+				m.fields[i].m.decode(d, m.fields[i].value(v))
+			}
+		}
+	} else {
+		for i := 0; i < n; i++ {
+			f := &m.fields[i]
+			if want != nil && !want[i] {
+				skip(d, f.m)
+				continue
+			}
+			d.decodeAt(f.m, f.value(v), step{name: f.name})
+		}
+	}
+	if m.defaults && n < len(m.fields) {
+		m.setDefaults(v, func(i int) bool { return i >= n && (want == nil || want[i]) })
+	}
+}
+
+type unsupportedMachine struct{ t reflect.Type }
+
+func (m unsupportedMachine) encode(e *encoder, v reflect.Value) {
+	if e.mode&SkipUnsupported == 0 {
+		panic(noPanic{TypeError{m.t}})
+	}
+}
+
+func (m unsupportedMachine) decode(d *decoder, v reflect.Value) {
+	if d.mode&SkipUnsupported == 0 {
+		panic(noPanic{TypeError{m.t}})
+	}
+	v.Set(reflect.Zero(m.t))
+}
+
 type bytesMachine struct{}
 
 func (bytesMachine) encode(e *encoder, v reflect.Value) {
-	e.encodeUint(uint64(v.Len()))
+	e.encodeLen(v)
 	e.write(v.Bytes())
 }
 
 func (bytesMachine) decode(d *decoder, v reflect.Value) {
-	v.SetBytes(d.read(d.decodeUint()))
+	l, ok := d.decodeLen()
+	if !ok {
+		v.SetBytes(nil)
+		return
+	}
+	v.SetBytes(d.read(uint64(l)))
 }
 
-type marshalerMachine struct{ e, d bool }
+// A marshalerMachine encodes through AppendBinary rather than
+// MarshalBinary if available, which saves allocating the result.
+type marshalerMachine struct {
+	t       reflect.Type
+	e, d, a bool
+}
+
+func marshalerOf(t reflect.Type) *marshalerMachine {
+	p := reflect.PtrTo(t)
+	e := p.Implements(marshalerType)
+	return &marshalerMachine{t, e, p.Implements(unmarshalerType), e && p.Implements(appenderType)}
+}
+
+// implements reports whether t or its pointer implements the interface i.
+func implements(t, i reflect.Type) bool {
+	return t.Implements(i) || reflect.PtrTo(t).Implements(i)
+}
 
 func (m *marshalerMachine) encode(e *encoder, v reflect.Value) {
 	if m.e {
 		v = v.Addr()
 	}
-	ret, err := v.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+	var ret []byte
+	var err error
+	if m.a {
+		ret, err = v.Interface().(encoding.BinaryAppender).AppendBinary(e.scratch[:0])
+		e.scratch = ret
+	} else {
+		ret, err = v.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+	}
 	if err != nil {
-		panic(noPanic{err})
+		panic(noPanic{MarshalerError{m.t, err}})
 	}
 	e.encodeUint(uint64(len(ret)))
 	e.write(ret)
@@ -421,6 +980,6 @@ func (m *marshalerMachine) decode(d *decoder, v reflect.Value) {
 		v = v.Addr()
 	}
 	if err := v.Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(d.read(d.decodeUint())); err != nil {
-		panic(noPanic{err})
+		panic(noPanic{MarshalerError{m.t, err}})
 	}
 }
@@ -0,0 +1,86 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"errors"
+	"reflect"
+)
+
+var errMapStream = errors.New("enc: map stream ended early")
+
+// mapStream is encoded by EncodeMapStream.
+type mapStream struct {
+	n    int
+	next func() (k, v interface{}, ok bool)
+}
+
+var mapStreamType = reflect.TypeOf(mapStream{})
+
+// EncodeMapStream writes a map of n entries, taken one by one from next,
+// without holding them all in memory. Keys and values are encoded as their
+// dynamic types, so that the result decodes like a map of these types.
+// Entries are written in the order next returns them, even in Canonical mode.
+// It fails if next runs out of entries early, and panics if a key or value
+// is of an invalid type.
+func (enc *Encoder) EncodeMapStream(n int, next func() (k, v interface{}, ok bool)) error {
+	return enc.encode(nil, reflect.ValueOf(mapStream{n, next}), false)
+}
+
+// DecodeMapStream reads a map entry by entry into the values k and v point to,
+// calling f after each, without holding them all in memory. Every key and value
+// is decoded into a zero value. Decoding fails with the error f returns.
+// It panics if k or v is of an invalid type.
+func (dec *Decoder) DecodeMapStream(k, v interface{}, f func() error) error {
+	kv, err := target(reflect.ValueOf(k))
+	if err != nil {
+		return err
+	}
+	vv, err := target(reflect.ValueOf(v))
+	if err != nil {
+		return err
+	}
+	return dec.run(nil, func(d *decoder) {
+		l, _ := d.decodeLen()
+		km, vm := d.types.get(kv.Type()), d.types.get(vv.Type())
+		kz, vz := reflect.Zero(kv.Type()), reflect.Zero(vv.Type())
+		for i := 0; i < l; i++ {
+			kv.Set(kz)
+			vv.Set(vz)
+			km.decode(d, kv)
+			d.decodeAt(vm, vv, step{k: kv})
+			if err := f(); err != nil {
+				panic(noPanic{err})
+			}
+		}
+	})
+}
+
+type mapStreamMachine struct{}
+
+func (mapStreamMachine) encode(e *encoder, v reflect.Value) {
+	s := v.Interface().(mapStream)
+	if e.mode&PreserveNil != 0 {
+		e.encodeUint(uint64(s.n) + 1)
+	} else {
+		e.encodeUint(uint64(s.n))
+	}
+	for i := 0; i < s.n; i++ {
+		k, x, ok := s.next()
+		if !ok {
+			panic(noPanic{errMapStream})
+		}
+		kv, xv := reflect.ValueOf(k), reflect.ValueOf(x)
+		if !kv.IsValid() || !xv.IsValid() {
+			panic(noPanic{errEncodeNil})
+		}
+		e.types.get(kv.Type()).encode(e, kv)
+		e.encodeAt(e.types.get(xv.Type()), xv, step{k: kv})
+	}
+}
+
+func (mapStreamMachine) decode(d *decoder, v reflect.Value) {
+	panic(noPanic{TypeError{mapStreamType}})
+}
@@ -0,0 +1,75 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// A Report breaks down the size of an encoded value by its parts.
+type Report struct {
+	// Bytes is the size of the whole value.
+	Bytes int
+	// Parts sums up the struct fields, elements and map values by their
+	// path, like .Field[].Name, in which the elements of slices and arrays
+	// and the values of maps are all folded into []. The size of a part
+	// includes that of the parts nested in it.
+	Parts map[string]Part
+}
+
+// A Part sums up the values found at a path of a Report.
+type Part struct {
+	Type  reflect.Type
+	Count int
+	Bytes int
+}
+
+// Measure encodes v like Size does and reports where its bytes go.
+// It panics if the value is of an invalid type.
+func Measure(v interface{}) (Report, error) {
+	m := measurer{Parts: make(map[string]Part)}
+	enc := NewEncoder(new(counter))
+	enc.SetMode(SnapshotChans)
+	enc.SetTracer(&m)
+	err := enc.Encode(v)
+	return Report(m), err
+}
+
+// String lists the parts of r from the largest to the smallest.
+func (r Report) String() string {
+	paths := make([]string, 0, len(r.Parts))
+	for p := range r.Parts {
+		paths = append(paths, p)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		a, b := r.Parts[paths[i]], r.Parts[paths[j]]
+		return a.Bytes > b.Bytes || a.Bytes == b.Bytes && paths[i] < paths[j]
+	})
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d bytes\n", r.Bytes)
+	for _, p := range paths {
+		part := r.Parts[p]
+		fmt.Fprintf(&b, "%10d %8d %s %v\n", part.Bytes, part.Count, p, part.Type)
+	}
+	return b.String()
+}
+
+// measurer is the Tracer of Measure. Tracers of its type fold elements into [].
+type measurer Report
+
+func (m *measurer) OnField(path string, t reflect.Type, n int) {
+	if path == "" {
+		m.Bytes = n
+		return
+	}
+	p := m.Parts[path]
+	p.Type = t
+	p.Count++
+	p.Bytes += n
+	m.Parts[path] = p
+}
@@ -0,0 +1,35 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"io"
+	"reflect"
+)
+
+// Migrate reads values of type t encoded in the modes from until the end of r
+// and writes them to w encoded in the modes to, for instance to convert stored
+// data to NamedFields mode. If r starts with a header, so does w, in the same
+// version. It panics if t is an invalid type.
+func Migrate(r io.Reader, w io.Writer, t reflect.Type, from, to Mode) error {
+	dec := NewDecoder(r)
+	dec.SetMode(from | Lenient)
+	enc := NewEncoder(w)
+	enc.SetMode(to)
+	for first := true; ; first = false {
+		v := reflect.New(t)
+		if err := dec.DecodeValue(v); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if first {
+			enc.SetVersion(dec.Options().Version)
+		}
+		if err := enc.EncodeValue(v); err != nil {
+			return err
+		}
+	}
+}
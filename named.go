@@ -0,0 +1,108 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"bytes"
+	"reflect"
+)
+
+// encodeNamed writes the fields of v along with their names and lengths
+// in NamedFields mode. Empty fields that may be omitted are left out.
+func (m *structMachine) encodeNamed(e *encoder, v reflect.Value) {
+	omit := func(f *field) bool {
+		return (e.mode&OmitEmpty != 0 || f.omitEmpty) && f.encoded(e, v).IsZero()
+	}
+	l := 0
+	for i := range m.fields {
+		if !omit(&m.fields[i]) {
+			l++
+		}
+	}
+	e.encodeUint(uint64(l))
+
+	var buf bytes.Buffer
+	k := *e
+	k.w, k.trace = &buf, nil
+	for i := range m.fields {
+		f := &m.fields[i]
+		if omit(f) {
+			continue
+		}
+		if e.ctx != nil {
+			e.cancel()
+		}
+		buf.Reset()
+		fv := f.encoded(e, v)
+		f.m.encode(&k, fv)
+		// k may have created the references map, which e must number on from
+		e.refs = k.refs
+		e.encodeUint(uint64(len(f.name)))
+		e.writeString(f.name)
+		write := func() {
+			e.encodeUint(uint64(buf.Len()))
+			e.write(buf.Bytes())
+		}
+		if e.trace != nil {
+			e.trace.run(step{name: f.name}.String(), fv.Type(), write)
+		} else {
+			write()
+		}
+	}
+}
+
+// decodeNamed reads fields written by encodeNamed into v.
+func (m *structMachine) decodeNamed(d *decoder, v reflect.Value, want []bool) {
+	n := d.decodeCount()
+	if n < len(m.fields) && d.mode&(Strict|OmitEmpty) == Strict {
+		panic(noPanic{SchemaMismatchError{m.t, len(m.fields), n}})
+	}
+	var seen []bool
+	if m.defaults {
+		seen = make([]bool, len(m.fields))
+	}
+	for i := 0; i < n; i++ {
+		j, l := m.readName(d)
+		if j < 0 || want != nil && !want[j] {
+			d.discard(l)
+			continue
+		}
+		f := &m.fields[j]
+		d.within(l, func(d *decoder) {
+			d.decodeAt(f.m, f.value(v), step{name: f.name})
+		})
+		if seen != nil {
+			seen[j] = true
+		}
+	}
+	if seen != nil {
+		m.setDefaults(v, func(i int) bool { return !seen[i] && (want == nil || want[i]) })
+	}
+}
+
+// readName reads the name and length of the next field in NamedFields mode,
+// and returns its index, or -1 if the field is unknown.
+// Unknown fields fail in Strict mode.
+func (m *structMachine) readName(d *decoder) (int, uint64) {
+	name := string(d.read(d.decodeUint()))
+	l := d.decodeUint()
+	j := m.field(name)
+	if j < 0 && d.mode&Strict != 0 {
+		panic(noPanic{FieldError{m.t, name}})
+	}
+	return j, l
+}
+
+// within calls f to decode a value taking up the next l bytes.
+func (d *decoder) within(l uint64, f func(*decoder)) {
+	lim := &limitReader{d.r, int64(d.count(l))}
+	sub := *d
+	sub.r, sub.lim = lim, lim
+	f(&sub)
+	if lim.n != 0 {
+		panic(noPanic{errFieldLen})
+	}
+	d.refs = sub.refs
+}
@@ -0,0 +1,124 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"net/netip"
+	"reflect"
+)
+
+var (
+	addrType   = reflect.TypeOf(netip.Addr{})
+	prefixType = reflect.TypeOf(netip.Prefix{})
+)
+
+// Tags of IP addresses, followed by the bytes of the address.
+const (
+	tagNoAddr = 0
+	tagIPv4   = 4
+	tagIPv6   = 6
+	tagZone   = 7 // IPv6 followed by the zone
+)
+
+// isIP reports whether t is net.IP, checked by name to spare importing package net.
+func isIP(t reflect.Type) bool {
+	return t.PkgPath() == "net" && t.Name() == "IP"
+}
+
+// netMachine encodes netip.Addr, netip.Prefix and net.IP values as a tag
+// followed by 4 or 16 bytes, rather than through their binary marshalers.
+// Prefixes add their length in bits, net.IP uses its length as the tag.
+type netMachine struct{ t reflect.Type }
+
+func (m netMachine) encode(e *encoder, v reflect.Value) {
+	switch m.t {
+	case addrType:
+		e.encodeAddr(v.Interface().(netip.Addr))
+	case prefixType:
+		p := v.Interface().(netip.Prefix)
+		e.encodeAddr(p.Addr())
+		if p.IsValid() {
+			e.writeByte(byte(p.Bits()))
+		}
+	default:
+		b := v.Bytes()
+		if l := len(b); l != 0 && l != 4 && l != 16 {
+			panic(noPanic{errIP})
+		}
+		e.writeByte(byte(len(b)))
+		e.write(b)
+	}
+}
+
+func (e *encoder) encodeAddr(a netip.Addr) {
+	switch {
+	case !a.IsValid():
+		e.writeByte(tagNoAddr)
+	case a.Is4():
+		e.writeByte(tagIPv4)
+		b := a.As4()
+		e.write(b[:])
+	default:
+		z := a.Zone()
+		if z == "" {
+			e.writeByte(tagIPv6)
+		} else {
+			e.writeByte(tagZone)
+		}
+		b := a.As16()
+		e.write(b[:])
+		if z != "" {
+			e.encodeUint(uint64(len(z)))
+			e.writeString(z)
+		}
+	}
+}
+
+func (m netMachine) decode(d *decoder, v reflect.Value) {
+	switch m.t {
+	case addrType:
+		v.Set(reflect.ValueOf(d.decodeAddr()))
+	case prefixType:
+		a := d.decodeAddr()
+		if !a.IsValid() {
+			v.Set(reflect.Zero(prefixType))
+			return
+		}
+		p := netip.PrefixFrom(a, int(d.readByte()))
+		if !p.IsValid() {
+			panic(noPanic{CorruptError{Reason: "invalid prefix length"}})
+		}
+		v.Set(reflect.ValueOf(p))
+	default:
+		switch l := d.readByte(); l {
+		case 0:
+			v.SetBytes(nil)
+		case 4, 16:
+			v.SetBytes(d.read(uint64(l)))
+		default:
+			panic(noPanic{CorruptError{Reason: "invalid IP length"}})
+		}
+	}
+}
+
+func (d *decoder) decodeAddr() netip.Addr {
+	switch d.readByte() {
+	case tagNoAddr:
+		return netip.Addr{}
+	case tagIPv4:
+		var b [4]byte
+		copy(b[:], d.read(4))
+		return netip.AddrFrom4(b)
+	case tagIPv6:
+		var b [16]byte
+		copy(b[:], d.read(16))
+		return netip.AddrFrom16(b)
+	case tagZone:
+		var b [16]byte
+		copy(b[:], d.read(16))
+		return netip.AddrFrom16(b).WithZone(string(d.read(d.decodeUint())))
+	}
+	panic(noPanic{CorruptError{Reason: "invalid address tag"}})
+}
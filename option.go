@@ -0,0 +1,68 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Option holds a value V if Valid is set. An Option without a value
+// encodes as a single 0 byte, one with a value as a 1 byte followed by V.
+// The Null types of database/sql, like sql.NullString, are encoded alike.
+type Option[T any] struct {
+	V     T
+	Valid bool
+}
+
+// Some returns an Option holding v.
+func Some[T any](v T) Option[T] {
+	return Option[T]{v, true}
+}
+
+// Get returns the value of o and whether it has one.
+func (o Option[T]) Get() (T, bool) {
+	return o.V, o.Valid
+}
+
+var optionPkg = reflect.TypeOf(Option[int]{}).PkgPath()
+
+// isOption reports whether t is an Option or a Null type of database/sql,
+// a struct of a value and a Valid flag.
+func isOption(t reflect.Type) bool {
+	switch {
+	case t.Kind() != reflect.Struct || t.NumField() != 2:
+		return false
+	case t.PkgPath() == optionPkg && strings.HasPrefix(t.Name(), "Option["):
+	case t.PkgPath() == "database/sql" && strings.HasPrefix(t.Name(), "Null"):
+	default:
+		return false
+	}
+	f := t.Field(1)
+	return f.Name == "Valid" && f.Type.Kind() == reflect.Bool
+}
+
+type optionMachine struct {
+	z reflect.Value
+	m machine
+}
+
+func (m *optionMachine) encode(e *encoder, v reflect.Value) {
+	if !v.Field(1).Bool() {
+		e.writeByte(0)
+		return
+	}
+	e.writeByte(1)
+	m.m.encode(e, v.Field(0))
+}
+
+func (m *optionMachine) decode(d *decoder, v reflect.Value) {
+	if decodeZero(d, v, m.z) {
+		return
+	}
+	d.present()
+	v.Field(1).SetBool(true)
+	m.m.decode(d, v.Field(0))
+}
@@ -0,0 +1,88 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"io"
+	"time"
+)
+
+// Options configure an Encoder or a Decoder.
+// Options only one of them uses are ignored by the other.
+type Options struct {
+	// Mode is the set of modes used for values.
+	Mode Mode
+
+	// Version is the wire format version, see Encoder.SetVersion and Decoder.SetVersion.
+	Version Version
+
+	// Flags are added to the registered flags of every type.
+	Flags Flags
+
+	// Parallelism and Threshold are used by Encoders, see Encoder.SetParallelism.
+	Parallelism, Threshold int
+
+	// Allocator is used by Decoders, see Decoder.SetAllocator.
+	Allocator Allocator
+
+	// SpillSize is used by Decoders, see Streamed.
+	SpillSize int64
+
+	// MaxMessageBytes limits the size of values,
+	// see Encoder.SetMaxMessageBytes and Decoder.SetMaxMessageBytes.
+	MaxMessageBytes int64
+
+	// MaxChanElements and MaxChanBuffer are used by Decoders, see Decoder.SetChanLimits.
+	MaxChanElements, MaxChanBuffer int
+
+	// ReadTimeout is used by Decoders, see Decoder.SetReadTimeout.
+	ReadTimeout time.Duration
+
+	// WriteTimeout is used by Encoders, see Encoder.SetWriteTimeout.
+	WriteTimeout time.Duration
+
+	// Chunk and ChunkSize are used by Encoders, see Encoder.SetChunkFunc.
+	Chunk     ChunkFunc
+	ChunkSize int64
+
+	// Stats counts the values encoded or decoded, see Stats.
+	Stats *Stats
+
+	// Tracer is told about the parts of values, see Tracer.
+	Tracer Tracer
+
+	// Progress and ProgressInterval are used by Decoders, see Decoder.SetProgress.
+	Progress         ProgressFunc
+	ProgressInterval int
+
+	// Sealer transforms the payload of frames, see Encoder.SetSealer.
+	Sealer Sealer
+}
+
+// NewEncoderOptions returns a new Encoder writing to w using o.
+func NewEncoderOptions(w io.Writer, o Options) *Encoder {
+	enc := NewEncoder(w)
+	enc.o = o
+	return enc
+}
+
+// Options returns the options of the Encoder.
+func (enc *Encoder) Options() Options {
+	return enc.o
+}
+
+// NewDecoderOptions returns a new Decoder reading from r using o.
+// It is in Strict mode unless o.Mode has Lenient set.
+func NewDecoderOptions(r io.Reader, o Options) *Decoder {
+	dec := NewDecoder(r)
+	dec.o = o
+	return dec
+}
+
+// Options returns the options of the Decoder.
+// Once the header of a stream has been read, they reflect its version and modes.
+func (dec *Decoder) Options() Options {
+	return dec.o
+}
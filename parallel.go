@@ -0,0 +1,63 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"bytes"
+	"reflect"
+	"sync"
+)
+
+// SetParallelism makes the Encoder split slices of at least min elements
+// into n shards that are encoded concurrently and written in order.
+// The output does not change. Parallelism is off in Refs mode,
+// as references may span shards, with a Tracer, whose events
+// come in order, and for n < 2.
+func (enc *Encoder) SetParallelism(n, min int) {
+	enc.o.Parallelism, enc.o.Threshold = n, min
+}
+
+// encodeParallel encodes the elements of the slice v using m in parallel
+// and reports whether it did so.
+func (e *encoder) encodeParallel(m machine, v reflect.Value) bool {
+	l := v.Len()
+	if e.parallel < 2 || l < e.threshold || l < e.parallel || e.mode&Refs != 0 || e.trace != nil {
+		return false
+	}
+
+	var (
+		wg     sync.WaitGroup
+		bufs   = make([]bytes.Buffer, e.parallel)
+		shards = make([]encoder, e.parallel)
+		panics = make([]interface{}, e.parallel)
+	)
+	// the first shard takes over the scratch buffer, and hands it back
+	shards[0].scratch = e.scratch
+	for s := range bufs {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			defer func() { panics[s] = recover() }()
+			se := &shards[s]
+			se.w, se.mode, se.version, se.ctx, se.types = &bufs[s], e.mode, e.version, e.ctx, e.types
+			for i, end := s*l/e.parallel, (s+1)*l/e.parallel; i < end; i++ {
+				if se.ctx != nil {
+					se.cancel()
+				}
+				m.encode(se, v.Index(i))
+			}
+		}(s)
+	}
+	wg.Wait()
+	e.scratch = shards[0].scratch
+
+	for s := range bufs {
+		if panics[s] != nil {
+			panic(panics[s])
+		}
+		e.write(bufs[s].Bytes())
+	}
+	return true
+}
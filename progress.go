@@ -0,0 +1,41 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+// Progress is the state of a decode in progress.
+type Progress struct {
+	// Elements counts the struct fields, elements and map values decoded so far.
+	Elements int64
+	// Bytes counts the bytes consumed from the stream so far.
+	Bytes int64
+}
+
+// A ProgressFunc is called every few elements while a value is decoded.
+// If it returns an error, decoding fails with it.
+type ProgressFunc func(Progress) error
+
+// SetProgress makes the Decoder call f every n elements while decoding a value,
+// which allows reporting on and aborting long decodes.
+// Elements are counted anew for every value. If n is 0, f is never called.
+func (dec *Decoder) SetProgress(f ProgressFunc, n int) {
+	dec.o.Progress, dec.o.ProgressInterval = f, n
+}
+
+type progress struct {
+	f     ProgressFunc
+	every int64
+	n     int64
+	in    *offsetReader
+}
+
+func (p *progress) step() {
+	p.n++
+	if p.n%p.every != 0 {
+		return
+	}
+	if err := p.f(Progress{p.n, p.in.n}); err != nil {
+		panic(noPanic{err})
+	}
+}
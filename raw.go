@@ -0,0 +1,31 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"bytes"
+	"reflect"
+)
+
+var rawType = reflect.TypeOf(Raw{})
+
+// Raw holds the encoding of a value, like json.RawMessage.
+// It is written as is, prefixed with its length, and read back without interpretation,
+// so that decoding the value it holds can be put off.
+type Raw []byte
+
+// NewRaw returns the encoding of v.
+// It panics if the value is of an invalid type.
+func NewRaw(v interface{}) (Raw, error) {
+	var buf bytes.Buffer
+	err := Encode(&buf, v)
+	return buf.Bytes(), err
+}
+
+// Decode unmarshals the value held by r into v.
+// It panics if the value is of an invalid type.
+func (r Raw) Decode(v interface{}) error {
+	return Decode(bytes.NewReader(r), v)
+}
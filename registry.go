@@ -0,0 +1,117 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"reflect"
+	"sync"
+)
+
+var names = struct {
+	sync.RWMutex
+	types map[string]reflect.Type
+	names map[reflect.Type]string
+
+	// builtin holds the types registered by default whose name may be replaced
+	builtin map[reflect.Type]bool
+}{types: make(map[string]reflect.Type), names: make(map[reflect.Type]string), builtin: make(map[reflect.Type]bool)}
+
+func init() {
+	for _, v := range []interface{}{
+		false, "", []byte(nil), []interface{}(nil), map[string]interface{}(nil),
+		int(0), int8(0), int16(0), int32(0), int64(0),
+		uint(0), uint8(0), uint16(0), uint32(0), uint64(0), uintptr(0),
+		float32(0), float64(0), complex64(0), complex128(0),
+	} {
+		Register(v)
+		names.builtin[reflect.TypeOf(v)] = true
+	}
+}
+
+// Register records the concrete type of v under a name derived from
+// its package path and type name, see RegisterName.
+func Register(v interface{}) {
+	RegisterName(typeName(reflect.TypeOf(v)), v)
+}
+
+// RegisterName records the concrete type of v under name, so that interface
+// values holding it can be encoded and decoded in Typed mode.
+// It panics if the name or the type is already registered otherwise,
+// except for types registered by default, like int: they are encoded
+// under the new name from then on, and still decoded under both.
+func RegisterName(name string, v interface{}) {
+	t := reflect.TypeOf(v)
+	if name == "" || t == nil {
+		panic("enc: RegisterName of empty name or nil value")
+	}
+	names.Lock()
+	defer names.Unlock()
+	if r, ok := names.types[name]; ok && r != t {
+		panic("enc: RegisterName of " + t.String() + " under " + name + " taken by " + r.String())
+	}
+	if n, ok := names.names[t]; ok && n != name && !names.builtin[t] {
+		panic("enc: RegisterName of " + t.String() + " under " + name + " registered as " + n)
+	}
+	names.types[name], names.names[t] = t, name
+	delete(names.builtin, t)
+}
+
+// RegisteredType returns the type registered under name, see RegisterName.
+func RegisteredType(name string) (reflect.Type, bool) {
+	names.RLock()
+	defer names.RUnlock()
+	t, ok := names.types[name]
+	return t, ok
+}
+
+// typeName returns the default name of t, qualified by its package path.
+func typeName(t reflect.Type) string {
+	star := ""
+	if t.Name() == "" && t.Kind() == reflect.Ptr {
+		star, t = "*", t.Elem()
+	}
+	if t.Name() == "" || t.PkgPath() == "" {
+		return star + t.String()
+	}
+	return star + t.PkgPath() + "." + t.Name()
+}
+
+// An UnregisteredError indicates an interface value of concrete type T
+// with no registered name, or an encoded Name with no registered type.
+type UnregisteredError struct {
+	T    reflect.Type
+	Name string
+}
+
+func (e UnregisteredError) Error() string {
+	if e.T != nil {
+		return "enc: type not registered: " + e.T.String()
+	}
+	return "enc: name not registered: " + e.Name
+}
+
+// encodeType writes the registered name of t.
+func (e *encoder) encodeType(t reflect.Type) {
+	names.RLock()
+	name, ok := names.names[t]
+	names.RUnlock()
+	if !ok {
+		panic(noPanic{UnregisteredError{T: t}})
+	}
+	e.encodeUint(uint64(len(name)))
+	e.writeString(name)
+}
+
+// decodeType reads a registered name and returns its type.
+func (d *decoder) decodeType() reflect.Type {
+	name := string(d.read(d.decodeUint()))
+	names.RLock()
+	t, ok := names.types[name]
+	names.RUnlock()
+	if !ok {
+		panic(noPanic{UnregisteredError{Name: name}})
+	}
+	return t
+}
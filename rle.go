@@ -0,0 +1,126 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"math"
+	"reflect"
+)
+
+var errRun = CorruptError{Reason: "invalid run length"}
+
+// rleMachine encodes slices of struct fields with the `enc:"rle"` tag
+// as their length followed by runs of equal elements,
+// each made up of its length and a single element.
+type rleMachine struct {
+	t reflect.Type
+	m machine
+}
+
+// rleable reports whether the `enc:"rle"` tag applies to type t,
+// a slice of booleans, numbers or strings.
+func rleable(t reflect.Type) bool {
+	if t.Kind() != reflect.Slice {
+		return false
+	}
+	switch t.Elem().Kind() {
+	case reflect.Bool, reflect.String, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return false
+}
+
+// same reports whether the elements a and b encode alike.
+func same(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Bool:
+		return a.Bool() == b.Bool()
+	case reflect.String:
+		return a.String() == b.String()
+	case reflect.Float32, reflect.Float64:
+		return math.Float64bits(a.Float()) == math.Float64bits(b.Float())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() == b.Int()
+	}
+	return a.Uint() == b.Uint()
+}
+
+func (m *rleMachine) encode(e *encoder, v reflect.Value) {
+	e.encodeLen(v)
+	for i, l := 0, v.Len(); i < l; {
+		j := i + 1
+		for j < l && same(v.Index(i), v.Index(j)) {
+			j++
+		}
+		e.encodeUint(uint64(j - i))
+		m.m.encode(e, v.Index(i))
+		i = j
+	}
+}
+
+func (m *rleMachine) decode(d *decoder, v reflect.Value) {
+	l, ok := d.decodeLen()
+	if !ok {
+		v.Set(reflect.Zero(m.t))
+		return
+	}
+	// runs make up for many elements with a few bytes of input
+	d.checkSize(uint64(l), m.t.Elem().Size())
+	size := uint64(m.t.Elem().Size())
+	d.checkRuns(uint64(l) * size)
+	v.Set(d.allocSlice(m.t, d.prealloc(l, m.t.Elem().Size())))
+	var start int64
+	if d.in != nil {
+		start = d.in.n
+	}
+	for i := 0; i < l; {
+		n := d.run(l - i)
+		if i+n > v.Len() {
+			// the size of the input is unknown, runs are appended as they arrive
+			d.checkRead(uint64(i+n)*size, start)
+			d.grow(v, i+n, l)
+		}
+		x := v.Index(i)
+		m.m.decode(d, x)
+		for j := i + 1; j < i+n; j++ {
+			v.Index(j).Set(x)
+		}
+		i += n
+	}
+}
+
+// maxExpansion is the number of bytes runs may take in memory
+// for every byte of input left.
+const maxExpansion = 1 << 20
+
+// checkRuns fails unless n bytes of runs may be allocated
+// for what is known to be left of the input.
+func (d *decoder) checkRuns(n uint64) {
+	if d.lim != nil && n/maxExpansion > uint64(d.lim.n) {
+		panic(noPanic{ErrTooLarge})
+	}
+	if d.left != nil && n/maxExpansion > uint64(d.left()) {
+		panic(noPanic{ErrTooLarge})
+	}
+}
+
+// checkRead fails unless n bytes of runs may be allocated
+// for the input read since start.
+func (d *decoder) checkRead(n uint64, start int64) {
+	if d.in == nil || n/maxExpansion > uint64(d.in.n-start) {
+		panic(noPanic{ErrTooLarge})
+	}
+}
+
+// run reads the length of a run of at most max elements.
+func (d *decoder) run(max int) int {
+	n := d.decodeUint()
+	if n == 0 || n > uint64(max) {
+		panic(noPanic{errRun})
+	}
+	return int(n)
+}
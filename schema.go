@@ -0,0 +1,377 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// A Schema describes how values of a type are laid out on the wire,
+// without any modes set.
+type Schema struct {
+	// Kind is one of bool, int, uint, float, complex, string, bytes,
+	// array, chan, interface, map, pointer, slice, rle, struct, marshaler,
+	// codec, enum, ip, option, compressed, unsupported, or ref for
+	// a recursive use of an enclosing type.
+	Kind string
+	// Type is the name of the Go type.
+	Type string
+	// Zero reports whether a single 0 byte stands for the zero value.
+	Zero bool
+	// Len is the length of an array, the number of values of an enum,
+	// or the length of every encoding of a codec with a fixed size.
+	Len int
+	// Key describes the keys of a map.
+	Key *Schema
+	// Elem describes the elements of an array, chan, map, pointer, slice or rle,
+	// or the value of an option.
+	Elem *Schema
+	// Fields describes the fields of a struct in wire order.
+	Fields []SchemaField
+}
+
+// A SchemaField describes a struct field.
+type SchemaField struct {
+	Name   string
+	Schema *Schema
+}
+
+// Describe returns the Schema of type t.
+// It panics if t is an invalid type.
+func Describe(t reflect.Type) *Schema {
+	return describeType(t, types.get(t), nil)
+}
+
+func describeType(t reflect.Type, m machine, stack []reflect.Type) *Schema {
+	for _, u := range stack {
+		if u == t {
+			return &Schema{Kind: "ref", Type: t.String()}
+		}
+	}
+	stack = append(stack, t)
+
+	s := &Schema{Type: t.String()}
+	if r, ok := m.(*recurseMachine); ok {
+		m = r.get()
+	}
+	if c, ok := m.(*compareMachine); ok {
+		s.Zero = true
+		m = c.m
+	}
+
+	switch m := m.(type) {
+	case boolMachine:
+		s.Kind = "bool"
+	case intMachine, unixNanoMachine:
+		s.Kind = "int"
+	case uintMachine:
+		s.Kind = "uint"
+	case floatMachine:
+		s.Kind = "float"
+	case complexMachine:
+		s.Kind = "complex"
+	case stringMachine:
+		s.Kind = "string"
+	case bytesMachine, streamedMachine, sinkMachine:
+		s.Kind = "bytes"
+	case *marshalerMachine:
+		s.Kind = "marshaler"
+	case *codecMachine:
+		s.Kind, s.Len = "codec", m.c.Size()
+	case *enumMachine:
+		s.Kind, s.Len = "enum", m.values.Len()
+	case unsupportedMachine:
+		s.Kind = "unsupported"
+	case *interfaceMachine:
+		s.Kind, s.Zero = "interface", true
+	case *arrayMachine:
+		s.Kind, s.Len = "array", m.l
+		s.Elem = describeType(t.Elem(), m.m, stack)
+	case *chanMachine:
+		s.Kind, s.Zero = "chan", true
+		s.Elem = describeType(t.Elem(), m.m, stack)
+	case *rleMachine:
+		s.Kind = "rle"
+		s.Elem = describeType(t.Elem(), m.m, stack)
+	case *sliceMachine:
+		s.Kind = "slice"
+		s.Elem = describeType(t.Elem(), m.m, stack)
+	case *ptrMachine:
+		s.Kind, s.Zero = "pointer", true
+		s.Elem = describeType(t.Elem(), m.m, stack)
+	case netMachine:
+		s.Kind = "ip"
+	case compressedMachine:
+		s.Kind = "compressed"
+	case *optionMachine:
+		s.Kind, s.Zero = "option", true
+		s.Elem = describeType(t.Field(0).Type, m.m, stack)
+	case *mapMachine:
+		s.Kind = "map"
+		s.Key = describeType(t.Key(), m.k, stack)
+		s.Elem = describeType(t.Elem(), m.v, stack)
+	case *structMachine:
+		s.Kind = "struct"
+		for i := range m.fields {
+			f := &m.fields[i]
+			s.Fields = append(s.Fields, SchemaField{f.name, describeType(t.FieldByIndex(f.index).Type, f.m, stack)})
+		}
+	default:
+		panic("enc: unknown machine")
+	}
+	return s
+}
+
+// MarshalJSON encodes s as a JSON object with lower case keys, leaving out empty ones.
+func (s *Schema) MarshalJSON() ([]byte, error) {
+	type field struct {
+		Name   string  `json:"name"`
+		Schema *Schema `json:"schema"`
+	}
+	v := struct {
+		Kind   string  `json:"kind"`
+		Type   string  `json:"type,omitempty"`
+		Zero   bool    `json:"zero,omitempty"`
+		Len    int     `json:"len,omitempty"`
+		Key    *Schema `json:"key,omitempty"`
+		Elem   *Schema `json:"elem,omitempty"`
+		Fields []field `json:"fields,omitempty"`
+	}{Kind: s.Kind, Type: s.Type, Zero: s.Zero, Len: s.Len, Key: s.Key, Elem: s.Elem}
+	for _, f := range s.Fields {
+		v.Fields = append(v.Fields, field(f))
+	}
+	return json.Marshal(v)
+}
+
+// Validate checks that data holds exactly one value laid out as s describes,
+// with well-formed varints and lengths that fit the data.
+// Values of interface types can only be checked if they are nil.
+func (s *Schema) Validate(data []byte) error {
+	v := validator{r: bytes.NewReader(data)}
+	if err := v.validate(s); err != nil {
+		return fmt.Errorf("enc: %v at offset %d", err, v.offset())
+	}
+	if v.r.Len() != 0 {
+		return fmt.Errorf("enc: trailing data at offset %d", v.offset())
+	}
+	return nil
+}
+
+type validator struct {
+	r     *bytes.Reader
+	stack []*Schema
+}
+
+func (v *validator) offset() int64 {
+	return v.r.Size() - int64(v.r.Len())
+}
+
+func (v *validator) uvarint() (uint64, error) {
+	u, err := readUvarint(v.r)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return u, err
+}
+
+// ip reads an IP address, followed by a length in bits if prefix is set.
+func (v *validator) ip(prefix bool) error {
+	b, err := v.r.ReadByte()
+	if err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	n := int(b)
+	switch b {
+	case tagNoAddr:
+		return nil
+	case tagIPv6, tagZone:
+		n = 16
+	case tagIPv4, 16:
+	default:
+		return errors.New("invalid address tag")
+	}
+	if prefix {
+		n++
+	}
+	if v.r.Len() < n {
+		return io.ErrUnexpectedEOF
+	}
+	v.r.Seek(int64(n), io.SeekCurrent)
+	if b == tagZone {
+		l, err := v.count()
+		if err != nil {
+			return err
+		}
+		v.r.Seek(int64(l), io.SeekCurrent)
+	}
+	return nil
+}
+
+// count reads a length or element count, which cannot exceed the remaining data.
+func (v *validator) count() (int, error) {
+	l, err := v.uvarint()
+	if err == nil && l > uint64(v.r.Len()) {
+		err = errors.New("length exceeds data")
+	}
+	return int(l), err
+}
+
+func (v *validator) validate(s *Schema) error {
+	if s.Kind == "ref" {
+		for i := len(v.stack) - 1; i >= 0; i-- {
+			if v.stack[i].Type == s.Type && v.stack[i].Kind != "ref" {
+				return v.validate(v.stack[i])
+			}
+		}
+		return errors.New("dangling ref to " + s.Type)
+	}
+	v.stack = append(v.stack, s)
+	defer func() { v.stack = v.stack[:len(v.stack)-1] }()
+
+	if s.Zero {
+		b, err := v.r.ReadByte()
+		if err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		if b == 0 {
+			return nil
+		}
+		v.r.UnreadByte()
+	}
+
+	switch s.Kind {
+	case "bool":
+		b, err := v.r.ReadByte()
+		if err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		if b > 1 {
+			return errors.New("invalid bool")
+		}
+	case "int", "uint", "float":
+		_, err := v.uvarint()
+		return err
+	case "complex":
+		if _, err := v.uvarint(); err != nil {
+			return err
+		}
+		_, err := v.uvarint()
+		return err
+	case "string", "bytes", "marshaler":
+		l, err := v.count()
+		if err != nil {
+			return err
+		}
+		v.r.Seek(int64(l), io.SeekCurrent)
+	case "enum":
+		b, err := v.r.ReadByte()
+		if err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		if int(b) >= s.Len {
+			return errors.New("invalid enum index")
+		}
+	case "codec":
+		l := s.Len
+		if l == 0 {
+			n, err := v.count()
+			if err != nil {
+				return err
+			}
+			l = n
+		} else if l > v.r.Len() {
+			return io.ErrUnexpectedEOF
+		}
+		v.r.Seek(int64(l), io.SeekCurrent)
+	case "array", "chan", "slice":
+		l, err := v.count()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < l; i++ {
+			if err := v.validate(s.Elem); err != nil {
+				return err
+			}
+		}
+	case "rle":
+		l, err := v.uvarint()
+		if err != nil {
+			return err
+		}
+		for l != 0 {
+			n, err := v.uvarint()
+			if err != nil {
+				return err
+			}
+			if n == 0 || n > l {
+				return errors.New("invalid run length")
+			}
+			if err := v.validate(s.Elem); err != nil {
+				return err
+			}
+			l -= n
+		}
+	case "map":
+		l, err := v.count()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < l; i++ {
+			if err := v.validate(s.Key); err != nil {
+				return err
+			}
+			if err := v.validate(s.Elem); err != nil {
+				return err
+			}
+		}
+	case "pointer":
+		return v.validate(s.Elem)
+	case "ip":
+		return v.ip(s.Type == prefixType.String())
+	case "compressed":
+		b, err := v.r.ReadByte()
+		switch {
+		case err != nil:
+			return io.ErrUnexpectedEOF
+		case b == flagDeflated:
+			if _, err := v.uvarint(); err != nil {
+				return err
+			}
+		case b != flagPlain:
+			return errors.New("invalid compressed flag")
+		}
+		l, err := v.count()
+		if err != nil {
+			return err
+		}
+		v.r.Seek(int64(l), io.SeekCurrent)
+	case "option":
+		if b, err := v.r.ReadByte(); err != nil || b != 1 {
+			return errors.New("invalid option tag")
+		}
+		return v.validate(s.Elem)
+	case "struct":
+		l, err := v.count()
+		if err != nil {
+			return err
+		}
+		if l > len(s.Fields) {
+			return errors.New("too many fields for " + s.Type)
+		}
+		for _, f := range s.Fields[:l] {
+			if err := v.validate(f.Schema); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New("cannot validate " + s.Kind + " " + s.Type)
+	}
+	return nil
+}
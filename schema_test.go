@@ -0,0 +1,48 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDescribe(t *testing.T) {
+	b, err := json.Marshal(Describe(reflect.TypeOf(Record{})))
+	if err != nil {
+		t.Error(err)
+	}
+	want := `{"kind":"struct","type":"enc.Record","fields":[` +
+		`{"name":"ID","schema":{"kind":"uint","type":"uint"}},` +
+		`{"name":"Tags","schema":{"kind":"map","type":"map[string]int","key":{"kind":"string","type":"string"},"elem":{"kind":"int","type":"int"}}},` +
+		`{"name":"Body","schema":{"kind":"bytes","type":"[]uint8"}},` +
+		`{"name":"Next","schema":{"kind":"pointer","type":"*enc.Record","zero":true,"elem":{"kind":"ref","type":"enc.Record"}}}]}`
+	if string(b) != want {
+		t.Errorf("unexpected schema %s", b)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	s := Describe(reflect.TypeOf(Test{}))
+	var buf bytes.Buffer
+	if err := Encode(&buf, randomValue(t, reflect.TypeOf(Test{}))); err != nil {
+		t.Error(err)
+	}
+	b := buf.Bytes()
+	if err := s.Validate(b); err != nil {
+		t.Error(err)
+	}
+	if err := s.Validate(b[:len(b)-1]); err == nil {
+		t.Error("truncated data passed validation")
+	}
+	if err := s.Validate(append(b, 0)); err == nil {
+		t.Error("trailing data passed validation")
+	}
+	if err := s.Validate([]byte{0xff, 0xff, 0xff, 0x0f}); err == nil {
+		t.Error("oversized struct passed validation")
+	}
+}
@@ -0,0 +1,108 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"hash"
+)
+
+// A Sealer transforms the payload of every frame in Framed mode,
+// like encrypting or authenticating it. The frame holds the sealed payload.
+// Sealers are given the offset of the frame from the first one of the
+// stream, after the header if any, to bind the payload to, so that frames
+// cannot be reordered or replayed within a stream.
+type Sealer interface {
+	// Seal appends the sealed form of payload to dst.
+	Seal(dst, payload []byte, offset int64) ([]byte, error)
+	// Open appends the payload sealed in sealed to dst,
+	// failing if sealed was not produced by Seal at the same offset.
+	Open(dst, sealed []byte, offset int64) ([]byte, error)
+}
+
+var (
+	errSealer = errors.New("enc: Sealer set outside Framed mode")
+	errMAC    = errors.New("message authentication failed")
+)
+
+// SetSealer makes the Encoder seal every frame with s.
+// It needs Framed mode, otherwise values fail to encode.
+func (enc *Encoder) SetSealer(s Sealer) {
+	enc.o.Sealer = s
+}
+
+// SetSealer makes the Decoder open every frame with s, failing with
+// a CorruptError for frames that do not open.
+// It needs Framed mode, otherwise values fail to decode.
+func (dec *Decoder) SetSealer(s Sealer) {
+	dec.o.Sealer = s
+}
+
+// AEADSealer returns a Sealer encrypting and authenticating payloads with a,
+// like AES-GCM, along with the offset of their frame as additional data.
+// Every sealed payload starts with a random nonce.
+func AEADSealer(a cipher.AEAD) Sealer {
+	return aeadSealer{a}
+}
+
+type aeadSealer struct{ a cipher.AEAD }
+
+func (s aeadSealer) Seal(dst, payload []byte, offset int64) ([]byte, error) {
+	n := len(dst)
+	dst = append(dst, make([]byte, s.a.NonceSize())...)
+	if _, err := rand.Read(dst[n:]); err != nil {
+		return nil, err
+	}
+	return s.a.Seal(dst, dst[n:], payload, sealOffset(offset)), nil
+}
+
+func (s aeadSealer) Open(dst, sealed []byte, offset int64) ([]byte, error) {
+	n := s.a.NonceSize()
+	if len(sealed) < n {
+		return nil, errMAC
+	}
+	return s.a.Open(dst, sealed[:n], sealed[n:], sealOffset(offset))
+}
+
+// sealOffset returns the bytes binding a sealed payload to the offset of its frame.
+func sealOffset(offset int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(offset))
+}
+
+// MACSealer returns a Sealer authenticating payloads, along with the offset
+// of their frame, with an HMAC of hash h and key, which is appended to them.
+func MACSealer(h func() hash.Hash, key []byte) Sealer {
+	return macSealer{h, key}
+}
+
+type macSealer struct {
+	h   func() hash.Hash
+	key []byte
+}
+
+func (s macSealer) Seal(dst, payload []byte, offset int64) ([]byte, error) {
+	h := hmac.New(s.h, s.key)
+	h.Write(sealOffset(offset))
+	h.Write(payload)
+	return h.Sum(append(dst, payload...)), nil
+}
+
+func (s macSealer) Open(dst, sealed []byte, offset int64) ([]byte, error) {
+	h := hmac.New(s.h, s.key)
+	n := len(sealed) - h.Size()
+	if n < 0 {
+		return nil, errMAC
+	}
+	h.Write(sealOffset(offset))
+	h.Write(sealed[:n])
+	if !hmac.Equal(h.Sum(nil), sealed[n:]) {
+		return nil, errMAC
+	}
+	return append(dst, sealed[:n]...), nil
+}
@@ -0,0 +1,33 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+// Size returns the number of bytes Encode would write for v.
+// Channels are snapshotted rather than drained.
+// It panics if the value is of an invalid type.
+func Size(v interface{}) (int, error) {
+	var c counter
+	enc := NewEncoder(&c)
+	enc.SetMode(SnapshotChans)
+	err := enc.Encode(v)
+	return int(c), err
+}
+
+type counter int
+
+func (c *counter) Write(p []byte) (int, error) {
+	*c += counter(len(p))
+	return len(p), nil
+}
+
+func (c *counter) WriteByte(byte) error {
+	*c++
+	return nil
+}
+
+func (c *counter) WriteString(s string) (int, error) {
+	*c += counter(len(s))
+	return len(s), nil
+}
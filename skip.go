@@ -0,0 +1,184 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"io"
+	"reflect"
+)
+
+// DecodeFields is like Decode for a pointer to a struct,
+// but only decodes the named fields and skips over the others.
+// It panics if the value is of an invalid type.
+func DecodeFields(r io.Reader, v interface{}, names ...string) error {
+	return lenient(r).DecodeFields(v, names...)
+}
+
+// DecodeFields is like Decode for a pointer to a struct,
+// but only decodes the named fields and skips over the others.
+// It panics if the value is of an invalid type.
+func (dec *Decoder) DecodeFields(v interface{}, names ...string) error {
+	rv, err := target(reflect.ValueOf(v))
+	if err != nil {
+		return err
+	}
+	m := cache(dec.o.Flags).get(rv.Type())
+	c, _ := m.(*compareMachine)
+	if c != nil {
+		m = c.m
+	}
+	s, ok := m.(*structMachine)
+	if !ok {
+		panic(TypeError{rv.Type()})
+	}
+	want := make([]bool, len(s.fields))
+	for _, n := range names {
+		i := s.field(n)
+		if i < 0 {
+			return FieldError{rv.Type(), n}
+		}
+		want[i] = true
+	}
+
+	start := dec.in.n
+	err = dec.run(nil, func(d *decoder) {
+		decode := func() {
+			if c != nil && d.zeroValue() {
+				rv.Set(c.zv)
+				s.check(rv, want)
+				return
+			}
+			s.decodeOnly(d, rv, want)
+		}
+		if d.trace != nil {
+			d.trace.run("", rv.Type(), decode)
+		} else {
+			decode()
+		}
+	})
+	if err == nil && dec.o.Stats != nil {
+		dec.o.Stats.add(rv.Type(), false, dec.in.n-start)
+	}
+	return err
+}
+
+// Skip reads past the next value in the stream, which is of type t,
+// without storing it anywhere.
+// It panics if t is an invalid type.
+func (dec *Decoder) Skip(t reflect.Type) error {
+	m := cache(dec.o.Flags).get(t)
+	return dec.run(nil, func(d *decoder) {
+		skip(d, m)
+	})
+}
+
+// skip reads past a value encoded by m.
+func skip(d *decoder, m machine) {
+	switch m := m.(type) {
+	case *recurseMachine:
+		skip(d, m.get())
+	case *compareMachine:
+		if !d.zeroValue() {
+			skip(d, m.m)
+		}
+	case netMachine:
+		m.decode(d, reflect.New(m.t).Elem())
+	case compressedMachine:
+		m.skip(d)
+	case *optionMachine:
+		if !d.zero() {
+			d.present()
+			skip(d, m.m)
+		}
+	case *enumMachine:
+		m.value(d)
+	case boolMachine:
+		d.readByte()
+	case intMachine, unixNanoMachine:
+		d.decodeInt()
+	case uintMachine, floatMachine:
+		d.decodeUint()
+	case complexMachine:
+		d.decodeUint()
+		d.decodeUint()
+	case stringMachine, *marshalerMachine:
+		d.discard(d.decodeUint())
+	case *codecMachine:
+		d.discard(m.len(d))
+	case bytesMachine, streamedMachine, sinkMachine:
+		l, _ := d.decodeLen()
+		d.discard(uint64(l))
+	case *arrayMachine:
+		for i, l := 0, d.decodeCount(); i < l; i++ {
+			skip(d, m.m)
+		}
+	case *chanMachine:
+		if d.zero() {
+			return
+		}
+		l, _ := d.decodeLen()
+		for i := 0; i < l; i++ {
+			skip(d, m.m)
+		}
+	case *rleMachine:
+		l, _ := d.decodeLen()
+		for i := 0; i < l; {
+			i += d.run(l - i)
+			skip(d, m.m)
+		}
+	case *sliceMachine:
+		l, _ := d.decodeLen()
+		for i := 0; i < l; i++ {
+			skip(d, m.m)
+		}
+	case *mapMachine:
+		l, _ := d.decodeLen()
+		for i := 0; i < l; i++ {
+			skip(d, m.k)
+			skip(d, m.v)
+		}
+	case *structMachine:
+		l := d.decodeCount()
+		if d.mode&NamedFields != 0 {
+			for i := 0; i < l; i++ {
+				d.discard(d.decodeUint())
+				d.discard(d.decodeUint())
+			}
+			return
+		}
+		if l > len(m.fields) {
+			panic(noPanic{errFields})
+		}
+		for i := 0; i < l; i++ {
+			skip(d, m.fields[i].m)
+		}
+	case *ptrMachine:
+		if d.zero() {
+			return
+		}
+		if d.mode&Refs != 0 {
+			if d.decodeUint() != 1 {
+				return
+			}
+		} else if d.mode&PreserveNil != 0 {
+			d.present()
+		}
+		skip(d, m.m)
+	case *interfaceMachine:
+		switch {
+		case d.zero():
+		case d.mode&Typed != 0:
+			skip(d, d.types.get(d.decodeType()))
+		default:
+			panic(noPanic{errSkip})
+		}
+	case unsupportedMachine:
+		if d.mode&SkipUnsupported == 0 {
+			panic(noPanic{TypeError{m.t}})
+		}
+	default:
+		panic("enc: unknown machine")
+	}
+}
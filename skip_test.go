@@ -0,0 +1,82 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeFields(t *testing.T) {
+	v := Record{ID: 1, Tags: map[string]int{"a": -1}, Body: []byte{2}, Next: &Record{ID: 3}}
+	var buf bytes.Buffer
+	if err := Encode(&buf, &v); err != nil {
+		t.Error(err)
+	}
+	buf.WriteByte(42)
+
+	var w Record
+	if err := DecodeFields(&buf, &w, "ID", "Body"); err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(w, Record{ID: 1, Body: []byte{2}}) {
+		t.Errorf("unexpected result %+v", w)
+	}
+	if b, _ := buf.ReadByte(); b != 42 {
+		t.Error("fields were not skipped correctly")
+	}
+
+	if _, ok := DecodeFields(&buf, &w, "Missing").(FieldError); !ok {
+		t.Error("expected FieldError")
+	}
+	if _, ok := DecodeFields(&buf, w, "ID").(AssignError); !ok {
+		t.Error("expected AssignError")
+	}
+}
+
+func TestDecodeFieldsHooks(t *testing.T) {
+	var buf bytes.Buffer
+	Encode(&buf, &Checked{1, &CheckedInner{2}})
+	validated = nil
+	var c Checked
+	if err := DecodeFields(&buf, &c, "N", "Inner"); !errors.Is(err, errInvalid) || !reflect.DeepEqual(validated, []string{"inner", "outer"}) {
+		t.Errorf("unexpected result %v %v", validated, err)
+	}
+
+	buf.Reset()
+	Encode(&buf, &struct{ A int }{7})
+	out := Defaults{B: "stale", C: []int{2}}
+	if err := DecodeFields(&buf, &out, "A", "B"); err != nil || !reflect.DeepEqual(out, Defaults{7, "default", []int{2}}) {
+		t.Errorf("unexpected result %+v %v", out, err)
+	}
+
+	buf.Reset()
+	Encode(&buf, &Bounded{Port: 2000})
+	var b Bounded
+	if err := DecodeFields(&buf, &b, "Level"); !errors.As(err, new(RangeError)) {
+		t.Error("expected RangeError, got", err)
+	}
+}
+
+func TestSkip(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	for _, v := range []interface{}{randomValue(t, reflect.TypeOf(Test{})), "next"} {
+		if err := e.Encode(v); err != nil {
+			t.Error(err)
+		}
+	}
+
+	d := NewDecoder(&buf)
+	if err := d.Skip(reflect.TypeOf(Test{})); err != nil {
+		t.Error(err)
+	}
+	var s string
+	if err := d.Decode(&s); err != nil || s != "next" {
+		t.Error("value was not skipped correctly", s, err)
+	}
+}
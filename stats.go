@@ -0,0 +1,129 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// misses counts the machines generated for types seen for the first time.
+var misses atomic.Int64
+
+// CacheMisses returns the number of times a type was seen for the first time
+// by any Encoder or Decoder, requiring it to be walked.
+func CacheMisses() int64 {
+	return misses.Load()
+}
+
+// TypeStats holds the number of values encoded and decoded, and their size in bytes.
+type TypeStats struct {
+	Encoded      int64 `json:"encoded"`
+	EncodedBytes int64 `json:"encodedBytes"`
+	Decoded      int64 `json:"decoded"`
+	DecodedBytes int64 `json:"decodedBytes"`
+}
+
+// Stats counts the values encoded and decoded by the Encoders and Decoders
+// it is set on, in total and per type. Only values that did not fail count.
+// Its zero value is ready to use and it may be shared between Encoders and
+// Decoders running concurrently. It implements expvar.Var.
+type Stats struct {
+	mu    sync.Mutex
+	total TypeStats
+	types map[reflect.Type]*TypeStats
+}
+
+// SetStats makes the Encoder count the values it encodes in s.
+func (enc *Encoder) SetStats(s *Stats) {
+	enc.o.Stats = s
+}
+
+// SetStats makes the Decoder count the values it decodes in s.
+func (dec *Decoder) SetStats(s *Stats) {
+	dec.o.Stats = s
+}
+
+// Total returns the counts for values of all types.
+func (s *Stats) Total() TypeStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.total
+}
+
+// Types returns the counts for values of each type.
+func (s *Stats) Types() map[reflect.Type]TypeStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make(map[reflect.Type]TypeStats, len(s.types))
+	for t, ts := range s.types {
+		ret[t] = *ts
+	}
+	return ret
+}
+
+// String returns the counts as JSON, with types named by reflect.Type.String.
+func (s *Stats) String() string {
+	v := struct {
+		Total       TypeStats            `json:"total"`
+		Types       map[string]TypeStats `json:"types"`
+		CacheMisses int64                `json:"cacheMisses"`
+	}{s.Total(), make(map[string]TypeStats), CacheMisses()}
+	for t, ts := range s.Types() {
+		v.Types[t.String()] = ts
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func (s *Stats) add(t reflect.Type, encoded bool, n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ts := s.types[t]
+	if ts == nil {
+		if s.types == nil {
+			s.types = make(map[reflect.Type]*TypeStats)
+		}
+		ts = new(TypeStats)
+		s.types[t] = ts
+	}
+	for _, ts := range []*TypeStats{&s.total, ts} {
+		if encoded {
+			ts.Encoded++
+			ts.EncodedBytes += n
+		} else {
+			ts.Decoded++
+			ts.DecodedBytes += n
+		}
+	}
+}
+
+// countWriter counts the bytes written to a writer.
+type countWriter struct {
+	Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *countWriter) WriteByte(c byte) error {
+	err := w.Writer.WriteByte(c)
+	if err == nil {
+		w.n++
+	}
+	return err
+}
+
+func (w *countWriter) WriteString(s string) (int, error) {
+	n, err := w.Writer.WriteString(s)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,117 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"reflect"
+)
+
+var (
+	streamedType = reflect.TypeOf(Streamed{})
+	sinkType     = reflect.TypeOf(Sink{})
+)
+
+// Streamed encodes N bytes read from R, laid out like a []byte,
+// without holding them in memory. A nil R stands for a nil []byte.
+// Decoding reads the bytes into memory and sets R to a reader over them.
+// If there are more than Options.SpillSize of them and it is not 0,
+// they go to a temporary file instead, and R is an *os.File
+// the caller has to close and remove.
+type Streamed struct {
+	R io.Reader
+	N int64
+}
+
+type streamedMachine struct{}
+
+func (streamedMachine) encode(e *encoder, v reflect.Value) {
+	s := v.Interface().(Streamed)
+	switch {
+	case e.mode&PreserveNil == 0:
+		e.encodeUint(uint64(s.N))
+	case s.R == nil:
+		e.writeByte(0)
+		return
+	default:
+		e.encodeUint(uint64(s.N) + 1)
+	}
+	if s.R == nil {
+		if s.N != 0 {
+			panic(noPanic{io.ErrUnexpectedEOF})
+		}
+		return
+	}
+	if _, err := io.CopyN(e.w, s.R, s.N); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		panic(noPanic{err})
+	}
+}
+
+func (streamedMachine) decode(d *decoder, v reflect.Value) {
+	l, ok := d.decodeLen()
+	if !ok {
+		v.Set(reflect.Zero(streamedType))
+		return
+	}
+	if d.spill == 0 || int64(l) <= d.spill {
+		v.Set(reflect.ValueOf(Streamed{bytes.NewReader(d.read(uint64(l))), int64(l)}))
+		return
+	}
+
+	f, err := os.CreateTemp("", "enc-")
+	if err != nil {
+		panic(noPanic{err})
+	}
+	if err := d.copy(f, int64(l)); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		panic(noPanic{err})
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		panic(noPanic{err})
+	}
+	v.Set(reflect.ValueOf(Streamed{f, int64(l)}))
+}
+
+// Sink decodes bytes laid out like a []byte by copying them to W,
+// without holding them in memory, and sets N to their number.
+// A nil W discards them. Sinks cannot be encoded.
+type Sink struct {
+	W io.Writer
+	N int64
+}
+
+type sinkMachine struct{}
+
+func (sinkMachine) encode(e *encoder, v reflect.Value) {
+	panic(noPanic{TypeError{sinkType}})
+}
+
+func (sinkMachine) decode(d *decoder, v reflect.Value) {
+	l, _ := d.decodeLen()
+	s := v.Addr().Interface().(*Sink)
+	if s.W == nil {
+		d.discard(uint64(l))
+	} else if err := d.copy(s.W, int64(l)); err != nil {
+		panic(noPanic{err})
+	}
+	s.N = int64(l)
+}
+
+// copy copies n bytes of the input to w.
+func (d *decoder) copy(w io.Writer, n int64) error {
+	_, err := io.CopyN(w, d.r, n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
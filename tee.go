@@ -0,0 +1,59 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"bufio"
+	"io"
+)
+
+// Tee makes the Encoder write everything it writes from now on to w as well,
+// like a log or a hash.Hash, so that both get the exact same bytes.
+// Output to w is buffered and flushed after every value.
+// Errors writing to w fail the value being encoded.
+func (enc *Encoder) Tee(w io.Writer) {
+	t := bufio.NewWriter(w)
+	enc.tees = append(enc.tees, t)
+	enc.w = &teeWriter{enc.w, t}
+}
+
+// flushTees flushes the buffers of the writers added by Tee.
+func (enc *Encoder) flushTees() error {
+	for _, t := range enc.tees {
+		if err := t.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type teeWriter struct {
+	Writer
+	t *bufio.Writer
+}
+
+func (w *teeWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if err == nil {
+		_, err = w.t.Write(p)
+	}
+	return n, err
+}
+
+func (w *teeWriter) WriteByte(c byte) error {
+	err := w.Writer.WriteByte(c)
+	if err == nil {
+		err = w.t.WriteByte(c)
+	}
+	return err
+}
+
+func (w *teeWriter) WriteString(s string) (int, error) {
+	n, err := w.Writer.WriteString(s)
+	if err == nil {
+		_, err = w.t.WriteString(s)
+	}
+	return n, err
+}
@@ -0,0 +1,48 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"errors"
+	"reflect"
+	"time"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+var (
+	errUnixNano = errors.New("enc: time out of the range of unixnano")
+
+	minUnixNano = time.Unix(0, -1<<63)
+	maxUnixNano = time.Unix(0, 1<<63-1)
+)
+
+// unixNanoMachine encodes a time.Time as nanoseconds since the Unix epoch.
+// The zero Time encodes as 0.
+type unixNanoMachine struct{}
+
+func (unixNanoMachine) encode(e *encoder, v reflect.Value) {
+	e.encodeInt(unixNano(v))
+}
+
+func (unixNanoMachine) decode(d *decoder, v reflect.Value) {
+	n := d.decodeInt()
+	if n == 0 {
+		v.Set(reflect.Zero(timeType))
+		return
+	}
+	v.Set(reflect.ValueOf(time.Unix(0, n).UTC()))
+}
+
+func unixNano(v reflect.Value) int64 {
+	t := v.Interface().(time.Time)
+	switch {
+	case t.IsZero():
+		return 0
+	case t.Before(minUnixNano) || t.After(maxUnixNano):
+		panic(noPanic{errUnixNano})
+	}
+	return t.UnixNano()
+}
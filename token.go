@@ -0,0 +1,287 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"io"
+	"reflect"
+)
+
+// A Token is a piece of an encoded value returned by Decoder.Token.
+// It is one of
+//
+//	Begin, End, Zero, Ref
+//	bool, int64, uint64, float64, complex128, string
+//	[]byte, for byte slices and the output of encoding.BinaryMarshaler or a Codec
+type Token interface{}
+
+// Begin starts an array, channel, map, slice or struct of Len elements.
+// Map entries count as a single element, made up of the key and the value.
+type Begin struct {
+	Kind reflect.Kind
+	Len  int
+}
+
+// End closes the innermost Begin.
+type End struct{}
+
+// Zero stands for the zero value of an array, channel, map, pointer,
+// slice or struct type, or of a type implementing encoding.BinaryMarshaler.
+type Zero struct{}
+
+// Ref refers back to the pointer target at the given index
+// among those introduced earlier in the value. It only occurs in Refs mode.
+type Ref uint64
+
+type tokenizer struct {
+	t     reflect.Type
+	stack []frame
+}
+
+type frame struct {
+	m    machine
+	i, n int
+
+	// the token repeated for the rest of a run of an rle slice
+	run int
+	tok Token
+
+	// a struct in NamedFields mode alternates names and values,
+	// the latter of field and size
+	named bool
+	field int
+	size  uint64
+}
+
+// SetTokenType sets the type of the values read by Token.
+func (dec *Decoder) SetTokenType(t reflect.Type) {
+	dec.tok = &tokenizer{t: t}
+}
+
+// Token returns the next token of the values in the stream,
+// which are of the type set by SetTokenType.
+// At the end of the stream, it returns nil, io.EOF.
+func (dec *Decoder) Token() (t Token, err error) {
+	k := dec.tok
+	if k == nil {
+		return nil, errTokenType
+	}
+	dec.guard.enter("Decoder")
+	defer dec.guard.exit()
+
+	start := dec.in.n
+	if len(k.stack) != 0 {
+		start = -1
+	}
+	defer func() {
+		switch p := recover(); p := p.(type) {
+		case nil:
+		case noPanic:
+			err = p.error
+		default:
+			panic(p)
+		}
+		err = dec.wrap(err, start)
+	}()
+
+	d := dec.start(len(k.stack) == 0)
+	for {
+		var m machine
+		if len(k.stack) == 0 {
+			if _, err := d.r.ReadByte(); err == io.EOF {
+				return nil, err
+			}
+			d.unreadByte()
+			m = d.types.get(k.t)
+		} else {
+			f := &k.stack[len(k.stack)-1]
+			if f.i == f.n {
+				k.stack = k.stack[:len(k.stack)-1]
+				return End{}, nil
+			}
+			if r, ok := f.m.(*rleMachine); ok {
+				return k.run(&d, f, r), nil
+			}
+			if f.named {
+				if t := k.named(&d, f); t != nil {
+					return t, nil
+				}
+				m = f.m.(*structMachine).fields[f.field].m
+				f.i++
+			} else {
+				m = f.next()
+			}
+		}
+		if t, ok := k.token(&d, m); ok {
+			return t, nil
+		}
+	}
+}
+
+// named returns the name of the next field of f in NamedFields mode,
+// or the value of an unknown one as bytes. It returns nil before
+// the value of a known field.
+func (k *tokenizer) named(d *decoder, f *frame) Token {
+	if f.i%2 == 0 {
+		f.i++
+		name := string(d.read(d.decodeUint()))
+		f.size = d.decodeUint()
+		f.field = f.m.(*structMachine).field(name)
+		return name
+	}
+	if f.field < 0 {
+		f.i++
+		return d.read(f.size)
+	}
+	return nil
+}
+
+// next returns the machine of the next element of f.
+func (f *frame) next() machine {
+	i := f.i
+	f.i++
+	switch m := f.m.(type) {
+	case *arrayMachine:
+		return m.m
+	case *chanMachine:
+		return m.m
+	case *mapMachine:
+		if i%2 == 0 {
+			return m.k
+		}
+		return m.v
+	case *sliceMachine:
+		return m.m
+	case *structMachine:
+		return m.fields[i].m
+	}
+	panic("enc: invalid frame")
+}
+
+// token reads the token for m. It reports false if m produced none.
+func (k *tokenizer) token(d *decoder, m machine) (Token, bool) {
+	switch m := m.(type) {
+	case *recurseMachine:
+		return k.token(d, m.get())
+	case *compareMachine:
+		if d.zeroValue() {
+			return Zero{}, true
+		}
+		return k.token(d, m.m)
+	case *enumMachine:
+		switch v := m.value(d); v.Kind() {
+		case reflect.String:
+			return v.String(), true
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return v.Int(), true
+		default:
+			return v.Uint(), true
+		}
+	case boolMachine:
+		return d.readByte() == 1, true
+	case intMachine, unixNanoMachine:
+		return d.decodeInt(), true
+	case uintMachine:
+		return d.decodeUint(), true
+	case floatMachine:
+		return d.decodeFloat(m.f32), true
+	case complexMachine:
+		return complex(d.decodeFloat(m.f32), d.decodeFloat(m.f32)), true
+	case stringMachine:
+		return string(d.read(d.decodeUint())), true
+	case bytesMachine, streamedMachine, sinkMachine:
+		l, ok := d.decodeLen()
+		if !ok {
+			return Zero{}, true
+		}
+		return d.read(uint64(l)), true
+	case *marshalerMachine:
+		return d.read(d.decodeUint()), true
+	case *codecMachine:
+		return d.read(m.len(d)), true
+	case *arrayMachine:
+		return k.begin(reflect.Array, m, d.decodeCount()), true
+	case *chanMachine:
+		if d.zero() {
+			return Zero{}, true
+		}
+		l, _ := d.decodeLen()
+		return k.begin(reflect.Chan, m, l), true
+	case *sliceMachine, *rleMachine:
+		l, ok := d.decodeLen()
+		if !ok {
+			return Zero{}, true
+		}
+		return k.begin(reflect.Slice, m, l), true
+	case *mapMachine:
+		l, ok := d.decodeLen()
+		if !ok {
+			return Zero{}, true
+		}
+		k.stack = append(k.stack, frame{m: m, n: 2 * l})
+		return Begin{reflect.Map, l}, true
+	case *structMachine:
+		l := d.decodeCount()
+		if d.mode&NamedFields != 0 {
+			k.stack = append(k.stack, frame{m: m, n: 2 * l, named: true})
+			return Begin{reflect.Struct, l}, true
+		}
+		if l > len(m.fields) {
+			panic(noPanic{errFields})
+		}
+		return k.begin(reflect.Struct, m, l), true
+	case netMachine:
+		v := reflect.New(m.t).Elem()
+		m.decode(d, v)
+		return v.Interface(), true
+	case compressedMachine:
+		v := reflect.New(m.t).Elem()
+		m.decode(d, v)
+		if m.t == compressedStringType {
+			return v.String(), true
+		}
+		return v.Bytes(), true
+	case *optionMachine:
+		if d.zero() {
+			return Zero{}, true
+		}
+		d.present()
+		return k.token(d, m.m)
+	case *ptrMachine:
+		if d.zero() {
+			return Zero{}, true
+		}
+		if d.mode&Refs != 0 {
+			if id := d.decodeUint(); id != 1 {
+				return Ref(id - 2), true
+			}
+		} else if d.mode&PreserveNil != 0 {
+			d.present()
+		}
+		return k.token(d, m.m)
+	case unsupportedMachine:
+		if d.mode&SkipUnsupported == 0 {
+			panic(noPanic{TypeError{m.t}})
+		}
+		return nil, false
+	}
+	panic(noPanic{errToken})
+}
+
+// run returns the next element of the rle slice in f.
+func (k *tokenizer) run(d *decoder, f *frame, m *rleMachine) Token {
+	if f.run == 0 {
+		f.run = d.run(f.n - f.i)
+		f.tok, _ = k.token(d, m.m)
+	}
+	f.run--
+	f.i++
+	return f.tok
+}
+
+func (k *tokenizer) begin(kind reflect.Kind, m machine, l int) Token {
+	k.stack = append(k.stack, frame{m: m, n: l})
+	return Begin{kind, l}
+}
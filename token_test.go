@@ -0,0 +1,56 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+type Record struct {
+	ID   uint
+	Tags map[string]int
+	Body []byte
+	Next *Record
+}
+
+func TestToken(t *testing.T) {
+	var buf bytes.Buffer
+	for _, v := range []Record{
+		{ID: 1, Tags: map[string]int{"a": -1}, Body: []byte{2}, Next: &Record{ID: 3}},
+		{},
+	} {
+		if err := Encode(&buf, &v); err != nil {
+			t.Error(err)
+		}
+	}
+
+	want := []Token{
+		Begin{reflect.Struct, 4},
+		uint64(1),
+		Begin{reflect.Map, 1}, "a", int64(-1), End{},
+		[]byte{2},
+		Begin{reflect.Struct, 4}, uint64(3), Begin{reflect.Map, 0}, End{}, []byte{}, Zero{}, End{},
+		End{},
+		Begin{reflect.Struct, 4}, uint64(0), Begin{reflect.Map, 0}, End{}, []byte{}, Zero{}, End{},
+	}
+
+	d := NewDecoder(&buf)
+	d.SetTokenType(reflect.TypeOf(Record{}))
+	for i, w := range want {
+		tok, err := d.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tok, w) {
+			t.Errorf("token %d: expected %#v, got %#v", i, w, tok)
+		}
+	}
+	if _, err := d.Token(); err != io.EOF {
+		t.Error("expected", io.EOF, "got", err)
+	}
+}
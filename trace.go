@@ -0,0 +1,97 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// A Tracer is told about the parts of values as they are encoded or decoded.
+type Tracer interface {
+	// OnField is called once the struct field, element or map value at path,
+	// like .Field[2]["key"], of type t took up n bytes. The whole value
+	// is reported last, with an empty path.
+	OnField(path string, t reflect.Type, n int)
+}
+
+// SetTracer makes the Encoder report the parts of the values it encodes to t.
+// It turns off parallelism, see SetParallelism.
+func (enc *Encoder) SetTracer(t Tracer) {
+	enc.o.Tracer = t
+}
+
+// SetTracer makes the Decoder report the parts of the values it decodes to t.
+func (dec *Decoder) SetTracer(t Tracer) {
+	dec.o.Tracer = t
+}
+
+type tracer struct {
+	t    Tracer
+	path string
+	pos  func() int64
+	// fold writes elements and map values as [] in paths
+	fold bool
+}
+
+// step is a part of a value: a struct field, an element or a map value.
+type step struct {
+	name string
+	i    int
+	k    reflect.Value
+}
+
+func (s step) String() string {
+	switch {
+	case s.name != "":
+		return "." + s.name
+	case s.k.IsValid():
+		return fmt.Sprintf("[%#v]", s.k)
+	}
+	return fmt.Sprintf("[%d]", s.i)
+}
+
+// step returns the path of the part s.
+func (t *tracer) step(s step) string {
+	if t.fold && s.name == "" {
+		return "[]"
+	}
+	return s.String()
+}
+
+func (t *tracer) run(p string, typ reflect.Type, f func()) {
+	path, start := t.path, t.pos()
+	t.path += p
+	f()
+	t.t.OnField(t.path, typ, int(t.pos()-start))
+	t.path = path
+}
+
+// encodeAt encodes the part s of the current value.
+func (e *encoder) encodeAt(m machine, v reflect.Value, s step) {
+	if e.ctx != nil {
+		e.cancel()
+	}
+	if e.trace == nil {
+		m.encode(e, v)
+		return
+	}
+	e.trace.run(e.trace.step(s), v.Type(), func() { m.encode(e, v) })
+}
+
+// decodeAt decodes the part s of the current value.
+func (d *decoder) decodeAt(m machine, v reflect.Value, s step) {
+	if d.ctx != nil {
+		d.cancel()
+	}
+	if d.progress != nil {
+		d.progress.step()
+	}
+	if d.trace == nil {
+		m.decode(d, v)
+		return
+	}
+	d.trace.run(d.trace.step(s), v.Type(), func() { m.decode(d, v) })
+}
@@ -0,0 +1,56 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// Value plugs the encoding of V into the standard interfaces
+// io.WriterTo, io.ReaderFrom, encoding.BinaryMarshaler and encoding.BinaryUnmarshaler.
+// V must be a pointer to be read into.
+type Value struct {
+	V interface{}
+}
+
+// WriteTo encodes V to w.
+func (v Value) WriteTo(w io.Writer) (int64, error) {
+	b, err := v.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// ReadFrom decodes V from r. It may read past the end of the value.
+func (v Value) ReadFrom(r io.Reader) (int64, error) {
+	c := &offsetReader{Reader: bufio.NewReader(r)}
+	err := Decode(c, v.V)
+	return c.n, err
+}
+
+// MarshalBinary returns the encoding of V.
+func (v Value) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	err := Encode(&buf, v.V)
+	return buf.Bytes(), err
+}
+
+// UnmarshalBinary decodes V from data, which must hold nothing else.
+func (v Value) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	if err := Decode(r, v.V); err != nil {
+		return err
+	}
+	if r.Len() != 0 {
+		err := errTrailing
+		err.Offset = r.Size() - int64(r.Len())
+		return err
+	}
+	return nil
+}
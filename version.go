@@ -0,0 +1,176 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import "strconv"
+
+// A Version identifies a wire format.
+type Version uint
+
+const (
+	// Version1 is the original wire format, used by default.
+	Version1 Version = 1 + iota
+
+	// Version2 writes floats with their bytes reversed, so that the varints of
+	// common values such as small integers get shorter, and float32 values in
+	// their 32-bit form.
+	Version2
+
+	// LatestVersion is the newest supported wire format.
+	LatestVersion = Version2
+)
+
+// WireVersion returns the newest wire format, LatestVersion.
+// The wire format is a stable contract: whatever the platform, values written
+// in any version decode with every later release of the package, and any change
+// to the format comes with a new version. Integers are written as varints of
+// 64 bits regardless of the size of int, uint and uintptr.
+func WireVersion() Version {
+	return LatestVersion
+}
+
+// wireModes are the modes that change the wire format.
+const wireModes = Refs | PreserveNil | SkipUnsupported | Framed | Typed | ExplicitZeros | NamedFields
+
+// A stream header starts with a two byte varint of 0, which no varint is,
+// followed by the version and the wire modes. Streams that would otherwise
+// start with these bytes, like the raw bytes of a fixed-size Codec, get
+// a header ahead of them, see leadWriter, so that Decoders tell them apart.
+var magic = [2]byte{0x80, 0x00}
+
+func (e *encoder) writeHeader() {
+	e.write(magic[:])
+	e.encodeUint(uint64(e.version))
+	e.encodeUint(uint64(e.mode & wireModes))
+}
+
+// readHeader picks up the version and modes from the header of the stream, if any.
+func (dec *Decoder) readHeader() {
+	d := decoder{r: dec.r}
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return
+	}
+	if b != magic[0] {
+		d.unreadByte()
+		return
+	}
+	if d.readByte() != magic[1] {
+		d.unreadByte()
+		dec.r = &prefixReader{b: b, n: 1, Reader: dec.r}
+		return
+	}
+
+	v := Version(d.decodeUint())
+	if v == 0 || v > LatestVersion {
+		panic(noPanic{VersionError{v}})
+	}
+	dec.o.Version = v
+	dec.o.Mode = dec.o.Mode&^wireModes | Mode(d.decodeUint())&wireModes
+}
+
+// A VersionError indicates a stream of an unsupported wire format version.
+type VersionError struct {
+	V Version
+}
+
+func (v VersionError) Error() string {
+	return "enc: unsupported version " + strconv.FormatUint(uint64(v.V), 10)
+}
+
+// prefixReader puts back a byte consumed while looking for a header.
+type prefixReader struct {
+	b    byte
+	n    int
+	last bool
+	Reader
+}
+
+func (p *prefixReader) Read(b []byte) (int, error) {
+	if p.n == 0 || len(b) == 0 {
+		p.last = false
+		return p.Reader.Read(b)
+	}
+	b[0], p.n, p.last = p.b, 0, false
+	n, err := p.Reader.Read(b[1:])
+	return n + 1, err
+}
+
+func (p *prefixReader) ReadByte() (byte, error) {
+	if p.n == 0 {
+		p.last = false
+		return p.Reader.ReadByte()
+	}
+	p.n, p.last = 0, true
+	return p.b, nil
+}
+
+func (p *prefixReader) UnreadByte() error {
+	if p.last {
+		p.n, p.last = 1, false
+		return nil
+	}
+	return p.Reader.UnreadByte()
+}
+
+// A leadWriter watches the first bytes of a stream without a header and
+// writes one ahead of them if they are those of magic. The first byte is
+// held back until the second one is known, or the value ends.
+type leadWriter struct {
+	Writer
+	e    *encoder
+	enc  *Encoder
+	held bool
+}
+
+func (w *leadWriter) Write(p []byte) (int, error) {
+	if w.enc.header || len(p) == 0 {
+		return w.Writer.Write(p)
+	}
+	if !w.held {
+		if p[0] != magic[0] {
+			w.enc.header = true
+			return w.Writer.Write(p)
+		}
+		w.held = true
+		if p = p[1:]; len(p) == 0 {
+			return 1, nil
+		}
+	}
+	w.release(p[0] == magic[1])
+	n, err := w.Writer.Write(p)
+	return n + 1, err
+}
+
+func (w *leadWriter) WriteByte(c byte) error {
+	_, err := w.Write([]byte{c})
+	return err
+}
+
+func (w *leadWriter) WriteString(s string) (int, error) {
+	if w.enc.header {
+		return w.Writer.WriteString(s)
+	}
+	return w.Write([]byte(s))
+}
+
+// release writes the byte held back, after a header if needed.
+func (w *leadWriter) release(header bool) {
+	w.enc.header = true
+	if header {
+		h := encoder{w: w.Writer, version: Version1, mode: w.e.mode}
+		h.writeHeader()
+	}
+	if err := w.Writer.WriteByte(magic[0]); err != nil {
+		panic(noPanic{err})
+	}
+}
+
+// finish releases a byte still held back once the value ends.
+func (w *leadWriter) finish() {
+	if w.held && !w.enc.header {
+		w.release(true)
+	}
+}
@@ -0,0 +1,111 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	type Floats struct {
+		A float32
+		B float64
+		C complex64
+		N *Floats
+	}
+	v := Floats{1, 0.5, 2 + 3i, new(Floats)}
+
+	var a, b bytes.Buffer
+	if err := Encode(&a, &v); err != nil {
+		t.Error(err)
+	}
+	e := NewEncoder(&b)
+	e.SetVersion(Version2)
+	e.SetMode(PreserveNil)
+	for i := 0; i < 2; i++ {
+		if err := e.Encode(&v); err != nil {
+			t.Error(err)
+		}
+	}
+	if b.Len() >= 2*a.Len() {
+		t.Error("Version2 is not shorter:", b.Len(), a.Len())
+	}
+
+	d := NewDecoder(&b)
+	for i := 0; i < 2; i++ {
+		var w Floats
+		if err := d.Decode(&w); err != nil {
+			t.Error(err)
+		}
+		if !reflect.DeepEqual(v, w) {
+			t.Error("decoded data does not match encoded data")
+		}
+	}
+}
+
+func TestNoHeader(t *testing.T) {
+	// 128 starts with the first byte of a header
+	u := uint(128)
+	testEquals(t, &u, new(uint))
+	testEquals(t, &[2]uint{128, 1}, new([2]uint))
+}
+
+// octet is written as is by a fixed-size codec.
+type octet byte
+
+type octetCodec struct{}
+
+func (octetCodec) Size() int { return 1 }
+
+func (octetCodec) Append(b []byte, v reflect.Value) ([]byte, error) {
+	return append(b, byte(v.Uint())), nil
+}
+
+func (octetCodec) Decode(b []byte, v reflect.Value) error {
+	v.SetUint(uint64(b[0]))
+	return nil
+}
+
+// TestLeadingMagic checks that streams starting with the bytes of a header,
+// which only fixed-size codecs write as is, get one ahead of them.
+func TestLeadingMagic(t *testing.T) {
+	RegisterCodec(reflect.TypeOf(octet(0)), octetCodec{})
+	for _, c := range []struct {
+		vs     []interface{}
+		header bool
+	}{
+		{[]interface{}{octet(0x80), uint(0)}, true},
+		{[]interface{}{octet(0x80), octet(0)}, true},
+		{[]interface{}{octet(0x80)}, true},
+		// the value ends before the next byte is known
+		{[]interface{}{octet(0x80), octet(1)}, true},
+		{[]interface{}{octet(0), octet(0x80), octet(0)}, false},
+		{[]interface{}{uint(128), octet(0)}, false},
+	} {
+		for _, m := range []Mode{0, PreserveNil, OmitEmpty | Canonical} {
+			var buf bytes.Buffer
+			e := NewEncoder(&buf)
+			e.SetMode(m)
+			for _, v := range c.vs {
+				if err := e.Encode(v); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if h := bytes.HasPrefix(buf.Bytes(), magic[:]); h != c.header {
+				t.Errorf("%v in mode %d: header %v: %x", c.vs, m, h, buf.Bytes())
+			}
+			d := NewDecoder(&buf)
+			d.SetMode(m)
+			for _, v := range c.vs {
+				w := reflect.New(reflect.TypeOf(v))
+				if err := d.Decode(w.Interface()); err != nil || w.Elem().Interface() != v {
+					t.Errorf("%v in mode %d: decoded %v, %v", c.vs, m, w.Elem(), err)
+				}
+			}
+		}
+	}
+}
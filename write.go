@@ -0,0 +1,139 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package enc
+
+import (
+	"bytes"
+	"io"
+	"time"
+)
+
+// A writeDeadliner can time out writes, like a net.Conn.
+type writeDeadliner interface {
+	SetWriteDeadline(time.Time) error
+}
+
+// SetWriteTimeout makes the Encoder give up writing a value d after it
+// started, if the writer it was created with has a SetWriteDeadline
+// method like net.Conn. A peer that stops reading then makes encoding
+// fail with the timeout error of the writer, rather than blocking it for
+// good. The value may have been written in part; in Framed mode, Decoders
+// skip it with Resync. If d is 0, writes never time out.
+func (enc *Encoder) SetWriteTimeout(d time.Duration) {
+	enc.o.WriteTimeout = d
+}
+
+func (enc *Encoder) setDeadline(t time.Time) {
+	if err := enc.deadline.SetWriteDeadline(t); err != nil {
+		panic(noPanic{err})
+	}
+}
+
+// A ChunkFunc is called with the number of bytes of a value written so far.
+// If it returns an error, encoding fails with it.
+type ChunkFunc func(written int64) error
+
+// SetChunkFunc makes the Encoder call f every n bytes it writes while
+// encoding a value, which allows reporting on and aborting long encodes.
+// Bytes are counted anew for every value. Output buffered by the Encoder
+// counts once it is handed to the buffer. If n is 0, f is never called.
+func (enc *Encoder) SetChunkFunc(f ChunkFunc, n int64) {
+	enc.o.Chunk, enc.o.ChunkSize = f, n
+}
+
+// A chunkWriter calls f whenever another every bytes went through it.
+type chunkWriter struct {
+	Writer
+	f            ChunkFunc
+	every, n, at int64
+}
+
+func (w *chunkWriter) wrote(n int) error {
+	w.n += int64(n)
+	if w.n < w.at {
+		return nil
+	}
+	w.at = w.n - w.n%w.every + w.every
+	return w.f(w.n)
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, w.wrote(n)
+}
+
+func (w *chunkWriter) WriteByte(c byte) error {
+	if err := w.Writer.WriteByte(c); err != nil {
+		return err
+	}
+	return w.wrote(1)
+}
+
+func (w *chunkWriter) WriteString(s string) (int, error) {
+	n, err := w.Writer.WriteString(s)
+	if err != nil {
+		return n, err
+	}
+	return n, w.wrote(n)
+}
+
+// EncodeMax is like Encode, but fails with ErrTooLarge as soon as the
+// encoding of v exceeds max bytes, for protocols limiting the size of
+// messages. Nothing is written to w unless v fits.
+func EncodeMax(w io.Writer, v interface{}, max int64) error {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SetMaxMessageBytes(max)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// SetMaxMessageBytes makes encoding fail with ErrTooLarge as soon as a value
+// takes more than n bytes, including its frame in Framed mode. What was
+// written of it until then is left in the stream. 0 means no limit.
+func (enc *Encoder) SetMaxMessageBytes(n int64) {
+	enc.o.MaxMessageBytes = n
+}
+
+// A limitWriter fails writes beyond the left bytes.
+type limitWriter struct {
+	Writer
+	left int64
+}
+
+func (w *limitWriter) take(n int) error {
+	if int64(n) > w.left {
+		return ErrTooLarge
+	}
+	w.left -= int64(n)
+	return nil
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	if err := w.take(len(p)); err != nil {
+		return 0, err
+	}
+	return w.Writer.Write(p)
+}
+
+func (w *limitWriter) WriteByte(c byte) error {
+	if err := w.take(1); err != nil {
+		return err
+	}
+	return w.Writer.WriteByte(c)
+}
+
+func (w *limitWriter) WriteString(s string) (int, error) {
+	if err := w.take(len(s)); err != nil {
+		return 0, err
+	}
+	return w.Writer.WriteString(s)
+}